@@ -0,0 +1,26 @@
+#version 430
+
+// One direction of a separable Gaussian blur
+
+in vec2 screen_uv;
+
+out vec4 out_color;
+
+layout(binding = 0) uniform sampler2D image;
+
+uniform bool horizontal;
+
+const float weights[5] = float[](0.227027, 0.1945946, 0.1216216, 0.054054, 0.016216);
+
+void main() {
+    vec2 texel = 1.0 / vec2(textureSize(image, 0));
+    vec2 offset = horizontal ? vec2(texel.x, 0.0) : vec2(0.0, texel.y);
+
+    vec3 result = texture(image, screen_uv).rgb * weights[0];
+    for (int i = 1; i < 5; i++) {
+        result += texture(image, screen_uv + offset * float(i)).rgb * weights[i];
+        result += texture(image, screen_uv - offset * float(i)).rgb * weights[i];
+    }
+
+    out_color = vec4(result, 1.0);
+}
@@ -0,0 +1,22 @@
+#version 430
+
+// Extracts the parts of the HDR image which should bloom: over-bright pixels
+// and emissive surfaces
+
+in vec2 screen_uv;
+
+out vec4 out_color;
+
+layout(binding = 0) uniform sampler2D hdr_color;
+layout(binding = 1) uniform sampler2D hdr_emissive;
+
+uniform float threshold;
+
+void main() {
+    vec3 color = texture(hdr_color, screen_uv).rgb;
+    float brightness = max(color.r, max(color.g, color.b));
+    // Only the part over the threshold, keeping the colour's hue
+    vec3 over = color * max(brightness - threshold, 0.0) / max(brightness, 0.0001);
+
+    out_color = vec4(over + texture(hdr_emissive, screen_uv).rgb, 1.0);
+}
@@ -0,0 +1,10 @@
+#version 430
+
+out vec2 screen_uv;
+
+// Covers the screen with a single triangle (no vertex buffer needed)
+void main() {
+    vec2 pos = vec2((gl_VertexID << 1) & 2, gl_VertexID & 2);
+    screen_uv = pos;
+    gl_Position = vec4(pos * 2.0 - 1.0, 0.0, 1.0);
+}
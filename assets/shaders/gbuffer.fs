@@ -0,0 +1,91 @@
+#version 430
+
+// Writes the geometry and material of each fragment to the G-buffer, for the
+// lighting to be done later in a single full screen pass (see deferred.go)
+
+in vec3 world_pos;
+in vec3 world_normal;
+in mat3 TBN;
+in vec2 uv;
+
+// w is 1 where there's geometry
+layout(location = 0) out vec4 g_position;
+layout(location = 1) out vec4 g_normal;
+// a is the reflectiveness
+layout(location = 2) out vec4 g_albedo;
+// a is the shininess, or -1 for metallic-roughness materials (with metallic,
+// roughness and ambient occlusion in rgb)
+layout(location = 3) out vec4 g_specular;
+layout(location = 4) out vec4 g_emmissive;
+
+// per-object
+uniform vec3 m_diffuse_color;
+uniform vec3 m_specular_color;
+uniform bool normal_map;
+uniform vec3 m_emmissive_color;
+uniform float m_shininess;
+uniform float m_reflectiveness;
+uniform bool m_pbr;
+uniform float m_metallic;
+uniform float m_roughness;
+uniform bool metallic_roughness_map;
+uniform bool occlusion_map;
+
+layout(binding = 0) uniform sampler2D tex_diffuse;
+layout(binding = 1) uniform sampler2D tex_specular;
+layout(binding = 2) uniform sampler2D tex_normal;
+layout(binding = 3) uniform sampler2D tex_emmissive;
+layout(binding = 13) uniform sampler2D tex_metallic_roughness;
+layout(binding = 14) uniform sampler2D tex_occlusion;
+
+vec3 diffuse_color() {
+    if (m_diffuse_color != vec3(0.0)) {
+        return m_diffuse_color;
+    }
+
+    return texture(tex_diffuse, uv).rgb;
+}
+vec3 specular_color() {
+    if (m_specular_color != vec3(0.0)) {
+        return m_specular_color;
+    }
+
+    return texture(tex_specular, uv).rgb;
+}
+vec3 emmissive_color() {
+    if (m_emmissive_color != vec3(0.0)) {
+        return m_emmissive_color;
+    }
+
+    return texture(tex_emmissive, uv).rgb;
+}
+
+void main() {
+    vec3 normal;
+    if (normal_map) {
+        // TBN transforms from world to tangent space
+        normal = transpose(TBN) * (texture(tex_normal, uv).rgb * 2.0 - 1.0);
+    } else {
+        normal = world_normal;
+    }
+
+    g_position = vec4(world_pos, 1.0);
+    g_normal = vec4(normalize(normal), 0.0);
+    g_albedo = vec4(diffuse_color(), m_reflectiveness);
+    if (m_pbr) {
+        float metallic = m_metallic, roughness = m_roughness, occlusion = 1.0;
+        if (metallic_roughness_map) {
+            vec4 mr = texture(tex_metallic_roughness, uv);
+            roughness *= mr.g;
+            metallic *= mr.b;
+        }
+        if (occlusion_map) {
+            occlusion = texture(tex_occlusion, uv).r;
+        }
+
+        g_specular = vec4(metallic, roughness, occlusion, -1.0);
+    } else {
+        g_specular = vec4(specular_color(), m_shininess);
+    }
+    g_emmissive = vec4(emmissive_color(), 1.0);
+}
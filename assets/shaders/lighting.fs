@@ -1,8 +1,11 @@
 #version 430
 
-#define N_DIRS {{len .Dirs}}
-#define N_LAMPS {{len .Lamps}}
-#define N_SPOTLIGHTS {{len .Spotlights}}
+#define N_CASCADES {{.Cascades}}
+#define CASCADE_CASTER_MARGIN {{printf "%.1f" .CascadeCasterMargin}}
+
+#define CLUSTERS_X {{.ClustersX}}
+#define CLUSTERS_Y {{.ClustersY}}
+#define CLUSTERS_Z {{.ClustersZ}}
 
 struct attenuation_params {
     float constant;
@@ -10,15 +13,33 @@ struct attenuation_params {
     float quadratic;
 };
 
+// The light structs are laid out following std430 (see lightbuffer.go)
+
+// See ShadowParams
+struct shadow_params {
+    int filter_mode;
+    float bias, slope_bias, normal_offset;
+    float radius;
+    int samples;
+    float light_size;
+};
+
 struct dir {
     vec3 direction;
     vec3 ambient, diffuse, specular;
+
+    shadow_params shadow;
+    mat4 shadow_transforms[N_CASCADES];
 };
 struct lamp {
     attenuation_params attenuation;
 
     vec3 position;
     vec3 ambient, diffuse, specular;
+
+    shadow_params shadow;
+    // Cube map in the depth map array (-1 if the lamp doesn't cast shadows)
+    int shadow_map;
 };
 struct spotlight {
     attenuation_params attenuation;
@@ -26,22 +47,86 @@ struct spotlight {
     vec3 position, direction;
     float cutoff, outer_cutoff;
     vec3 ambient, diffuse, specular;
+
+    shadow_params shadow;
+    mat4 shadow_transform;
+    // Fraction of the shadow map layer used (spotlights can have different
+    // resolutions)
+    float shadow_scale;
 };
 
+{{if .Deferred}}
+// Read from the G-buffer (see gbuffer.fs)
+vec3 world_pos;
+vec3 world_normal;
+{{else}}
 in vec3 world_pos;
 in vec3 world_normal;
 in mat3 TBN;
 in vec2 uv;
+{{end}}
 
-out vec4 out_color;
+layout(location = 0) out vec4 out_color;
+// Contribution to bloom (see postprocess.go)
+layout(location = 1) out vec4 out_emissive;
+
+layout(std430, binding = 2) readonly buffer dirs_buffer {
+    int n_dirs;
+    dir dirs[];
+};
+layout(std430, binding = 3) readonly buffer lamps_buffer {
+    int n_lamps;
+    lamp lamps[];
+};
+layout(std430, binding = 4) readonly buffer spotlights_buffer {
+    int n_spotlights;
+    spotlight spotlights[];
+};
+// For each cluster, the offset of its lights in light_indices and the number
+// of lamps and spotlights (see clusters.go)
+layout(std430, binding = 5) readonly buffer clusters_buffer {
+    ivec4 clusters[CLUSTERS_X * CLUSTERS_Y * CLUSTERS_Z];
+    int light_indices[];
+};
 
 // global
 uniform vec3 view_pos;
-uniform dir dirs[N_DIRS];
-uniform lamp lamps[N_LAMPS];
-uniform spotlight spotlights[N_SPOTLIGHTS];
 uniform float far_plane;
 uniform bool shadows_enabled;
+uniform mat4 camera;
+// View space depth of the far end of each shadow cascade
+uniform float cascade_splits[N_CASCADES];
+// Radius of the sphere each cascade is fitted to
+uniform float cascade_radii[N_CASCADES];
+uniform float spot_near_plane;
+uniform vec2 viewport_size;
+// Depth range split into cluster slices (cluster_near is 0 if lights haven't
+// been clustered)
+uniform float cluster_near, cluster_far;
+// Screen space ambient occlusion (see ssao.go)
+uniform bool ssao_enabled;
+layout(binding = 12) uniform sampler2D ssao_map;
+float occlusion = 1.0;
+
+// Metallic-roughness material (set up in main)
+bool pbr;
+float metallic, roughness;
+
+{{if .Deferred}}
+uniform mat4 projection;
+
+layout(binding = 0) uniform sampler2D g_position;
+layout(binding = 1) uniform sampler2D g_normal;
+layout(binding = 2) uniform sampler2D g_albedo;
+layout(binding = 3) uniform sampler2D g_specular;
+layout(binding = 11) uniform sampler2D g_emmissive;
+
+vec3 g_diffuse_color, g_specular_color, g_emmissive_color;
+float m_shininess;
+float m_reflectiveness;
+{{else}}
+// Writes world space normals only (the SSAO prepass)
+uniform bool normal_pass;
 
 // per-object
 uniform vec3 m_diffuse_color;
@@ -50,18 +135,57 @@ uniform bool normal_map;
 uniform vec3 m_emmissive_color;
 uniform float m_shininess;
 uniform float m_reflectiveness;
+uniform bool m_pbr;
+uniform float m_metallic;
+uniform float m_roughness;
+uniform bool metallic_roughness_map;
+uniform bool occlusion_map;
 
 layout(binding = 0) uniform sampler2D tex_diffuse;
 layout(binding = 1) uniform sampler2D tex_specular;
 layout(binding = 2) uniform sampler2D tex_normal;
 layout(binding = 3) uniform sampler2D tex_emmissive;
+layout(binding = 13) uniform sampler2D tex_metallic_roughness;
+layout(binding = 14) uniform sampler2D tex_occlusion;
+{{end}}
 layout(binding = 4) uniform samplerCube env_map;
 layout(binding = 5) uniform samplerCubeArray depth_maps;
+layout(binding = 6) uniform sampler2DArray dir_depth_maps;
+// The same maps with hardware comparison
+layout(binding = 7) uniform sampler2DArrayShadow dir_compare_maps;
+layout(binding = 8) uniform samplerCubeArrayShadow lamp_compare_maps;
+layout(binding = 9) uniform sampler2DArray spot_depth_maps;
+layout(binding = 10) uniform sampler2DArrayShadow spot_compare_maps;
 
 float get_attenuation(attenuation_params p, float dist) {
     return 1.0 / (p.constant + p.linear * dist + p.quadratic * (dist*dist));
 }
 
+{{if .Deferred}}
+// The G-buffer's normals are in world space, so lighting is too
+vec3 shading_space(vec3 p) {
+    return p;
+}
+
+vec3 diffuse_color() {
+    return g_diffuse_color;
+}
+vec3 specular_color() {
+    return g_specular_color;
+}
+vec3 emmissive_color() {
+    return g_emmissive_color;
+}
+{{else}}
+// Lighting is done in tangent space with normal mapping
+vec3 shading_space(vec3 p) {
+    if (normal_map) {
+        return TBN * p;
+    }
+
+    return p;
+}
+
 vec3 diffuse_color() {
     if (m_diffuse_color != vec3(0.0)) {
         return m_diffuse_color;
@@ -84,73 +208,385 @@ vec3 emmissive_color() {
 
     return texture(tex_emmissive, uv).rgb;
 }
+{{end}}
 
-vec3 dir_phong(dir l, vec3 normal, vec3 view_dir) {
-    vec3 light_dir = normalize(-l.direction);
+#define PI 3.14159265
 
-    // diffuse
-    float diffuse = max(dot(normal, light_dir), 0.0);
+// Cook-Torrance BRDF for metallic-roughness materials, with the GGX normal
+// distribution, Smith's geometry term (Schlick-GGX) and Schlick's Fresnel
+// approximation
+float ggx_distribution(float n_dot_h, float a) {
+    float a2 = a*a;
+    float d = n_dot_h*n_dot_h * (a2 - 1.0) + 1.0;
+    return a2 / (PI * d*d);
+}
+float schlick_ggx(float n_dot_x, float k) {
+    return n_dot_x / (n_dot_x * (1.0 - k) + k);
+}
+vec3 fresnel_schlick(float cos_theta, vec3 f0) {
+    return f0 + (1.0 - f0) * pow(1.0 - cos_theta, 5.0);
+}
+// Reflectance at normal incidence (dielectrics reflect about 4%)
+vec3 base_reflectance() {
+    return mix(vec3(0.04), diffuse_color(), metallic);
+}
+
+// Light reflected towards the viewer from a light of the given colour. Light
+// colours are scaled by PI so that a white surface facing the light is as
+// bright as with the Phong model.
+vec3 cook_torrance(vec3 normal, vec3 view_dir, vec3 light_dir, vec3 light) {
+    normal = normalize(normal);
+    float n_dot_l = max(dot(normal, light_dir), 0.0);
+    if (n_dot_l == 0.0) {
+        return vec3(0.0);
+    }
+    float n_dot_v = max(dot(normal, view_dir), 0.0001);
+    vec3 h = normalize(view_dir + light_dir);
+
+    float r = max(roughness, 0.05);
+    float d = ggx_distribution(max(dot(normal, h), 0.0), r*r);
+    // k remapped for direct lighting
+    float k = (r + 1.0)*(r + 1.0) / 8.0;
+    float g = schlick_ggx(n_dot_v, k) * schlick_ggx(n_dot_l, k);
+    vec3 f = fresnel_schlick(max(dot(h, view_dir), 0.0), base_reflectance());
+
+    vec3 specular = d * g * f / (4.0 * n_dot_v * n_dot_l);
+    // Metals have no diffuse reflection
+    vec3 diffuse = (1.0 - f) * (1.0 - metallic) * diffuse_color() / PI;
 
-    // specular
+    return (diffuse + specular) * light * PI * n_dot_l;
+}
+
+// Diffuse and specular lighting from a light in light_dir (before attenuation
+// and shadows)
+vec3 direct_light(vec3 normal, vec3 view_dir, vec3 light_dir, vec3 diffuse_light, vec3 specular_light) {
+    if (pbr) {
+        return cook_torrance(normal, view_dir, light_dir, diffuse_light);
+    }
+
+    float diffuse = max(dot(normal, light_dir), 0.0);
     vec3 reflect_dir = reflect(-light_dir, normal);
     float specular = pow(max(dot(view_dir, reflect_dir), 0.0), m_shininess);
 
-    vec3 result;
-    result += l.ambient * diffuse_color();
-    result += l.diffuse * diffuse * diffuse_color();
-    result += l.specular * specular * specular_color();
+    return diffuse_light * diffuse * diffuse_color() + specular_light * specular * specular_color();
+}
 
-    return result;
+// See ShadowFilter (the default filter is resolved before upload)
+#define SHADOW_FILTER_HARD 1
+#define SHADOW_FILTER_HARDWARE 2
+#define SHADOW_FILTER_PCF_GRID 3
+#define SHADOW_FILTER_PCF_POISSON 4
+#define SHADOW_FILTER_PCSS 5
+// Largest filter radius PCSS will use (in texels)
+#define PCSS_MAX_RADIUS 24.0
+
+#define SHADOW_MAP_CASCADE 0
+#define SHADOW_MAP_LAMP 1
+#define SHADOW_MAP_SPOT 2
+
+const vec2 poisson_disk[16] = vec2[](
+    vec2(-0.94201624, -0.39906216), vec2(0.94558609, -0.76890725),
+    vec2(-0.09418410, -0.92938870), vec2(0.34495938, 0.29387760),
+    vec2(-0.91588581, 0.45771432), vec2(-0.81544232, -0.87912464),
+    vec2(-0.38277543, 0.27676845), vec2(0.97484398, 0.75648379),
+    vec2(0.44323325, -0.97511554), vec2(0.53742981, -0.47373420),
+    vec2(-0.26496911, -0.41893023), vec2(0.79197514, 0.19090188),
+    vec2(-0.24188840, 0.99706507), vec2(-0.81409955, 0.91437590),
+    vec2(0.19984126, 0.78641367), vec2(0.14383161, -0.14100790)
+);
+
+// A lookup into one of the shadow maps. Depths are linear distances from the
+// light in world units and offsets (in texels) are applied along the tangent
+// and bitangent.
+struct shadow_lookup {
+    int map;
+    // Cascade layer, lamp or spotlight
+    int index;
+    // Texture coordinates (2D maps) or direction from the lamp (cube maps)
+    vec3 coord;
+    vec3 tangent, bitangent;
+    // Depth of the receiving surface
+    float receiver;
+    // World size of a texel at the receiver
+    float texel_size;
+    bool valid;
+};
+
+float spot_linear_depth(float depth) {
+    float z = depth * 2.0 - 1.0;
+    return 2.0 * spot_near_plane * far_plane / (far_plane + spot_near_plane - z * (far_plane - spot_near_plane));
+}
+float spot_depth(float linear) {
+    float z = (far_plane + spot_near_plane - 2.0 * spot_near_plane * far_plane / linear) / (far_plane - spot_near_plane);
+    return z * 0.5 + 0.5;
+}
+float cascade_depth_range(int layer) {
+    return 2.0 * cascade_radii[layer % N_CASCADES] + CASCADE_CASTER_MARGIN;
+}
+
+// Depth stored in the map at an offset from the lookup
+float shadow_fetch(shadow_lookup q, vec2 offset) {
+    vec3 c = q.coord + q.tangent * offset.x + q.bitangent * offset.y;
+    if (q.map == SHADOW_MAP_CASCADE) {
+        return texture(dir_depth_maps, vec3(c.xy, q.index)).r * cascade_depth_range(q.index);
+    } else if (q.map == SHADOW_MAP_LAMP) {
+        return texture(depth_maps, vec4(c, q.index)).r * far_plane;
+    }
+
+    return spot_linear_depth(texture(spot_depth_maps, vec3(c.xy, q.index)).r);
+}
+// Fraction of the (hardware filtered) map in front of a depth
+float shadow_compare(shadow_lookup q, float depth) {
+    if (q.map == SHADOW_MAP_CASCADE) {
+        return texture(dir_compare_maps, vec4(q.coord.xy, q.index, depth / cascade_depth_range(q.index)));
+    } else if (q.map == SHADOW_MAP_LAMP) {
+        return texture(lamp_compare_maps, vec4(q.coord, q.index), depth / far_plane);
+    }
+
+    return texture(spot_compare_maps, vec4(q.coord.xy, q.index, spot_depth(depth)));
+}
+
+shadow_lookup cascade_lookup(int layer, vec3 pos) {
+    shadow_lookup q;
+    q.map = SHADOW_MAP_CASCADE;
+    q.index = layer;
+
+    // Orthographic, so depth is already linear
+    mat4 transform = dirs[layer / N_CASCADES].shadow_transforms[layer % N_CASCADES];
+    vec3 proj = (transform * vec4(pos, 1.0)).xyz * 0.5 + 0.5;
+    vec2 texel = 1.0 / vec2(textureSize(dir_depth_maps, 0).xy);
+    q.coord = proj;
+    q.tangent = vec3(texel.x, 0.0, 0.0);
+    q.bitangent = vec3(0.0, texel.y, 0.0);
+    q.receiver = proj.z * cascade_depth_range(layer);
+    q.texel_size = 2.0 * cascade_radii[layer % N_CASCADES] * texel.x;
+    q.valid = proj.z <= 1.0;
+
+    return q;
+}
+shadow_lookup lamp_lookup(int index, vec3 pos) {
+    shadow_lookup q;
+    q.map = SHADOW_MAP_LAMP;
+    q.index = lamps[index].shadow_map;
+
+    vec3 frag_to_lamp = pos - lamps[index].position;
+    q.coord = frag_to_lamp;
+    q.receiver = length(frag_to_lamp);
+    // Each face covers 90 degrees
+    q.texel_size = 2.0 * q.receiver / float(textureSize(depth_maps, 0).x);
+
+    vec3 dir = frag_to_lamp / max(q.receiver, 0.0001);
+    vec3 up = abs(dir.y) < 0.99 ? vec3(0.0, 1.0, 0.0) : vec3(1.0, 0.0, 0.0);
+    vec3 tangent = normalize(cross(up, dir));
+    q.tangent = tangent * q.texel_size;
+    q.bitangent = cross(dir, tangent) * q.texel_size;
+    q.valid = true;
+
+    return q;
+}
+shadow_lookup spot_lookup(int index, vec3 pos) {
+    shadow_lookup q;
+    q.map = SHADOW_MAP_SPOT;
+    q.index = index;
+
+    spotlight l = spotlights[index];
+    vec4 light_space = l.shadow_transform * vec4(pos, 1.0);
+    vec3 proj = light_space.xyz / light_space.w * 0.5 + 0.5;
+    q.valid = light_space.w > 0.0 &&
+        all(greaterThanEqual(proj, vec3(0.0))) && all(lessThanEqual(proj, vec3(1.0)));
+
+    // The spotlight only uses the corner of the layer matching its resolution
+    vec2 texel = 1.0 / vec2(textureSize(spot_depth_maps, 0).xy);
+    q.coord = vec3(proj.xy * l.shadow_scale, proj.z);
+    q.tangent = vec3(texel.x, 0.0, 0.0);
+    q.bitangent = vec3(0.0, texel.y, 0.0);
+    // w is the depth in front of the spotlight
+    q.receiver = light_space.w;
+    // The projection covers the outer cone
+    float c = l.outer_cutoff;
+    q.texel_size = 2.0 * q.receiver * sqrt(1.0 - c*c) / c * texel.x / l.shadow_scale;
+
+    return q;
+}
+
+// Random rotation for the Poisson disk, trading banding for noise
+float shadow_angle() {
+    return 6.2831853 * fract(sin(dot(world_pos, vec3(12.9898, 78.233, 45.164))) * 43758.5453);
+}
+int pcf_samples(shadow_params s) {
+    if (s.filter_mode == SHADOW_FILTER_PCF_GRID) {
+        int side = max(int(sqrt(float(s.samples))), 1);
+        return side * side;
+    }
+
+    return clamp(s.samples, 1, 16);
+}
+// Offset (within the unit square or disk) of a PCF sample
+vec2 pcf_offset(shadow_params s, int i, int n, float angle) {
+    if (s.filter_mode == SHADOW_FILTER_PCF_GRID) {
+        int side = int(sqrt(float(n)) + 0.5);
+        if (side == 1) {
+            return vec2(0.0);
+        }
+
+        return vec2(i % side, i / side) / float(side - 1) * 2.0 - 1.0;
+    }
+
+    float c = cos(angle), sn = sin(angle);
+    vec2 p = poisson_disk[i];
+    return vec2(c*p.x - sn*p.y, sn*p.x + c*p.y);
+}
+
+// Estimates the PCSS filter radius (in texels) from the average depth of the
+// occluders around the lookup (0 if there aren't any)
+float pcss_radius(shadow_params s, shadow_lookup q, float depth, float angle) {
+    float search = s.light_size / q.texel_size;
+    if (q.map == SHADOW_MAP_CASCADE) {
+        // Directional lights are infinitely far away, so the penumbra only
+        // depends on the distance to the occluder
+        search *= q.receiver;
+    }
+    search = clamp(search, 1.0, PCSS_MAX_RADIUS);
+
+    float total = 0.0;
+    int n = 0;
+    for (int i = 0; i < 16; i++) {
+        float d = shadow_fetch(q, pcf_offset(s, i, 16, angle) * search);
+        if (d < depth) {
+            total += d;
+            n++;
+        }
+    }
+    if (n == 0) {
+        return 0.0;
+    }
+
+    float blocker = total / float(n);
+    float penumbra = (q.receiver - blocker) * s.light_size;
+    if (q.map != SHADOW_MAP_CASCADE) {
+        penumbra /= blocker;
+    }
+    return clamp(penumbra / q.texel_size, 1.0, PCSS_MAX_RADIUS);
+}
+
+// Bias in world units, increasing as the surface faces away from the light
+float shadow_bias(shadow_params s, shadow_lookup q, float n_dot_l) {
+    float slope = sqrt(1.0 - n_dot_l*n_dot_l) / max(n_dot_l, 0.1);
+    return s.bias + s.slope_bias * q.texel_size * slope;
 }
+vec3 shadow_offset_pos(shadow_params s, float texel_size, vec3 normal, float n_dot_l) {
+    return world_pos + normal * s.normal_offset * texel_size * (1.0 - n_dot_l);
+}
+
+// Fraction of the lookup in shadow, filtered according to the light's params
+float shadow_filter(shadow_params s, shadow_lookup q, float n_dot_l) {
+    if (!q.valid) {
+        return 0.0;
+    }
+
+    float depth = q.receiver - shadow_bias(s, q, n_dot_l);
+    if (s.filter_mode == SHADOW_FILTER_HARD) {
+        return shadow_fetch(q, vec2(0.0)) < depth ? 1.0 : 0.0;
+    } else if (s.filter_mode == SHADOW_FILTER_HARDWARE) {
+        return 1.0 - shadow_compare(q, depth);
+    }
+
+    float angle = shadow_angle();
+    float radius = s.radius;
+    if (s.filter_mode == SHADOW_FILTER_PCSS) {
+        radius = pcss_radius(s, q, depth, angle);
+        if (radius == 0.0) {
+            return 0.0;
+        }
+    }
 
-float lamp_shadow(int index, vec3 lamp_pos, vec3 pos) {
+    int n = pcf_samples(s);
+    float shadow = 0.0;
+    for (int i = 0; i < n; i++) {
+        shadow += shadow_fetch(q, pcf_offset(s, i, n, angle) * radius) < depth ? 1.0 : 0.0;
+    }
+    return shadow / float(n);
+}
+
+float dir_shadow(int index, dir l) {
     if (!shadows_enabled) {
         return 0.0;
     }
 
-    vec3 frag_to_lamp = world_pos - lamp_pos;
-    float closest_depth = texture(depth_maps, vec4(frag_to_lamp, index)).r;
-    closest_depth *= far_plane;
+    // Pick the cascade by the fragment's distance along the view
+    float depth = -(camera * vec4(world_pos, 1.0)).z;
+    int cascade = -1;
+    for (int c = 0; c < N_CASCADES; c++) {
+        if (depth < cascade_splits[c]) {
+            cascade = c;
+            break;
+        }
+    }
+    if (cascade == -1) {
+        return 0.0;
+    }
 
-    float current_depth = length(frag_to_lamp);
-    float bias = 0.1;
-    return current_depth - bias > closest_depth ? 1.0 : 0.0;
+    int layer = index*N_CASCADES + cascade;
+    vec3 normal = normalize(world_normal);
+    float n_dot_l = clamp(dot(normal, normalize(-l.direction)), 0.0, 1.0);
+    shadow_lookup q = cascade_lookup(layer, world_pos);
+    q = cascade_lookup(layer, shadow_offset_pos(l.shadow, q.texel_size, normal, n_dot_l));
+    return shadow_filter(l.shadow, q, n_dot_l);
 }
-vec3 lamp_phong(int index, lamp l, vec3 lamp_pos, vec3 pos, vec3 normal, vec3 view_dir) {
-    vec3 lamp_dir = normalize(lamp_pos - pos);
+vec3 dir_lighting(int index, dir l, vec3 normal, vec3 view_dir) {
+    vec3 light_dir = normalize(-l.direction);
 
-    // diffuse
-    float diffuse = max(dot(normal, lamp_dir), 0.0);
+    float shadow_factor = 1.0 - dir_shadow(index, l);
 
-    // specular
-    vec3 reflect_dir = reflect(-lamp_dir, normal);
-    float specular = pow(max(dot(view_dir, reflect_dir), 0.0), m_shininess);
+    vec3 result;
+    result += l.ambient * diffuse_color() * occlusion;
+    result += direct_light(normal, view_dir, light_dir, l.diffuse, l.specular) * shadow_factor;
+
+    return result;
+}
+
+float lamp_shadow(int index, lamp l) {
+    if (!shadows_enabled || l.shadow_map < 0) {
+        return 0.0;
+    }
+
+    vec3 normal = normalize(world_normal);
+    float n_dot_l = clamp(dot(normal, normalize(l.position - world_pos)), 0.0, 1.0);
+    shadow_lookup q = lamp_lookup(index, world_pos);
+    q = lamp_lookup(index, shadow_offset_pos(l.shadow, q.texel_size, normal, n_dot_l));
+    return shadow_filter(l.shadow, q, n_dot_l);
+}
+vec3 lamp_lighting(int index, lamp l, vec3 lamp_pos, vec3 pos, vec3 normal, vec3 view_dir) {
+    vec3 lamp_dir = normalize(lamp_pos - pos);
 
     // attenuation
     float dist = length(l.position - world_pos);
     float attenuation = get_attenuation(l.attenuation, dist);
 
-    float shadow_factor = 1.0 - lamp_shadow(index, l.position, pos);
+    float shadow_factor = 1.0 - lamp_shadow(index, l);
 
     vec3 result;
-    result += l.ambient * diffuse_color() * attenuation;
-    result += l.diffuse * diffuse * diffuse_color() * shadow_factor * attenuation;
-    result += l.specular * specular * specular_color() * shadow_factor * attenuation;
+    result += l.ambient * diffuse_color() * attenuation * occlusion;
+    result += direct_light(normal, view_dir, lamp_dir, l.diffuse, l.specular) * shadow_factor * attenuation;
 
     return result;
 }
 
-vec3 spotlight_phong(spotlight l, vec3 spot_pos, vec3 pos, vec3 normal, vec3 view_dir) {
+float spot_shadow(int index, spotlight l) {
+    if (!shadows_enabled) {
+        return 0.0;
+    }
+
+    vec3 normal = normalize(world_normal);
+    float n_dot_l = clamp(dot(normal, normalize(l.position - world_pos)), 0.0, 1.0);
+    shadow_lookup q = spot_lookup(index, world_pos);
+    q = spot_lookup(index, shadow_offset_pos(l.shadow, q.texel_size, normal, n_dot_l));
+    return shadow_filter(l.shadow, q, n_dot_l);
+}
+vec3 spotlight_lighting(int index, spotlight l, vec3 spot_pos, vec3 pos, vec3 normal, vec3 view_dir) {
     vec3 spot_dir = normalize(spot_pos - pos);
     vec3 world_dir = normalize(l.position - world_pos);
 
-    // diffuse
-    float diffuse = max(dot(normal, spot_dir), 0.0);
-
-    // specular
-    vec3 reflect_dir = reflect(-spot_dir, normal);
-    float specular = pow(max(dot(view_dir, reflect_dir), 0.0), m_shininess);
-
     // attenuation
     float dist = length(l.position - world_pos);
     float attenuation = get_attenuation(l.attenuation, dist);
@@ -160,22 +596,88 @@ vec3 spotlight_phong(spotlight l, vec3 spot_pos, vec3 pos, vec3 normal, vec3 vie
     float epsilon = l.cutoff - l.outer_cutoff;
     float intensity = clamp((theta - l.outer_cutoff) / epsilon, 0.0, 1.0);
 
+    float shadow_factor = 1.0 - spot_shadow(index, l);
+
     vec3 result;
-    result += l.ambient * diffuse_color() * attenuation * intensity;
-    result += l.diffuse * diffuse * diffuse_color() * attenuation * intensity;
-    result += l.specular * specular * specular_color() * attenuation * intensity;
+    result += l.ambient * diffuse_color() * attenuation * intensity * occlusion;
+    result += direct_light(normal, view_dir, spot_dir, l.diffuse, l.specular) * attenuation * intensity * shadow_factor;
 
     return result;
 }
 
 vec3 env_reflections(vec3 pos, vec3 normal, vec3 view_dir) {
     vec3 r = reflect(-view_dir, normal);
+    if (pbr) {
+        // Fresnel with roughness, and without a prefiltered environment map
+        // rougher surfaces just reflect less
+        float n_dot_v = max(dot(normalize(normal), view_dir), 0.0);
+        vec3 f0 = base_reflectance();
+        vec3 f = f0 + (max(vec3(1.0 - roughness), f0) - f0) * pow(1.0 - n_dot_v, 5.0);
+        return texture(env_map, r).rgb * f * (1.0 - 0.75*roughness) * occlusion;
+    }
+
     return texture(env_map, r).rgb * m_reflectiveness;
 }
 
+int cluster_index() {
+    if (cluster_near <= 0.0) {
+        return 0;
+    }
+
+    ivec2 tile = ivec2(gl_FragCoord.xy / viewport_size * vec2(CLUSTERS_X, CLUSTERS_Y));
+    tile = clamp(tile, ivec2(0), ivec2(CLUSTERS_X - 1, CLUSTERS_Y - 1));
+
+    // Slices are spaced exponentially
+    float depth = -(camera * vec4(world_pos, 1.0)).z;
+    int slice = int(log(max(depth, cluster_near) / cluster_near) / log(cluster_far / cluster_near) * float(CLUSTERS_Z));
+    slice = clamp(slice, 0, CLUSTERS_Z - 1);
+
+    return (slice * CLUSTERS_Y + tile.y) * CLUSTERS_X + tile.x;
+}
+
 void main() {
     vec3 pos, normal, view_dir;
 
+{{if .Deferred}}
+    ivec2 texel = ivec2(gl_FragCoord.xy);
+    vec4 position = texelFetch(g_position, texel, 0);
+    if (position.w == 0.0) {
+        discard;
+    }
+
+    world_pos = position.xyz;
+    world_normal = texelFetch(g_normal, texel, 0).xyz;
+    vec4 albedo = texelFetch(g_albedo, texel, 0);
+    vec4 specular = texelFetch(g_specular, texel, 0);
+    g_diffuse_color = albedo.rgb;
+    m_reflectiveness = albedo.a;
+    // Negative for metallic-roughness materials (see gbuffer.fs)
+    pbr = specular.a < 0.0;
+    if (pbr) {
+        metallic = specular.r;
+        roughness = specular.g;
+        occlusion = specular.b;
+    } else {
+        g_specular_color = specular.rgb;
+        m_shininess = specular.a;
+    }
+    g_emmissive_color = texelFetch(g_emmissive, texel, 0).rgb;
+
+    // Depth for anything drawn after the lighting pass
+    vec4 clip = projection * camera * vec4(world_pos, 1.0);
+    gl_FragDepth = clip.z / clip.w * 0.5 + 0.5;
+
+    pos = world_pos;
+    normal = world_normal;
+    view_dir = normalize(view_pos - pos);
+{{else}}
+    if (normal_pass) {
+        // TBN transforms from world to tangent space
+        vec3 n = normal_map ? transpose(TBN) * (texture(tex_normal, uv).rgb * 2.0 - 1.0) : world_normal;
+        out_color = vec4(normalize(n), 1.0);
+        return;
+    }
+
     if (normal_map) {
         pos = TBN * world_pos;
         normal = normalize(texture(tex_normal, uv).rgb * 2.0 - 1.0);
@@ -186,35 +688,43 @@ void main() {
         view_dir = normalize(view_pos - pos);
     }
 
+    pbr = m_pbr;
+    metallic = m_metallic;
+    roughness = m_roughness;
+    if (metallic_roughness_map) {
+        vec4 mr = texture(tex_metallic_roughness, uv);
+        roughness *= mr.g;
+        metallic *= mr.b;
+    }
+    if (occlusion_map) {
+        occlusion = texture(tex_occlusion, uv).r;
+    }
+{{end}}
+    if (ssao_enabled) {
+        occlusion *= texelFetch(ssao_map, ivec2(gl_FragCoord.xy), 0).r;
+    }
+
     vec3 result;
-    for (int i = 0; i < N_DIRS; i++) {
-        result += dir_phong(dirs[i], normal, view_dir);
+    for (int i = 0; i < n_dirs; i++) {
+        result += dir_lighting(i, dirs[i], normal, view_dir);
     }
-    for (int i = 0; i < N_LAMPS; i++) {
-        lamp l = lamps[i];
 
-        vec3 lamp_pos;
-        if (normal_map) {
-            lamp_pos = TBN * l.position;
-        } else {
-            lamp_pos = l.position;
-        }
-        result += lamp_phong(i, l, lamp_pos, pos, normal, view_dir);
+    // Only the lamps and spotlights which reach this fragment's cluster
+    ivec4 cluster = clusters[cluster_index()];
+    for (int j = 0; j < cluster.y; j++) {
+        int i = light_indices[cluster.x + j];
+        lamp l = lamps[i];
+        result += lamp_lighting(i, l, shading_space(l.position), pos, normal, view_dir);
     }
-    for (int i = 0; i < N_SPOTLIGHTS; i++) {
+    for (int j = 0; j < cluster.z; j++) {
+        int i = light_indices[cluster.x + cluster.y + j];
         spotlight l = spotlights[i];
-
-        vec3 spot_pos;
-        if (normal_map) {
-            spot_pos = TBN * l.position;
-        } else {
-            spot_pos = l.position;
-        }
-        result += spotlight_phong(l, spot_pos, pos, normal, view_dir);
+        result += spotlight_lighting(i, l, shading_space(l.position), pos, normal, view_dir);
     }
 
     result += emmissive_color();
     result += env_reflections(pos, normal, view_dir);
 
     out_color = vec4(result, 1.0);
+    out_emissive = vec4(emmissive_color(), 1.0);
 }
@@ -2,18 +2,19 @@
 
 #define MAX_JOINTS 256
 
-in vec3 frag_pos;
+// Fixed locations so a mesh's VAO works with the instanced variant too
+layout(location = 0) in vec3 frag_pos;
 {{if not .DepthPass}}
-in vec3 normal;
-in vec2 uv_in;
-in vec3 tangent;
-in vec3 bitangent;
+layout(location = 1) in vec3 normal;
+layout(location = 2) in vec2 uv_in;
+layout(location = 3) in vec3 tangent;
+layout(location = 4) in vec3 bitangent;
 {{end}}
 
-in ivec4 joint_ids_a;
-in ivec4 joint_ids_b;
-in vec4 weights_a;
-in vec4 weights_b;
+layout(location = 5) in ivec4 joint_ids_a;
+layout(location = 6) in ivec4 joint_ids_b;
+layout(location = 7) in vec4 weights_a;
+layout(location = 8) in vec4 weights_b;
 
 {{if not .DepthPass}}
 out vec3 world_pos;
@@ -21,38 +22,61 @@ out vec3 world_normal;
 out mat3 TBN;
 out vec2 uv;
 
-uniform mat4 projection, camera, model;
+uniform mat4 projection, camera;
+{{end}}
+{{if .Instanced}}
+// Per-instance model matrices and joint palettes (joint_count per instance)
+layout(std430, binding = 0) readonly buffer instance_models {
+    mat4 instance_model[];
+};
+layout(std430, binding = 1) readonly buffer instance_joints {
+    mat4 instance_joint[];
+};
+uniform int joint_count;
+// Transform of the mesh within the object
+uniform mat4 mesh_transform, inv_mesh_transform;
+
+mat4 joint(int id) {
+    return inv_mesh_transform * instance_joint[gl_InstanceID * joint_count + id];
+}
 {{else}}
 uniform mat4 model;
-{{end}}
 uniform mat4 joints[MAX_JOINTS];
 
+mat4 joint(int id) {
+    return joints[id];
+}
+{{end}}
+
 {{if not .DepthPass}}
 uniform bool normal_map;
 {{end}}
 
 void main() {
-    mat4 skinning  = joints[joint_ids_a[0]] * weights_a[0];
-         skinning += joints[joint_ids_a[1]] * weights_a[1];
-         skinning += joints[joint_ids_a[2]] * weights_a[2];
-         skinning += joints[joint_ids_a[3]] * weights_a[3];
-         skinning += joints[joint_ids_b[0]] * weights_b[0];
-         skinning += joints[joint_ids_b[1]] * weights_b[1];
-         skinning += joints[joint_ids_b[2]] * weights_b[2];
-         skinning += joints[joint_ids_b[3]] * weights_b[3];
+{{if .Instanced}}
+    mat4 model = instance_model[gl_InstanceID] * mesh_transform;
+{{end}}
+    mat4 skinning  = joint(joint_ids_a[0]) * weights_a[0];
+         skinning += joint(joint_ids_a[1]) * weights_a[1];
+         skinning += joint(joint_ids_a[2]) * weights_a[2];
+         skinning += joint(joint_ids_a[3]) * weights_a[3];
+         skinning += joint(joint_ids_b[0]) * weights_b[0];
+         skinning += joint(joint_ids_b[1]) * weights_b[1];
+         skinning += joint(joint_ids_b[2]) * weights_b[2];
+         skinning += joint(joint_ids_b[3]) * weights_b[3];
 
 {{if not .DepthPass}}
     world_pos = vec3(model * skinning * vec4(frag_pos, 1.0));
 
     mat3 normal_matrix = transpose(inverse(mat3(model * skinning)));
+    // Always written since the shadow bias uses the geometric normal
+    world_normal = normalize(normal_matrix * normal);
     if (normal_map) {
         vec3 T = normalize(normal_matrix * tangent);
-        vec3 N = normalize(normal_matrix * normal);
+        vec3 N = world_normal;
         T = normalize(T - dot(T, N) * N);
         vec3 B = cross(N, T);
         TBN = transpose(mat3(T, B, N));
-    } else {
-        world_normal = normalize(normal_matrix * normal);
     }
 
     uv = uv_in;
@@ -2,15 +2,23 @@
 
 in vec4 frag_pos;
 
-#define N_LAMPS {{len .Lamps}}
-uniform vec3 lamp_positions[N_LAMPS];
+// Lamp currently being rendered
+uniform vec3 lamp_position;
 uniform float far_plane;
 
+#define SHADOW_PASS_LAMPS 0
+#define SHADOW_PASS_DIRS 1
+#define SHADOW_PASS_SPOT 2
+uniform int shadow_pass;
+
 void main() {
-    // gl_Layer represents the current face of the current cubemap array element
-    // Divide by 6 to get the lamp index
-    vec3 lamp_pos = lamp_positions[gl_Layer / 6];
-    float lamp_distance = length(frag_pos.xyz - lamp_pos);
+    if (shadow_pass != SHADOW_PASS_LAMPS) {
+        // Single projection, so the regular depth is fine
+        gl_FragDepth = gl_FragCoord.z;
+        return;
+    }
+
+    float lamp_distance = length(frag_pos.xyz - lamp_position);
 
     // map to [0;1] range by dividing by far_plane
     lamp_distance /= far_plane;
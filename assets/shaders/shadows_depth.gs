@@ -1,35 +1,34 @@
 #version 430
 
-#define N_LAMPS {{len .Lamps}}
-layout (triangles) in;
-layout (triangle_strip, max_vertices={{mul 6 3 (len .Lamps)}}) out;
+// One invocation per layer (a face of a lamp's cubemap, a cascade of a
+// directional light or a spotlight's map)
+#define MAX_SHADOW_LAYERS {{max 6 .Cascades}}
+layout (triangles, invocations = MAX_SHADOW_LAYERS) in;
+layout (triangle_strip, max_vertices = 3) out;
 
-// Only emit geometry for lamps we actually need to update
-uniform bool update_lamps[N_LAMPS];
-// Set of transforms for each lamp (one for each face of the cubemap)
-uniform mat4 shadow_transforms[N_LAMPS*6];
+// Transforms for each layer being rendered
+uniform mat4 shadow_transforms[MAX_SHADOW_LAYERS];
+uniform int shadow_layers;
+// Layer of the texture array the first transform renders to
+uniform int shadow_layer_base;
 
 out vec4 frag_pos; // frag_pos from GS (output per emitvertex)
 
 void main() {
-    for (int lamp = 0; lamp < N_LAMPS; lamp++) {
-        if (!update_lamps[lamp]) {
-            continue;
-        }
-
-        for (int face = 0; face < 6; face++) {
-            // We're using a cubemap array - each layer is a single face of an
-            // element in the array
-            gl_Layer = lamp*6 + face;
-            // for each triangle's vertices
-            for (int i = 0; i < 3; i++) {
-                frag_pos = gl_in[i].gl_Position;
-                gl_Position = shadow_transforms[lamp*6 + face] * frag_pos;
+    if (gl_InvocationID >= shadow_layers) {
+        return;
+    }
 
-                EmitVertex();
-            }
+    // For cubemap arrays each layer is a single face of an element in the
+    // array
+    gl_Layer = shadow_layer_base + gl_InvocationID;
+    // for each triangle's vertices
+    for (int i = 0; i < 3; i++) {
+        frag_pos = gl_in[i].gl_Position;
+        gl_Position = shadow_transforms[gl_InvocationID] * frag_pos;
 
-            EndPrimitive();
-        }
+        EmitVertex();
     }
+
+    EndPrimitive();
 }
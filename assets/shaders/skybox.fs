@@ -2,10 +2,13 @@
 
 in vec3 tex_coords;
 
-out vec4 out_color;
+layout(location = 0) out vec4 out_color;
+// Contribution to bloom (see postprocess.go)
+layout(location = 1) out vec4 out_emissive;
 
 layout(binding = 0) uniform samplerCube skybox;
 
 void main() {
     out_color = texture(skybox, tex_coords);
+    out_emissive = vec4(0.0);
 }
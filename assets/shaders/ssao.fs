@@ -0,0 +1,60 @@
+#version 430
+
+// Screen space ambient occlusion: the fraction of a hemisphere of samples
+// around each fragment which isn't hidden behind other geometry (see ssao.go)
+
+#define KERNEL_SIZE {{.KernelSize}}
+#define NOISE_SIZE {{.NoiseSize}}
+
+in vec2 screen_uv;
+
+out float out_occlusion;
+
+layout(binding = 0) uniform sampler2D depth_map;
+// World space normals
+layout(binding = 1) uniform sampler2D normal_map;
+// Random rotations of the kernel around the normal, tiled over the screen
+layout(binding = 2) uniform sampler2D noise;
+
+uniform mat4 projection, inv_projection, camera;
+uniform vec3 kernel[KERNEL_SIZE];
+uniform float radius;
+uniform float bias;
+uniform float intensity;
+
+vec3 view_pos(vec2 uv) {
+    vec4 ndc = vec4(vec3(uv, texture(depth_map, uv).r) * 2.0 - 1.0, 1.0);
+    vec4 pos = inv_projection * ndc;
+    return pos.xyz / pos.w;
+}
+
+void main() {
+    if (texture(depth_map, screen_uv).r == 1.0) {
+        // Nothing drawn here
+        out_occlusion = 1.0;
+        return;
+    }
+
+    vec3 pos = view_pos(screen_uv);
+    vec3 normal = normalize(mat3(camera) * texture(normal_map, screen_uv).xyz);
+
+    vec2 noise_scale = vec2(textureSize(depth_map, 0)) / float(NOISE_SIZE);
+    vec3 random = texture(noise, screen_uv * noise_scale).xyz;
+    vec3 tangent = normalize(random - normal * dot(random, normal));
+    mat3 TBN = mat3(tangent, cross(normal, tangent), normal);
+
+    float occlusion = 0.0;
+    for (int i = 0; i < KERNEL_SIZE; i++) {
+        vec3 sample_pos = pos + TBN * kernel[i] * radius;
+
+        vec4 offset = projection * vec4(sample_pos, 1.0);
+        offset.xy = offset.xy / offset.w * 0.5 + 0.5;
+        float depth = view_pos(offset.xy).z;
+
+        // Ignore geometry much further away than the radius
+        float range = smoothstep(0.0, 1.0, radius / abs(pos.z - depth));
+        occlusion += (depth >= sample_pos.z + bias ? 1.0 : 0.0) * range;
+    }
+
+    out_occlusion = pow(1.0 - occlusion / float(KERNEL_SIZE), intensity);
+}
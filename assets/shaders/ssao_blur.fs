@@ -0,0 +1,26 @@
+#version 430
+
+// Averages the occlusion over the size of the noise texture to remove its
+// pattern
+
+#define NOISE_SIZE {{.NoiseSize}}
+
+in vec2 screen_uv;
+
+out float out_occlusion;
+
+layout(binding = 0) uniform sampler2D occlusion;
+
+void main() {
+    vec2 texel = 1.0 / vec2(textureSize(occlusion, 0));
+
+    float result = 0.0;
+    for (int x = 0; x < NOISE_SIZE; x++) {
+        for (int y = 0; y < NOISE_SIZE; y++) {
+            vec2 offset = vec2(x - NOISE_SIZE / 2, y - NOISE_SIZE / 2) * texel;
+            result += texture(occlusion, screen_uv + offset).r;
+        }
+    }
+
+    out_occlusion = result / float(NOISE_SIZE * NOISE_SIZE);
+}
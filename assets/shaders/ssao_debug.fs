@@ -0,0 +1,13 @@
+#version 430
+
+// Shows the ambient occlusion in greyscale
+
+in vec2 screen_uv;
+
+out vec4 out_color;
+
+layout(binding = 0) uniform sampler2D occlusion;
+
+void main() {
+    out_color = vec4(vec3(texture(occlusion, screen_uv).r), 1.0);
+}
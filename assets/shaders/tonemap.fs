@@ -0,0 +1,43 @@
+#version 430
+
+// Combines the HDR image with its bloom and maps it to displayable colours
+
+// See ToneMapper
+#define TONE_MAP_CLAMP 0
+#define TONE_MAP_REINHARD 1
+#define TONE_MAP_ACES 2
+
+in vec2 screen_uv;
+
+out vec4 out_color;
+
+layout(binding = 0) uniform sampler2D hdr_color;
+layout(binding = 1) uniform sampler2D bloom;
+
+uniform float exposure;
+uniform int tone_mapper;
+uniform bool bloom_enabled;
+uniform float bloom_intensity;
+
+// Narkowicz's fit of the ACES filmic curve
+vec3 aces(vec3 x) {
+    return clamp((x * (2.51 * x + 0.03)) / (x * (2.43 * x + 0.59) + 0.14), 0.0, 1.0);
+}
+
+void main() {
+    vec3 color = texture(hdr_color, screen_uv).rgb;
+    if (bloom_enabled) {
+        color += texture(bloom, screen_uv).rgb * bloom_intensity;
+    }
+    color *= exposure;
+
+    if (tone_mapper == TONE_MAP_REINHARD) {
+        color = color / (color + 1.0);
+    } else if (tone_mapper == TONE_MAP_ACES) {
+        color = aces(color);
+    } else {
+        color = clamp(color, 0.0, 1.0);
+    }
+
+    out_color = vec4(color, 1.0);
+}
@@ -1,9 +1,12 @@
 #version 430
 
-out vec4 out_color;
+layout(location = 0) out vec4 out_color;
+// Contribution to bloom (see postprocess.go), these are used to show lights
+layout(location = 1) out vec4 out_emissive;
 
 uniform vec3 color;
 
 void main() {
     out_color = vec4(color, 1.0);
+    out_emissive = out_color;
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"runtime"
 	"unsafe"
@@ -16,6 +17,10 @@ func init() {
 }
 
 func main() {
+	scenePath := flag.String("scene", "assets/scenes/default.json", "path to the scene description")
+	deferred := flag.Bool("deferred", false, "use deferred lighting (with a G-buffer) instead of forward lighting")
+	flag.Parse()
+
 	if err := glfw.Init(); err != nil {
 		log.Fatalf("Error initializing glfw: %v", err)
 	}
@@ -47,7 +52,7 @@ func main() {
 		log.Printf("[SEV%v] %v", severity, message)
 	}, nil)
 
-	app := app.NewApp(window)
+	app := app.NewApp(window, *scenePath, *deferred)
 	if err := app.Setup(); err != nil {
 		log.Fatalf("Setup failed: %v", err)
 	}
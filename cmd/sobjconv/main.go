@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/devplayer0/cs4052/pkg/gltf"
+	"github.com/devplayer0/cs4052/pkg/pb"
+)
+
+var (
+	textOutput   = flag.Bool("text", false, "write the object in protobuf text format (for debugging)")
+	skipTextures = flag.Bool("skip-textures", false, "don't embed textures in materials")
+)
+
+func convert(in string) (*pb.Object, error) {
+	switch ext := strings.ToLower(filepath.Ext(in)); ext {
+	case ".obj":
+		return convertOBJ(in)
+	case ".gltf", ".glb":
+		return gltf.ConvertFile(in)
+	default:
+		return nil, fmt.Errorf("unsupported input format %v", ext)
+	}
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %v [flags] <input> <output.sobj>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	in, out := flag.Arg(0), flag.Arg(1)
+
+	obj, err := convert(in)
+	if err != nil {
+		log.Fatalf("Failed to convert %v: %v", in, err)
+	}
+	if *skipTextures {
+		for _, m := range obj.Materials {
+			m.Diffuse, m.Specular, m.Normal, m.Emissive = nil, nil, nil, nil
+			m.MetallicRoughness, m.Occlusion = nil, nil
+		}
+	}
+
+	var data []byte
+	if *textOutput {
+		data, err = prototext.MarshalOptions{Multiline: true}.Marshal(obj)
+	} else {
+		data, err = proto.Marshal(obj)
+	}
+	if err != nil {
+		log.Fatalf("Failed to marshal object: %v", err)
+	}
+
+	if err := ioutil.WriteFile(out, data, 0644); err != nil {
+		log.Fatalf("Failed to write output: %v", err)
+	}
+}
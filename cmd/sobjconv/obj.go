@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/sheenobu/go-obj/obj"
+
+	"github.com/devplayer0/cs4052/pkg/object"
+	"github.com/devplayer0/cs4052/pkg/pb"
+	"github.com/devplayer0/cs4052/pkg/util"
+)
+
+const defaultMaterial = "default"
+
+// materialUse marks the face index from which a material applies
+type materialUse struct {
+	face int
+	name string
+}
+
+func joinRest(rest [][]byte) string {
+	parts := make([]string, len(rest))
+	for i, r := range rest {
+		parts[i] = string(r)
+	}
+
+	return strings.TrimSpace(strings.Join(parts, " "))
+}
+
+func parseMTLVec3(fields []string) (*pb.Vec3, error) {
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("expected 3 components, got %v", len(fields))
+	}
+
+	var v [3]float32
+	for i := range v {
+		f, err := strconv.ParseFloat(fields[i], 32)
+		if err != nil {
+			return nil, err
+		}
+		v[i] = float32(f)
+	}
+
+	return util.Vec3PB(v), nil
+}
+
+// readMTLFile parses a Wavefront .mtl material library
+func readMTLFile(mtlFile string) ([]*pb.Material, error) {
+	f, err := os.Open(mtlFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %v: %w", mtlFile, err)
+	}
+	defer f.Close()
+
+	dir := filepath.Dir(mtlFile)
+	var mats []*pb.Material
+	var current *pb.Material
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if fields[0] == "newmtl" {
+			current = &pb.Material{Name: strings.Join(fields[1:], " ")}
+			mats = append(mats, current)
+			continue
+		}
+		if current == nil {
+			continue
+		}
+
+		var err error
+		args := fields[1:]
+		switch fields[0] {
+		case "Ns":
+			var s float64
+			if len(args) > 0 {
+				s, err = strconv.ParseFloat(args[0], 32)
+			}
+			current.Shininess = float32(s)
+		case "Kd":
+			current.DiffuseColor, err = parseMTLVec3(args)
+		case "Ks":
+			current.SpecularColor, err = parseMTLVec3(args)
+		case "Ke":
+			current.EmissiveColor, err = parseMTLVec3(args)
+		case "map_Kd", "map_Ks", "map_Ke", "map_Bump", "map_bump", "bump", "norm":
+			if *skipTextures || len(args) == 0 {
+				break
+			}
+
+			// Texture options may precede the filename, which is always last
+			var tex *pb.Texture
+			tex, err = loadTexture(filepath.Join(dir, args[len(args)-1]))
+			switch fields[0] {
+			case "map_Kd":
+				current.Diffuse = tex
+			case "map_Ks":
+				current.Specular = tex
+			case "map_Ke":
+				current.Emissive = tex
+			default:
+				current.Normal = tex
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %v: %w", mtlFile, line, fields[0], err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %v: %w", mtlFile, err)
+	}
+
+	return mats, nil
+}
+
+type meshBuilder struct {
+	mesh *pb.Mesh
+
+	vertices []object.Vertex
+	indices  []uint32
+	lookup   map[object.Vertex]uint32
+	// vertices which had no normal in the source and need one generated
+	noNormal map[uint32]bool
+}
+
+func (b *meshBuilder) addPoint(p *obj.Point) uint32 {
+	v := object.Vertex{
+		Position: mgl32.Vec3{float32(p.Vertex.X), float32(p.Vertex.Y), float32(p.Vertex.Z)},
+	}
+	if p.Normal != nil {
+		v.Normal = mgl32.Vec3{float32(p.Normal.X), float32(p.Normal.Y), float32(p.Normal.Z)}
+	}
+	if p.Texture != nil {
+		// Textures are uploaded top row first, so flip V
+		v.UV = mgl32.Vec2{float32(p.Texture.U), 1 - float32(p.Texture.V)}
+	}
+
+	i, ok := b.lookup[v]
+	if !ok {
+		i = uint32(len(b.vertices))
+		b.lookup[v] = i
+		b.vertices = append(b.vertices, v)
+
+		if p.Normal == nil {
+			b.noNormal[i] = true
+		}
+	}
+
+	b.indices = append(b.indices, i)
+	return i
+}
+
+func (b *meshBuilder) finish() *pb.Mesh {
+	positions := make([]mgl32.Vec3, len(b.vertices))
+	normals := make([]mgl32.Vec3, len(b.vertices))
+	uvs := make([]mgl32.Vec2, len(b.vertices))
+	for i, v := range b.vertices {
+		positions[i], normals[i], uvs[i] = v.Position, v.Normal, v.UV
+	}
+
+	// Generate smooth normals for vertices which didn't have one
+	if len(b.noNormal) > 0 {
+		generated := util.CalculateNormals(positions, b.indices)
+		for i := range b.noNormal {
+			normals[i] = generated[i]
+		}
+	}
+	tangents, bitangents := util.CalculateTangents(positions, normals, uvs, b.indices)
+
+	b.mesh.Vertices = make([]*pb.Vertex, len(b.vertices))
+	for i, v := range b.vertices {
+		b.mesh.Vertices[i] = &pb.Vertex{
+			Position:  util.Vec3PB(v.Position),
+			Normal:    util.Vec3PB(normals[i]),
+			Uv:        util.Vec2PB(v.UV),
+			Tangent:   util.Vec3PB(tangents[i]),
+			Bitangent: util.Vec3PB(bitangents[i]),
+		}
+	}
+
+	b.mesh.Faces = make([]*pb.Triangle, len(b.indices)/3)
+	for i := range b.mesh.Faces {
+		b.mesh.Faces[i] = &pb.Triangle{
+			A: b.indices[i*3],
+			B: b.indices[i*3+1],
+			C: b.indices[i*3+2],
+		}
+	}
+
+	return b.mesh
+}
+
+// convertOBJ builds an object from a Wavefront .obj file (and any material
+// libraries it references), with one mesh per material used
+func convertOBJ(objFile string) (*pb.Object, error) {
+	o, err := object.ReadOBJFile(objFile,
+		obj.WithType("mtllib", "material library", func(o *obj.Object, token string, rest ...[]byte) error {
+			o.AddCustom("mtllib", joinRest(rest))
+			return nil
+		}),
+		obj.WithType("usemtl", "use material", func(o *obj.Object, token string, rest ...[]byte) error {
+			o.AddCustom("usemtl", materialUse{len(o.Faces), joinRest(rest)})
+			return nil
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read obj: %w", err)
+	}
+
+	out := &pb.Object{}
+	materialIDs := make(map[string]uint32)
+
+	libs, _ := o.GetCustom("mtllib")
+	for _, l := range libs {
+		mats, err := readMTLFile(filepath.Join(filepath.Dir(objFile), l.(string)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read material library: %w", err)
+		}
+
+		for _, m := range mats {
+			materialIDs[m.Name] = uint32(len(out.Materials))
+			out.Materials = append(out.Materials, m)
+		}
+	}
+
+	uses, _ := o.GetCustom("usemtl")
+	builders := make(map[uint32]*meshBuilder)
+	var order []uint32
+	for i, f := range o.Faces {
+		name := defaultMaterial
+		for _, u := range uses {
+			mu := u.(materialUse)
+			if mu.face > i {
+				break
+			}
+			name = mu.name
+		}
+
+		mID, ok := materialIDs[name]
+		if !ok {
+			if name != defaultMaterial {
+				log.Printf("Warning: unknown material %v, using default", name)
+			}
+
+			mID = uint32(len(out.Materials))
+			materialIDs[name] = mID
+			out.Materials = append(out.Materials, &pb.Material{
+				Name:         name,
+				DiffuseColor: util.Vec3PB(mgl32.Vec3{0.8, 0.8, 0.8}),
+			})
+		}
+
+		b, ok := builders[mID]
+		if !ok {
+			b = &meshBuilder{
+				mesh: &pb.Mesh{
+					Name:       fmt.Sprintf("%v_%v", o.Name, name),
+					MaterialID: mID,
+				},
+
+				lookup:   make(map[object.Vertex]uint32),
+				noNormal: make(map[uint32]bool),
+			}
+			builders[mID] = b
+			order = append(order, mID)
+		}
+
+		// Triangulate polygons as a fan
+		for j := 1; j+1 < len(f.Points); j++ {
+			b.addPoint(f.Points[0])
+			b.addPoint(f.Points[j])
+			b.addPoint(f.Points[j+1])
+		}
+	}
+
+	out.Hierarchy = []*pb.Node{
+		{
+			Name:      o.Name,
+			Transform: util.Mat4PB(mgl32.Ident4()),
+		},
+	}
+	for _, mID := range order {
+		out.Instances = append(out.Instances, &pb.MeshInstance{
+			MeshID:    uint32(len(out.Meshes)),
+			Transform: util.Mat4PB(mgl32.Ident4()),
+		})
+		out.Meshes = append(out.Meshes, builders[mID].finish())
+	}
+
+	return out, nil
+}
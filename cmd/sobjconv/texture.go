@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+
+	// Register decoders for the formats we might encounter
+	_ "image/jpeg"
+
+	"github.com/devplayer0/cs4052/pkg/pb"
+)
+
+// loadTexture reads an image file and re-encodes it as a PNG (which is what
+// the object loader expects)
+func loadTexture(file string) (*pb.Texture, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %v: %w", file, err)
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %v: %w", file, err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode PNG: %w", err)
+	}
+
+	return &pb.Texture{Data: buf.Bytes()}, nil
+}
@@ -9,19 +9,17 @@ import (
 	"github.com/go-gl/mathgl/mgl32"
 
 	"github.com/devplayer0/cs4052/pkg/object"
+	"github.com/devplayer0/cs4052/pkg/scene"
 	"github.com/devplayer0/cs4052/pkg/util"
 )
 
 const (
 	mouseSensitivity = 5
 	movementSpeed    = 5
-	boidCount        = 64
-	brrLamp2Speed    = 3
-)
 
-type skinnedVSParams struct {
-	DepthPass bool
-}
+	// How long (in seconds) transitions between animations take
+	animationFadeTime = 0.5
+)
 
 // App represents the graphics application
 type App struct {
@@ -29,22 +27,16 @@ type App struct {
 
 	crosshair *Crosshair
 
-	lighting *util.Lighting
-
-	meshShader             *util.Program
-	meshDepthShader        *util.Program
-	skinnedMeshShader      *util.Program
-	skinnedMeshDepthShader *util.Program
-	skeletonShader         *util.Program
+	scenePath string
+	scene     *scene.Scene
+	skybox    int
 
-	skybox  *util.Skybox
-	skybox2 *util.Skybox
-
-	ground    *object.Mesh
-	backpack  *object.Mesh
-	scorpion  *object.Object
-	tarantula *object.Object
-	locust    *object.Object
+	deferred bool
+	gBuffer  *util.GBuffer
+	post     *util.PostProcess
+	ssao     *util.SSAO
+	// Show the ambient occlusion instead of the scene
+	ssaoDebug bool
 
 	previousTime  float64
 	animationTime float32
@@ -61,38 +53,24 @@ type App struct {
 	camera     *util.Camera
 
 	depthMapsFirstPass bool
-	brrLamp            util.Lamp
-	brrLampOrbit       mgl32.Vec3
-	brrLampAngle       float32
-	brrLamp2           util.Lamp
-	brrLamp2Dir        float32
-
-	spotlight util.Spotlight
-
-	scorpionTrans  mgl32.Mat4
-	tarantulaTrans mgl32.Mat4
-	locustTrans    mgl32.Mat4
-
-	boids *object.Boids
+	// Lamps placed at the camera at runtime
+	placedLamps []*util.Lamp
 }
 
-// NewApp creates a new app for the window
-func NewApp(w *glfw.Window) *App {
+// NewApp creates a new app for the window, which will render the scene
+// described by the file at scenePath (with deferred or forward lighting)
+func NewApp(w *glfw.Window, scenePath string, deferred bool) *App {
 	a := &App{
 		window: w,
 		camera: util.NewCamera(mgl32.Vec3{0, 10, 11}, mgl32.Vec2{-90, -25}, true),
 
-		brrLampOrbit: mgl32.Vec3{3, 10, 1},
+		scenePath: scenePath,
+		deferred:  deferred,
 
 		fov:    45,
 		paused: false,
 
 		depthMapsFirstPass: true,
-		brrLamp2Dir:        float32(brrLamp2Speed),
-
-		scorpionTrans:  mgl32.Translate3D(6, 0, 0).Mul4(mgl32.Scale3D(0.02, 0.02, 0.02)),
-		tarantulaTrans: mgl32.Translate3D(0, 0, -2).Mul4(mgl32.Scale3D(0.04, 0.04, 0.04)),
-		locustTrans:    mgl32.Translate3D(-8, 0, -2).Mul4(mgl32.Scale3D(0.01, 0.01, 0.01)),
 	}
 
 	wi, hi := w.GetSize()
@@ -114,173 +92,22 @@ func (a *App) Setup() error {
 		return fmt.Errorf("failed to set up crosshair: %w", err)
 	}
 
-	a.skybox, err = util.NewSkybox("assets/skyboxes/mountains/")
-	if err != nil {
-		return fmt.Errorf("failed to set up skybox: %w", err)
-	}
-	a.skybox2, err = util.NewSkybox("assets/skyboxes/city/")
+	a.scene, err = scene.NewFile(a.scenePath, a.deferred)
 	if err != nil {
-		return fmt.Errorf("failed to set up skybox 2: %w", err)
+		return fmt.Errorf("failed to load scene %v: %w", a.scenePath, err)
 	}
 
-	att := util.AttenuationParams{Constant: 1, Linear: 0.07, Quadratic: 0.017}
-	a.brrLamp = util.Lamp{
-		Position: a.brrLampOrbit,
-
-		Ambient:     mgl32.Vec3{0.4, 0.0, 0.0},
-		Diffuse:     mgl32.Vec3{1, 0.0, 0.0},
-		Specular:    mgl32.Vec3{1, 0, 0},
-		Attenuation: att,
-	}
-	a.brrLamp2 = util.Lamp{
-		Position: mgl32.Vec3{6, 3, -1},
-
-		Ambient:     mgl32.Vec3{0.02, 0.05, 0.01},
-		Diffuse:     mgl32.Vec3{0.3, 0.8, 0.15},
-		Specular:    mgl32.Vec3{0.4, 1, 0.2},
-		Attenuation: att,
-	}
-	a.spotlight = util.Spotlight{
-		Cutoff:      util.Cos(mgl32.DegToRad(12.5)),
-		OuterCutoff: util.Cos(mgl32.DegToRad(15)),
-
-		Ambient:  mgl32.Vec3{0, 0, 0},
-		Diffuse:  mgl32.Vec3{1, 1, 1},
-		Specular: mgl32.Vec3{2, 2, 2},
-
-		Attenuation: att,
-	}
-
-	a.lighting, err = util.NewLighting([]*util.DirectionalLight{
-		{
-			Direction: mgl32.Vec3{-0.2, -1, -0.3},
-			Ambient:   mgl32.Vec3{0.1, 0.1, 0.1},
-			Diffuse:   mgl32.Vec3{0.7, 0.7, 0.7},
-			Specular:  mgl32.Vec3{0.5, 0.5, 0.5},
-		},
-	}, []*util.Lamp{
-		{
-			Position: mgl32.Vec3{-2, 8, -2},
-
-			Ambient:     mgl32.Vec3{0.01, 0.02, 0.04},
-			Diffuse:     mgl32.Vec3{0.2, 0.3, 0.7},
-			Specular:    mgl32.Vec3{0.18, 0.4, 0.83},
-			Attenuation: att,
-		},
-		&a.brrLamp,
-		&a.brrLamp2,
-		{
-			Position: mgl32.Vec3{-4, 6, 1},
-
-			Ambient:     mgl32.Vec3{0.05, 0.05, 0.05},
-			Diffuse:     mgl32.Vec3{0.8, 0.8, 0.8},
-			Specular:    mgl32.Vec3{0.4, 0.4, 0.4},
-			Attenuation: att,
-		},
-
-		{
-			Position: mgl32.Vec3{-28, 2, -28},
-
-			Diffuse:     mgl32.Vec3{0.9, 0.9, 0.9},
-			Specular:    mgl32.Vec3{0.4, 0.4, 0.4},
-			Attenuation: att,
-		},
-		{
-			Position: mgl32.Vec3{28, 2, -28},
-
-			Diffuse:     mgl32.Vec3{0.9, 0.9, 0.9},
-			Specular:    mgl32.Vec3{0.4, 0.4, 0.4},
-			Attenuation: att,
-		},
-		{
-			Position: mgl32.Vec3{-28, 2, 28},
-
-			Diffuse:     mgl32.Vec3{0.9, 0.9, 0.9},
-			Specular:    mgl32.Vec3{0.4, 0.4, 0.4},
-			Attenuation: att,
-		},
-	}, []*util.Spotlight{
-		&a.spotlight,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to initialize lighting: %w", err)
-	}
-
-	a.meshShader, err = a.lighting.ProgramVSFile("assets/shaders/mesh.vs")
-	if err != nil {
-		return fmt.Errorf("failed to link mesh shaders: %w", err)
-	}
-	a.meshDepthShader, err = a.lighting.DepthProgramVSFile("assets/shaders/shadows_depth.vs")
-	if err != nil {
-		return fmt.Errorf("failed to link mesh depth pass shaders: %w", err)
-	}
-
-	groundDiffuse := util.NewTexture(gl.TEXTURE_2D)
-	if err := groundDiffuse.LoadJPEGFile(gl.TEXTURE_2D, "assets/textures/brickwall.jpg"); err != nil {
-		return fmt.Errorf("failed to load ground texture: %w", err)
-	}
-	groundDiffuse.Apply2DDefaults()
-
-	groundNormal := util.NewTexture(gl.TEXTURE_2D)
-	if err := groundNormal.LoadJPEGFile(gl.TEXTURE_2D, "assets/textures/brickwall_normal.jpg"); err != nil {
-		return fmt.Errorf("failed to load ground normal map texture: %w", err)
-	}
-	groundNormal.Apply2DDefaults()
-
-	a.ground, err = object.NewOBJMeshFile("assets/meshes/plane.obj", &object.Material{
-		Specular: mgl32.Vec3{0.05, 0.05, 0.05},
-
-		DiffuseTexture: groundDiffuse,
-		NormalTexture:  groundNormal,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to load mesh: %w", err)
-	}
-	a.ground.Upload(a.meshShader).LinkDepthMap(a.meshDepthShader)
-
-	a.backpack, err = object.NewOBJMeshFile("assets/meshes/backpack.obj", &object.Material{
-		Diffuse:        mgl32.Vec3{0, 0.1, 0},
-		Reflectiveness: 0.7,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to load mesh: %w", err)
-	}
-	a.backpack.Upload(a.meshShader).LinkDepthMap(a.meshDepthShader)
-
-	a.skinnedMeshShader, err = a.lighting.ProgramVSTemplateFile("assets/shaders/mesh_skinned.vs", skinnedVSParams{false})
-	if err != nil {
-		return fmt.Errorf("failed to link skinned mesh shaders: %w", err)
-	}
-	a.skinnedMeshDepthShader, err = a.lighting.DepthProgramVSTemplateFile("assets/shaders/mesh_skinned.vs", skinnedVSParams{true})
-	if err != nil {
-		return fmt.Errorf("failed to link skinned mesh depth shaders: %w", err)
-	}
-
-	a.skeletonShader = util.NewProgram()
-	if err := a.skeletonShader.LinkFiles("assets/shaders/generic_3d.vs", "assets/shaders/uniform_color.fs", ""); err != nil {
-		return fmt.Errorf("failed to setup skeleton debug shader: %w", err)
-	}
-	a.skeletonShader.SetUniformVec3("color", mgl32.Vec3{1, 0, 1})
-
-	a.scorpion, err = object.NewObjectFile("assets/objects/scorpion.sobj", a.skinnedMeshShader, a.skinnedMeshDepthShader, a.skeletonShader)
-	if err != nil {
-		return fmt.Errorf("failed to set up scorpion: %w", err)
-	}
-	a.tarantula, err = object.NewObjectFile("assets/objects/tarantula.sobj", a.skinnedMeshShader, a.skinnedMeshDepthShader, a.skeletonShader)
-	if err != nil {
-		return fmt.Errorf("failed to set up tarantula: %w", err)
+	w, h := a.window.GetSize()
+	if a.deferred {
+		if a.gBuffer, err = util.NewGBuffer(int32(w), int32(h)); err != nil {
+			return fmt.Errorf("failed to set up G-buffer: %w", err)
+		}
 	}
-	a.locust, err = object.NewObjectFile("assets/objects/locust.sobj", a.skinnedMeshShader, a.skinnedMeshDepthShader, a.skeletonShader)
-	if err != nil {
-		return fmt.Errorf("failed to set up locust: %w", err)
+	if a.post, err = util.NewPostProcess(int32(w), int32(h)); err != nil {
+		return fmt.Errorf("failed to set up post-processing: %w", err)
 	}
-
-	a.boids = object.NewBoids(util.Bounds{
-		Min: mgl32.Vec3{-32, 0, -32},
-		Max: mgl32.Vec3{32, 0, 32},
-	}, 0.02)
-	for i := 0; i < boidCount; i++ {
-		a.boids.Instances = append(a.boids.Instances, a.boids.MakeBoid())
+	if a.ssao, err = util.NewSSAO(int32(w), int32(h)); err != nil {
+		return fmt.Errorf("failed to set up SSAO: %w", err)
 	}
 
 	gl.Enable(gl.DEPTH_TEST)
@@ -308,17 +135,34 @@ func (a *App) onKeyEvent(w *glfw.Window, key glfw.Key, scancode int, action glfw
 		case glfw.KeyM:
 			object.MeshWireFrame = !object.MeshWireFrame
 		case glfw.KeyE:
-			a.scorpion.Debug = !a.scorpion.Debug
+			for _, o := range a.scene.Objects {
+				o.Debug = !o.Debug
+			}
 		case glfw.KeyP:
 			a.paused = !a.paused
 		case glfw.KeyN:
 			object.DisableNormalMapping = !object.DisableNormalMapping
+		case glfw.KeyG:
+			object.ForcePBR = !object.ForcePBR
 		case glfw.KeyZ:
-			a.lighting.ShadowsEnabled = !a.lighting.ShadowsEnabled
+			a.scene.Lighting.ShadowsEnabled = !a.scene.Lighting.ShadowsEnabled
 		case glfw.KeyX:
-			tmp := a.skybox
-			a.skybox = a.skybox2
-			a.skybox2 = tmp
+			a.skybox = (a.skybox + 1) % len(a.scene.Skyboxes)
+		case glfw.KeyV:
+			a.nextAnimations()
+		case glfw.KeyL:
+			a.placeLamp()
+		case glfw.KeyK:
+			a.removePlacedLamp()
+		case glfw.KeyT:
+			a.post.ToneMapper = a.post.ToneMapper.Next()
+			log.Printf("Tone mapper: %v", a.post.ToneMapper)
+		case glfw.KeyB:
+			a.post.Bloom = !a.post.Bloom
+		case glfw.KeyO:
+			a.ssao.Enabled = !a.ssao.Enabled
+		case glfw.KeyI:
+			a.ssaoDebug = !a.ssaoDebug
 		}
 
 	}
@@ -329,6 +173,56 @@ func (a *App) onKeyEvent(w *glfw.Window, key glfw.Key, scancode int, action glfw
 	}
 }
 
+// nextAnimations crossfades each animated entity to its object's next
+// animation
+func (a *App) nextAnimations() {
+	for _, e := range a.scene.Entities {
+		if e.Crossfade == nil || e.Animator != nil || e.Crossfade.Current() == nil {
+			continue
+		}
+
+		anims := e.Object.Animations
+		next := anims[0]
+		for i, an := range anims {
+			if an == e.Crossfade.Current() {
+				next = anims[(i+1)%len(anims)]
+				break
+			}
+		}
+
+		e.Crossfade.Play(next, animationFadeTime, a.animationTime)
+	}
+}
+
+// placeLamp adds a white lamp at the camera's position (without shadows, so
+// that placing many doesn't need a shadow cube map for each)
+func (a *App) placeLamp() {
+	l := &util.Lamp{
+		Attenuation: a.scene.Attenuation,
+		Position:    a.camera.Position,
+
+		Ambient:  mgl32.Vec3{0.05, 0.05, 0.05},
+		Diffuse:  mgl32.Vec3{0.8, 0.8, 0.8},
+		Specular: mgl32.Vec3{0.4, 0.4, 0.4},
+
+		NoShadows: true,
+	}
+
+	a.scene.Lighting.AddLamp(l)
+	a.placedLamps = append(a.placedLamps, l)
+}
+
+// removePlacedLamp removes the most recently placed lamp
+func (a *App) removePlacedLamp() {
+	if len(a.placedLamps) == 0 {
+		return
+	}
+
+	last := len(a.placedLamps) - 1
+	a.scene.Lighting.RemoveLamp(a.placedLamps[last])
+	a.placedLamps = a.placedLamps[:last]
+}
+
 func (a *App) updateProjection() {
 	w, h := a.window.GetSize()
 	a.projection = mgl32.Perspective(mgl32.DegToRad(a.fov), float32(w)/float32(h), 0.1, 100)
@@ -343,6 +237,32 @@ func (a *App) readInputs() {
 		a.updateProjection()
 	})
 
+	util.KeyAction(a.window, glfw.KeyLeftBracket, func() {
+		if a.post.Exposure -= a.d; a.post.Exposure < 0.05 {
+			a.post.Exposure = 0.05
+		}
+	})
+	util.KeyAction(a.window, glfw.KeyRightBracket, func() {
+		a.post.Exposure += a.d
+	})
+
+	util.KeyAction(a.window, glfw.KeyComma, func() {
+		if a.ssao.Radius -= a.d; a.ssao.Radius < 0.05 {
+			a.ssao.Radius = 0.05
+		}
+	})
+	util.KeyAction(a.window, glfw.KeyPeriod, func() {
+		a.ssao.Radius += a.d
+	})
+	util.KeyAction(a.window, glfw.KeySemicolon, func() {
+		if a.ssao.Intensity -= 2 * a.d; a.ssao.Intensity < 0 {
+			a.ssao.Intensity = 0
+		}
+	})
+	util.KeyAction(a.window, glfw.KeyApostrophe, func() {
+		a.ssao.Intensity += 2 * a.d
+	})
+
 	util.KeyAction(a.window, glfw.KeyW, func() {
 		a.camera.MoveZ(movementSpeed * a.d)
 	})
@@ -366,61 +286,121 @@ func (a *App) readInputs() {
 }
 
 func (a *App) draw() {
-	groundTrans := mgl32.Translate3D(0, 0, 0).Mul4(mgl32.Scale3D(32, 32, 32))
-	backpackTrans := mgl32.Translate3D(7, 4, -8)
+	s := a.scene
+	skybox := s.Skyboxes[a.skybox]
 
 	// Depth map pass
-	a.lighting.ShadowsDepthPass(func(dpa util.DepthMapParamsApplicator) {
-		a.ground.DepthMapPass(a.meshDepthShader, groundTrans, dpa)
-		a.backpack.DepthMapPass(a.meshDepthShader, backpackTrans, dpa)
-
-		a.scorpion.DepthMapPass(a.scorpionTrans, dpa)
-		a.tarantula.DepthMapPass(a.tarantulaTrans, dpa)
-		a.locust.DepthMapPass(a.locustTrans, dpa)
+	s.Lighting.ShadowsDepthPass(func(dpa util.DepthMapParamsApplicator) {
+		for _, e := range s.Entities {
+			if e.Mesh != nil {
+				e.Mesh.DepthMapPass(s.MeshDepthShader, e.Transform, dpa)
+			} else {
+				e.Object.DepthMapPass(e.Transform, dpa)
+			}
+		}
 	})
 
-	// Drawing pass
-	w, h := a.window.GetSize()
-	gl.Viewport(0, 0, int32(w), int32(h))
-	gl.Clear(gl.COLOR_BUFFER_BIT | gl.DEPTH_BUFFER_BIT)
+	a.poseFlocks()
+
+	// Ambient occlusion, from the G-buffer if deferred or a prepass of normals
+	// and depth if not
+	ssao := a.ssao.Enabled || a.ssaoDebug
+	if ssao && !a.deferred {
+		a.ssao.BeginPrepass(s.LitPrograms()...)
+		a.drawGeometry(skybox.Texture)
+		a.ssao.EndPrepass(s.LitPrograms()...)
 
-	a.ground.Draw(a.meshShader, a.projection, a.camera, groundTrans, a.skybox.Texture, a.lighting.DepthMaps)
-	a.backpack.Draw(a.meshShader, a.projection, a.camera, backpackTrans, a.skybox.Texture, a.lighting.DepthMaps)
+		a.ssao.Compute(a.ssao.Depth, a.ssao.Normals, a.projection, a.camera.Transform())
+	}
 
-	a.scorpion.Draw(a.projection, a.camera, a.scorpionTrans, a.skybox.Texture, a.lighting.DepthMaps)
-	a.tarantula.Draw(a.projection, a.camera, a.tarantulaTrans, a.skybox.Texture, a.lighting.DepthMaps)
-	a.locust.Draw(a.projection, a.camera, a.locustTrans, a.skybox.Texture, a.lighting.DepthMaps)
+	// Drawing pass (only geometry if deferred)
+	if a.deferred {
+		a.gBuffer.Bind()
+		a.drawGeometry(skybox.Texture)
+		a.gBuffer.Unbind()
 
-	boidBase := mgl32.Scale3D(0.01, 0.01, 0.01)
-	for _, b := range a.boids.Instances {
-		angle := util.Atan2(b.Velocity.Z(), b.Velocity.X())
-		trans := mgl32.Translate3D(b.Position.X(), 0, b.Position.Z()).Mul4(mgl32.HomogRotate3DY(angle)).Mul4(boidBase)
+		if ssao {
+			a.ssao.Compute(a.gBuffer.Depth, a.gBuffer.Targets[1], a.projection, a.camera.Transform())
+		}
 
-		a.scorpion.Update(a.projection, a.camera, trans, a.scorpion.Animations[4], a.animationTime)
-		a.scorpion.Draw(a.projection, a.camera, trans, a.skybox.Texture, a.lighting.DepthMaps)
+		a.post.Bind()
+		s.Lighting.DeferredPass(a.gBuffer, skybox.Texture)
+	} else {
+		a.post.Bind()
+		a.drawGeometry(skybox.Texture)
 	}
 
-	a.lighting.DrawCubes(a.projection, a.camera)
+	s.Lighting.DrawCubes(a.projection, a.camera)
+
+	skybox.Draw(a.projection, a.camera)
 
-	a.skybox.Draw(a.projection, a.camera)
+	// Tone mapping and bloom to the screen
+	a.post.Draw()
+	if a.ssaoDebug {
+		a.ssao.DrawDebug()
+	}
 
 	a.crosshair.Draw()
 
 	a.window.SwapBuffers()
 }
 
+// drawGeometry draws the entities and flocks
+func (a *App) drawGeometry(envMap *util.Texture) {
+	s := a.scene
+	for _, e := range s.Entities {
+		if e.Mesh != nil {
+			e.Mesh.Draw(s.MeshShader, a.projection, a.camera, e.Transform, envMap, s.Lighting.DepthMaps)
+		} else {
+			e.Object.Draw(a.projection, a.camera, e.Transform, envMap, s.Lighting.DepthMaps)
+		}
+	}
+
+	for _, f := range s.Flocks {
+		f.Crowd.Draw(a.projection, a.camera, envMap, s.Lighting.DepthMaps)
+	}
+}
+
+// poseFlocks evaluates the pose of each boid for drawing
+func (a *App) poseFlocks() {
+	for _, f := range a.scene.Flocks {
+		boidBase := mgl32.Scale3D(f.Scale, f.Scale, f.Scale)
+		f.Crowd.Reset()
+		for i, b := range f.Boids.Instances {
+			angle := util.Atan2(b.Velocity.Z(), b.Velocity.X())
+			trans := mgl32.Translate3D(b.Position.X(), 0, b.Position.Z()).Mul4(mgl32.HomogRotate3DY(angle)).Mul4(boidBase)
+
+			var layers []object.AnimationLayer
+			if f.Animators != nil {
+				anim := f.Animators[i]
+				anim.SetFloat("speed", b.Velocity.Len()/f.Boids.MaxSpeed)
+				layers = anim.Update(a.animationTime)
+			} else {
+				layers = f.Instances[i].Layers(a.animationTime)
+			}
+
+			f.Object.Evaluate(f.Pose, trans, layers)
+			f.Crowd.AddPose(f.Pose)
+		}
+	}
+}
+
 // Update updates the app state and draws to the screen
 func (a *App) Update() {
+	s := a.scene
+
 	t := glfw.GetTime()
 	a.d = float32(t - a.previousTime)
 	if !a.paused {
 		a.animationTime += float32(a.d)
-		a.boids.Update()
+		s.Boids.Update(a.d)
 	}
 
 	if t-a.lastDebug > 1 {
 		log.Printf("FPS: %v", a.frames)
 		log.Printf("FOV: %v", a.fov)
+		log.Printf("Exposure: %v", a.post.Exposure)
+		log.Printf("SSAO radius: %v, intensity: %v", a.ssao.Radius, a.ssao.Intensity)
 		log.Printf("Camera position: %v", a.camera.Position)
 		log.Printf("Camera rotation: %v", a.camera.Rotation())
 		log.Printf("Camera direction: %v", a.camera.Direction())
@@ -431,37 +411,46 @@ func (a *App) Update() {
 
 	a.readInputs()
 
-	brrLampTransform := util.TransFromPos(a.brrLampOrbit).Mul4(mgl32.HomogRotate3DY(a.brrLampAngle)).Mul4(mgl32.Translate3D(0, 0, -5))
-	a.brrLamp.Position = util.PosFromTrans(brrLampTransform)
-	a.spotlight.Position = a.camera.Position
-	a.spotlight.Direction = a.camera.Direction()
-
-	a.brrLamp2.Position = mgl32.Vec3{a.brrLamp2.Position.X() + a.brrLamp2Dir*a.d, a.brrLamp2.Position.Y(), a.brrLamp2.Position.Z()}
+	for _, spot := range s.CameraSpotlights {
+		spot.Position = a.camera.Position
+		spot.Direction = a.camera.Direction()
+	}
+	for _, t := range s.CameraTargets {
+		*t = a.camera.Position
+	}
+	for _, m := range s.MovingLamps {
+		m.Update(a.d)
+	}
 
-	a.lighting.SetViewPos(a.camera.Position)
-	a.lighting.Update(a.meshShader, a.skinnedMeshShader)
+	s.Lighting.SetViewPos(a.camera.Position)
+	s.Lighting.SetView(a.projection, a.camera)
+	s.Lighting.SetViewportSize(a.window.GetSize())
+	s.Lighting.AmbientOcclusion = nil
+	if a.ssao.Enabled {
+		s.Lighting.AmbientOcclusion = a.ssao.Occlusion
+	}
+	s.Lighting.Update(s.LitPrograms()...)
 
 	if a.depthMapsFirstPass {
-		a.lighting.UpdateLamps(a.meshShader, a.skinnedMeshShader)
+		s.Lighting.UpdateLamps()
 		a.depthMapsFirstPass = false
 	} else {
-		a.lighting.UpdateLamp(&a.brrLamp, a.meshShader, a.skinnedMeshShader)
-		a.lighting.UpdateLamp(&a.brrLamp2, a.meshShader, a.skinnedMeshShader)
+		for _, m := range s.MovingLamps {
+			s.Lighting.UpdateLamp(m.Lamp)
+		}
 	}
 
-	a.brrLampAngle += 4 * a.d
-	if a.brrLampAngle > 360 {
-		a.brrLampAngle = 0
-	}
-	if a.brrLamp2.Position.X() > 12 {
-		a.brrLamp2Dir = -float32(brrLamp2Speed)
-	} else if a.brrLamp2.Position.X() < 6 {
-		a.brrLamp2Dir = float32(brrLamp2Speed)
-	}
+	for _, e := range s.Entities {
+		if e.Object != nil {
+			layers := e.Crossfade.Layers(a.animationTime)
+			if e.Animator != nil {
+				layers = e.Animator.Update(a.animationTime)
+			}
 
-	a.scorpion.Update(a.projection, a.camera, a.scorpionTrans, a.scorpion.Animations[0], a.animationTime)
-	a.tarantula.Update(a.projection, a.camera, a.tarantulaTrans, nil, 0)
-	a.locust.Update(a.projection, a.camera, a.locustTrans, nil, 0)
+			_, motion := e.Object.UpdateBlend(a.projection, a.camera, e.Transform, layers)
+			e.Transform = e.Transform.Mul4(motion.Mat4())
+		}
+	}
 
 	a.draw()
 
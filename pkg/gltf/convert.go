@@ -0,0 +1,711 @@
+package gltf
+
+import (
+	"bytes"
+	"fmt"
+	goimage "image"
+	"image/png"
+	"log"
+	"math"
+
+	// Register decoders for embedded images
+	_ "image/jpeg"
+
+	"github.com/go-gl/mathgl/mgl32"
+
+	"github.com/devplayer0/cs4052/pkg/pb"
+	"github.com/devplayer0/cs4052/pkg/util"
+)
+
+type meshKey struct {
+	mesh int
+	// skin index, or the (negated, offset) node index for rigid meshes
+	binding int
+}
+
+type converter struct {
+	d   *Document
+	obj *pb.Object
+
+	nodeJoints      map[int]uint32
+	textures        map[int]*pb.Texture
+	defaultMaterial *uint32
+	meshCache       map[meshKey][]uint32
+}
+
+func (n node) local() mgl32.Mat4 {
+	if n.Matrix != nil {
+		return mgl32.Mat4(*n.Matrix)
+	}
+
+	t, r, s := n.trs()
+	return util.TransFromPos(t).Mul4(r.Mat4()).Mul4(mgl32.Scale3D(s.X(), s.Y(), s.Z()))
+}
+
+// trs returns the node's rest translation, rotation and scale
+func (n node) trs() (mgl32.Vec3, mgl32.Quat, mgl32.Vec3) {
+	if n.Matrix != nil {
+		return util.DecomposeTransform(mgl32.Mat4(*n.Matrix))
+	}
+
+	t := mgl32.Vec3{}
+	r := mgl32.QuatIdent()
+	s := mgl32.Vec3{1, 1, 1}
+	if n.Translation != nil {
+		t = *n.Translation
+	}
+	if n.Rotation != nil {
+		r = mgl32.Quat{W: n.Rotation[3], V: mgl32.Vec3{n.Rotation[0], n.Rotation[1], n.Rotation[2]}}
+	}
+	if n.Scale != nil {
+		s = *n.Scale
+	}
+
+	return t, r, s
+}
+
+func (c *converter) texture(info *textureInfo) (*pb.Texture, error) {
+	if info == nil {
+		return nil, nil
+	}
+	if t, ok := c.textures[info.Index]; ok {
+		return t, nil
+	}
+
+	if info.Index < 0 || info.Index >= len(c.d.Textures) || c.d.Textures[info.Index].Source == nil {
+		return nil, fmt.Errorf("invalid texture %v", info.Index)
+	}
+	data, err := c.d.imageData(*c.d.Textures[info.Index].Source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load image: %w", err)
+	}
+
+	// The object loader only accepts PNG's
+	if !isPNG(data) {
+		img, _, err := goimage.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode image: %w", err)
+		}
+
+		buf := &bytes.Buffer{}
+		if err := png.Encode(buf, img); err != nil {
+			return nil, fmt.Errorf("failed to encode PNG: %w", err)
+		}
+		data = buf.Bytes()
+	}
+
+	t := &pb.Texture{Data: data}
+	c.textures[info.Index] = t
+	return t, nil
+}
+
+// material converts a metallic-roughness material (also filling in the Phong
+// parameters as an approximation)
+func (c *converter) material(m material) (*pb.Material, error) {
+	out := &pb.Material{Name: m.Name}
+
+	pbr := m.PBRMetallicRoughness
+	if pbr == nil {
+		pbr = &pbrMetallicRoughness{}
+	}
+
+	var err error
+	if out.Diffuse, err = c.texture(pbr.BaseColorTexture); err != nil {
+		return nil, fmt.Errorf("base colour texture: %w", err)
+	}
+	if out.Diffuse == nil {
+		base := mgl32.Vec3{1, 1, 1}
+		if pbr.BaseColorFactor != nil {
+			base = mgl32.Vec4(*pbr.BaseColorFactor).Vec3()
+		}
+		out.DiffuseColor = util.Vec3PB(base)
+	}
+
+	if out.Normal, err = c.texture(m.NormalTexture); err != nil {
+		return nil, fmt.Errorf("normal texture: %w", err)
+	}
+	if out.Emissive, err = c.texture(m.EmissiveTexture); err != nil {
+		return nil, fmt.Errorf("emissive texture: %w", err)
+	}
+	if out.Emissive == nil && m.EmissiveFactor != nil {
+		out.EmissiveColor = util.Vec3PB(*m.EmissiveFactor)
+	}
+
+	out.Pbr = true
+	out.Metallic = 1
+	if pbr.MetallicFactor != nil {
+		out.Metallic = *pbr.MetallicFactor
+	}
+	out.Roughness = 1
+	if pbr.RoughnessFactor != nil {
+		out.Roughness = *pbr.RoughnessFactor
+	}
+	if out.MetallicRoughness, err = c.texture(pbr.MetallicRoughnessTexture); err != nil {
+		return nil, fmt.Errorf("metallic-roughness texture: %w", err)
+	}
+	if out.Occlusion, err = c.texture(m.OcclusionTexture); err != nil {
+		return nil, fmt.Errorf("occlusion texture: %w", err)
+	}
+
+	// Approximate specular highlights from roughness (using the common
+	// Blinn-Phong exponent mapping for alpha = roughness^2)
+	roughness := out.Roughness
+	alpha := mgl32.Clamp(roughness*roughness, 0.01, 1)
+	out.Shininess = mgl32.Clamp(2/(alpha*alpha)-2, 1, 1024)
+	spec := 0.5 * (1 - roughness)
+	out.SpecularColor = util.Vec3PB(mgl32.Vec3{spec, spec, spec})
+
+	return out, nil
+}
+
+func (c *converter) materialID(i *int) (uint32, error) {
+	if i != nil {
+		if *i < 0 || *i >= len(c.d.Materials) {
+			return 0, fmt.Errorf("invalid material %v", *i)
+		}
+
+		return uint32(*i), nil
+	}
+
+	if c.defaultMaterial == nil {
+		id := uint32(len(c.obj.Materials))
+		c.obj.Materials = append(c.obj.Materials, &pb.Material{
+			Name:          "default",
+			DiffuseColor:  util.Vec3PB(mgl32.Vec3{1, 1, 1}),
+			SpecularColor: util.Vec3PB(mgl32.Vec3{0.2, 0.2, 0.2}),
+		})
+		c.defaultMaterial = &id
+	}
+
+	return *c.defaultMaterial, nil
+}
+
+// joint returns the joint ID for a node, creating one if necessary
+func (c *converter) joint(n int, inverseBind mgl32.Mat4) uint32 {
+	if id, ok := c.nodeJoints[n]; ok {
+		return id
+	}
+
+	id := uint32(len(c.obj.Joints))
+	c.obj.Joints = append(c.obj.Joints, &pb.Joint{InverseBind: util.Mat4PB(inverseBind)})
+	c.obj.Hierarchy[n+1].JointID = &id
+	c.nodeJoints[n] = id
+
+	return id
+}
+
+func (c *converter) skins() error {
+	for i, s := range c.d.Skins {
+		var ibms []float32
+		if s.InverseBindMatrices != nil {
+			var err error
+			if ibms, _, err = c.d.readAccessor(*s.InverseBindMatrices); err != nil {
+				return fmt.Errorf("skin %v: %w", i, err)
+			}
+			if len(ibms) < len(s.Joints)*16 {
+				return fmt.Errorf("skin %v: not enough inverse bind matrices", i)
+			}
+		}
+
+		for j, n := range s.Joints {
+			if n < 0 || n >= len(c.d.Nodes) {
+				return fmt.Errorf("skin %v: invalid joint node %v", i, n)
+			}
+
+			ibm := mgl32.Ident4()
+			if ibms != nil {
+				copy(ibm[:], ibms[j*16:])
+			}
+
+			if id, ok := c.nodeJoints[n]; ok && util.PBMat4(c.obj.Joints[id].InverseBind) != ibm {
+				log.Printf("Warning: joint %v is shared between skins with different bind poses", c.d.Nodes[n].Name)
+			}
+			c.joint(n, ibm)
+		}
+	}
+
+	return nil
+}
+
+func vec3s(fs []float32) []mgl32.Vec3 {
+	out := make([]mgl32.Vec3, len(fs)/3)
+	for i := range out {
+		out[i] = mgl32.Vec3{fs[i*3], fs[i*3+1], fs[i*3+2]}
+	}
+
+	return out
+}
+
+type weightAttrs struct {
+	joints, weights string
+}
+
+var skinAttrs = []weightAttrs{
+	{"JOINTS_0", "WEIGHTS_0"},
+	{"JOINTS_1", "WEIGHTS_1"},
+}
+
+// primitive converts a single primitive to a mesh, binding it either to a skin
+// or rigidly to a single joint (with the given inverse bind transform)
+func (c *converter) primitive(p primitive, s *skin, rigidJoint uint32, rigidBind mgl32.Mat4) (*pb.Mesh, error) {
+	posAcc, ok := p.Attributes["POSITION"]
+	if !ok {
+		return nil, fmt.Errorf("missing POSITION attribute")
+	}
+	fs, _, err := c.d.readAccessor(posAcc)
+	if err != nil {
+		return nil, fmt.Errorf("positions: %w", err)
+	}
+	positions := vec3s(fs)
+
+	var indices []uint32
+	if p.Indices != nil {
+		if indices, _, err = c.d.readUints(*p.Indices); err != nil {
+			return nil, fmt.Errorf("indices: %w", err)
+		}
+	} else {
+		indices = make([]uint32, len(positions))
+		for i := range indices {
+			indices[i] = uint32(i)
+		}
+	}
+	for _, i := range indices {
+		if int(i) >= len(positions) {
+			return nil, fmt.Errorf("vertex index %v out of range", i)
+		}
+	}
+
+	var normals []mgl32.Vec3
+	if a, ok := p.Attributes["NORMAL"]; ok {
+		if fs, _, err = c.d.readAccessor(a); err != nil {
+			return nil, fmt.Errorf("normals: %w", err)
+		}
+		normals = vec3s(fs)
+	} else {
+		normals = util.CalculateNormals(positions, indices)
+	}
+
+	uvs := make([]mgl32.Vec2, len(positions))
+	if a, ok := p.Attributes["TEXCOORD_0"]; ok {
+		if fs, _, err = c.d.readAccessor(a); err != nil {
+			return nil, fmt.Errorf("texture coordinates: %w", err)
+		}
+		for i := range uvs {
+			uvs[i] = mgl32.Vec2{fs[i*2], fs[i*2+1]}
+		}
+	}
+
+	var tangents, bitangents []mgl32.Vec3
+	if a, ok := p.Attributes["TANGENT"]; ok {
+		if fs, _, err = c.d.readAccessor(a); err != nil {
+			return nil, fmt.Errorf("tangents: %w", err)
+		}
+
+		tangents = make([]mgl32.Vec3, len(positions))
+		bitangents = make([]mgl32.Vec3, len(positions))
+		for i := range tangents {
+			tangents[i] = mgl32.Vec3{fs[i*4], fs[i*4+1], fs[i*4+2]}
+			// w is the handedness of the bitangent
+			bitangents[i] = normals[i].Cross(tangents[i]).Mul(fs[i*4+3])
+		}
+	} else {
+		tangents, bitangents = util.CalculateTangents(positions, normals, uvs, indices)
+	}
+
+	mID, err := c.materialID(p.Material)
+	if err != nil {
+		return nil, err
+	}
+	m := &pb.Mesh{
+		MaterialID: mID,
+		Weights:    make(map[uint32]*pb.VertexWeights),
+	}
+
+	addWeight := func(joint uint32, v int, w float32) {
+		vws, ok := m.Weights[joint]
+		if !ok {
+			vws = &pb.VertexWeights{}
+			m.Weights[joint] = vws
+		}
+
+		vws.Weights = append(vws.Weights, &pb.VertexWeight{Vertex: uint32(v), Weight: w})
+	}
+
+	if s != nil {
+		for _, attrs := range skinAttrs {
+			ja, ok := p.Attributes[attrs.joints]
+			if !ok {
+				continue
+			}
+			wa, ok := p.Attributes[attrs.weights]
+			if !ok {
+				return nil, fmt.Errorf("%v without %v", attrs.joints, attrs.weights)
+			}
+
+			joints, _, err := c.d.readUints(ja)
+			if err != nil {
+				return nil, fmt.Errorf("joints: %w", err)
+			}
+			weights, _, err := c.d.readAccessor(wa)
+			if err != nil {
+				return nil, fmt.Errorf("weights: %w", err)
+			}
+			if len(joints) < len(positions)*4 || len(weights) < len(positions)*4 {
+				return nil, fmt.Errorf("not enough joints / weights")
+			}
+
+			for v := range positions {
+				for k := 0; k < 4; k++ {
+					w := weights[v*4+k]
+					if w == 0 {
+						continue
+					}
+
+					j := int(joints[v*4+k])
+					if j >= len(s.Joints) {
+						return nil, fmt.Errorf("joint index %v out of range", j)
+					}
+					addWeight(c.nodeJoints[s.Joints[j]], v, w)
+				}
+			}
+		}
+	} else {
+		// Bake the inverse of the joint's bind transform into the vertices, so
+		// the mesh follows its node exactly
+		bind := rigidBind.Inv()
+		normalMat := bind.Mat3().Inv().Transpose()
+		for v := range positions {
+			positions[v] = mgl32.TransformCoordinate(positions[v], bind)
+			normals[v] = normalMat.Mul3x1(normals[v]).Normalize()
+			tangents[v] = normalMat.Mul3x1(tangents[v])
+			bitangents[v] = normalMat.Mul3x1(bitangents[v])
+
+			addWeight(rigidJoint, v, 1)
+		}
+	}
+
+	m.Vertices = make([]*pb.Vertex, len(positions))
+	for i := range positions {
+		m.Vertices[i] = &pb.Vertex{
+			Position:  util.Vec3PB(positions[i]),
+			Normal:    util.Vec3PB(normals[i]),
+			Uv:        util.Vec2PB(uvs[i]),
+			Tangent:   util.Vec3PB(tangents[i]),
+			Bitangent: util.Vec3PB(bitangents[i]),
+		}
+	}
+
+	m.Faces = make([]*pb.Triangle, len(indices)/3)
+	for i := range m.Faces {
+		m.Faces[i] = &pb.Triangle{
+			A: indices[i*3],
+			B: indices[i*3+1],
+			C: indices[i*3+2],
+		}
+	}
+
+	return m, nil
+}
+
+// meshes converts the primitives of a mesh attached to a node (caching the
+// result, since meshes can be instanced)
+func (c *converter) meshes(n int) ([]uint32, error) {
+	gn := c.d.Nodes[n]
+	mi := *gn.Mesh
+	if mi < 0 || mi >= len(c.d.Meshes) {
+		return nil, fmt.Errorf("invalid mesh %v", mi)
+	}
+
+	key := meshKey{mi, -1 - n}
+	var s *skin
+	if gn.Skin != nil {
+		if *gn.Skin < 0 || *gn.Skin >= len(c.d.Skins) {
+			return nil, fmt.Errorf("invalid skin %v", *gn.Skin)
+		}
+
+		key.binding = *gn.Skin
+		s = &c.d.Skins[*gn.Skin]
+	}
+	if ids, ok := c.meshCache[key]; ok {
+		return ids, nil
+	}
+
+	var rigidJoint uint32
+	rigidBind := mgl32.Ident4()
+	if s == nil {
+		rigidJoint = c.joint(n, rigidBind)
+		rigidBind = util.PBMat4(c.obj.Joints[rigidJoint].InverseBind)
+	}
+
+	gm := c.d.Meshes[mi]
+	var ids []uint32
+	for i, p := range gm.Primitives {
+		if p.Mode != nil && *p.Mode != modeTriangles {
+			log.Printf("Warning: skipping non-triangle primitive %v of mesh %v", i, gm.Name)
+			continue
+		}
+
+		m, err := c.primitive(p, s, rigidJoint, rigidBind)
+		if err != nil {
+			return nil, fmt.Errorf("mesh %v primitive %v: %w", gm.Name, i, err)
+		}
+		m.Name = fmt.Sprintf("%v_%v", gm.Name, i)
+
+		ids = append(ids, uint32(len(c.obj.Meshes)))
+		c.obj.Meshes = append(c.obj.Meshes, m)
+	}
+
+	c.meshCache[key] = ids
+	return ids, nil
+}
+
+// instances walks the node tree, instancing meshes at their rest transforms
+func (c *converter) instances(n int, parent mgl32.Mat4, visited map[int]bool) error {
+	if n < 0 || n >= len(c.d.Nodes) {
+		return fmt.Errorf("invalid node %v", n)
+	}
+	if visited[n] {
+		return fmt.Errorf("node %v has multiple parents", n)
+	}
+	visited[n] = true
+
+	gn := c.d.Nodes[n]
+	final := parent.Mul4(gn.local())
+	if gn.Mesh != nil {
+		ids, err := c.meshes(n)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			c.obj.Instances = append(c.obj.Instances, &pb.MeshInstance{
+				MeshID:    id,
+				Transform: util.Mat4PB(final),
+			})
+		}
+	}
+
+	for _, child := range gn.Children {
+		if err := c.instances(child, final, visited); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var interpolations = map[string]pb.AnimChannel_Interpolation{
+	"":            pb.AnimChannel_LINEAR,
+	"LINEAR":      pb.AnimChannel_LINEAR,
+	"STEP":        pb.AnimChannel_STEP,
+	"CUBICSPLINE": pb.AnimChannel_CUBIC_SPLINE,
+}
+
+func (c *converter) vec3Keys(times, values []float32, interp pb.AnimChannel_Interpolation) []*pb.Vec3Key {
+	keys := make([]*pb.Vec3Key, len(times))
+	for i, t := range times {
+		var v mgl32.Vec3
+		if interp != pb.AnimChannel_CUBIC_SPLINE {
+			copy(v[:], values[i*3:])
+			keys[i] = &pb.Vec3Key{Time: t, Value: util.Vec3PB(v)}
+			continue
+		}
+
+		// in-tangent, value, out-tangent
+		var in, out mgl32.Vec3
+		copy(in[:], values[i*9:])
+		copy(v[:], values[i*9+3:])
+		copy(out[:], values[i*9+6:])
+		keys[i] = &pb.Vec3Key{
+			Time:       t,
+			Value:      util.Vec3PB(v),
+			InTangent:  util.Vec3PB(in),
+			OutTangent: util.Vec3PB(out),
+		}
+	}
+
+	return keys
+}
+
+func (c *converter) quatKeys(times, values []float32, interp pb.AnimChannel_Interpolation) []*pb.Vec4Key {
+	keys := make([]*pb.Vec4Key, len(times))
+	for i, t := range times {
+		var v mgl32.Vec4
+		if interp != pb.AnimChannel_CUBIC_SPLINE {
+			copy(v[:], values[i*4:])
+			keys[i] = &pb.Vec4Key{Time: t, Value: util.Vec4PB(v)}
+			continue
+		}
+
+		var in, out mgl32.Vec4
+		copy(in[:], values[i*12:])
+		copy(v[:], values[i*12+4:])
+		copy(out[:], values[i*12+8:])
+		keys[i] = &pb.Vec4Key{
+			Time:       t,
+			Value:      util.Vec4PB(v),
+			InTangent:  util.Vec4PB(in),
+			OutTangent: util.Vec4PB(out),
+		}
+	}
+
+	return keys
+}
+
+func (c *converter) animation(a animation) (*pb.Animation, error) {
+	out := &pb.Animation{
+		Name: a.Name,
+		// glTF keyframe times are in seconds
+		Tps: 1,
+	}
+
+	channels := make(map[int]*pb.AnimChannel)
+	var order []int
+	for i, ch := range a.Channels {
+		if ch.Target.Node == nil {
+			continue
+		}
+		n := *ch.Target.Node
+		if n < 0 || n >= len(c.d.Nodes) {
+			return nil, fmt.Errorf("channel %v: invalid node %v", i, n)
+		}
+		if ch.Sampler < 0 || ch.Sampler >= len(a.Samplers) {
+			return nil, fmt.Errorf("channel %v: invalid sampler %v", i, ch.Sampler)
+		}
+		s := a.Samplers[ch.Sampler]
+
+		times, _, err := c.d.readAccessor(s.Input)
+		if err != nil {
+			return nil, fmt.Errorf("channel %v input: %w", i, err)
+		}
+		values, _, err := c.d.readAccessor(s.Output)
+		if err != nil {
+			return nil, fmt.Errorf("channel %v output: %w", i, err)
+		}
+		interp, ok := interpolations[s.Interpolation]
+		if !ok {
+			return nil, fmt.Errorf("channel %v: unknown interpolation %v", i, s.Interpolation)
+		}
+
+		for _, t := range times {
+			out.Duration = float32(math.Max(float64(out.Duration), float64(t)))
+		}
+
+		cc, ok := channels[n]
+		if !ok {
+			cc = &pb.AnimChannel{NodeID: uint32(n + 1)}
+			channels[n] = cc
+			order = append(order, n)
+		}
+
+		perKey := map[string]int{"translation": 3, "rotation": 4, "scale": 3}[ch.Target.Path]
+		if interp == pb.AnimChannel_CUBIC_SPLINE {
+			perKey *= 3
+		}
+		if perKey != 0 && len(values) < len(times)*perKey {
+			return nil, fmt.Errorf("channel %v: not enough output values", i)
+		}
+
+		switch ch.Target.Path {
+		case "translation":
+			cc.PosFrames = c.vec3Keys(times, values, interp)
+			cc.PosInterpolation = interp
+		case "rotation":
+			cc.RotFrames = c.quatKeys(times, values, interp)
+			cc.RotInterpolation = interp
+		case "scale":
+			cc.ScaleFrames = c.vec3Keys(times, values, interp)
+			cc.ScaleInterpolation = interp
+		default:
+			log.Printf("Warning: unsupported animation path %v in animation %v", ch.Target.Path, a.Name)
+		}
+	}
+
+	// Components without keys fall back to the node's rest pose (which is
+	// the same as in glTF)
+	for _, n := range order {
+		out.Channels = append(out.Channels, channels[n])
+	}
+
+	for _, e := range a.events() {
+		out.Events = append(out.Events, &pb.AnimEvent{Name: e.Name, Time: e.Time})
+	}
+
+	return out, nil
+}
+
+// Convert builds an Object protobuf (as stored in .sobj files) from the asset
+func (d *Document) Convert() (*pb.Object, error) {
+	c := &converter{
+		d:   d,
+		obj: &pb.Object{},
+
+		nodeJoints: make(map[int]uint32),
+		textures:   make(map[int]*pb.Texture),
+		meshCache:  make(map[meshKey][]uint32),
+	}
+
+	for i, m := range d.Materials {
+		cm, err := c.material(m)
+		if err != nil {
+			return nil, fmt.Errorf("material %v: %w", i, err)
+		}
+
+		c.obj.Materials = append(c.obj.Materials, cm)
+	}
+
+	// Node 0 is a synthetic root for the scene's root nodes, so glTF node i
+	// becomes node i+1
+	roots := d.rootNodes()
+	root := &pb.Node{
+		Name:      "root",
+		Transform: util.Mat4PB(mgl32.Ident4()),
+	}
+	for _, r := range roots {
+		root.Children = append(root.Children, uint32(r+1))
+	}
+	c.obj.Hierarchy = append(c.obj.Hierarchy, root)
+	for _, n := range d.Nodes {
+		cn := &pb.Node{
+			Name:      n.Name,
+			Transform: util.Mat4PB(n.local()),
+		}
+		for _, child := range n.Children {
+			cn.Children = append(cn.Children, uint32(child+1))
+		}
+
+		c.obj.Hierarchy = append(c.obj.Hierarchy, cn)
+	}
+
+	if err := c.skins(); err != nil {
+		return nil, err
+	}
+
+	visited := make(map[int]bool)
+	for _, r := range roots {
+		if err := c.instances(r, mgl32.Ident4(), visited); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, a := range d.Animations {
+		ca, err := c.animation(a)
+		if err != nil {
+			return nil, fmt.Errorf("animation %v: %w", i, err)
+		}
+
+		c.obj.Animations = append(c.obj.Animations, ca)
+	}
+
+	return c.obj, nil
+}
+
+// ConvertFile reads a .gltf or .glb file and converts it to an Object protobuf
+func ConvertFile(file string) (*pb.Object, error) {
+	d, err := ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.Convert()
+}
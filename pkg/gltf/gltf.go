@@ -0,0 +1,512 @@
+package gltf
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	glbMagic     = 0x46546c67 // "glTF"
+	glbChunkJSON = 0x4e4f534a // "JSON"
+	glbChunkBIN  = 0x004e4942 // "BIN\0"
+)
+
+// Accessor component types
+const (
+	componentByte          = 5120
+	componentUnsignedByte  = 5121
+	componentShort         = 5122
+	componentUnsignedShort = 5123
+	componentUnsignedInt   = 5125
+	componentFloat         = 5126
+)
+
+// Primitive modes
+const (
+	modeTriangles = 4
+)
+
+var typeComponents = map[string]int{
+	"SCALAR": 1,
+	"VEC2":   2,
+	"VEC3":   3,
+	"VEC4":   4,
+	"MAT2":   4,
+	"MAT3":   9,
+	"MAT4":   16,
+}
+
+type textureInfo struct {
+	Index    int     `json:"index"`
+	TexCoord int     `json:"texCoord"`
+	Scale    float32 `json:"scale"`
+}
+
+type pbrMetallicRoughness struct {
+	BaseColorFactor          *[4]float32  `json:"baseColorFactor"`
+	BaseColorTexture         *textureInfo `json:"baseColorTexture"`
+	MetallicFactor           *float32     `json:"metallicFactor"`
+	RoughnessFactor          *float32     `json:"roughnessFactor"`
+	MetallicRoughnessTexture *textureInfo `json:"metallicRoughnessTexture"`
+}
+
+type material struct {
+	Name                 string                `json:"name"`
+	PBRMetallicRoughness *pbrMetallicRoughness `json:"pbrMetallicRoughness"`
+	NormalTexture        *textureInfo          `json:"normalTexture"`
+	OcclusionTexture     *textureInfo          `json:"occlusionTexture"`
+	EmissiveTexture      *textureInfo          `json:"emissiveTexture"`
+	EmissiveFactor       *[3]float32           `json:"emissiveFactor"`
+}
+
+type primitive struct {
+	Attributes map[string]int `json:"attributes"`
+	Indices    *int           `json:"indices"`
+	Material   *int           `json:"material"`
+	Mode       *int           `json:"mode"`
+}
+
+type mesh struct {
+	Name       string      `json:"name"`
+	Primitives []primitive `json:"primitives"`
+}
+
+type node struct {
+	Name        string       `json:"name"`
+	Children    []int        `json:"children"`
+	Matrix      *[16]float32 `json:"matrix"`
+	Translation *[3]float32  `json:"translation"`
+	Rotation    *[4]float32  `json:"rotation"`
+	Scale       *[3]float32  `json:"scale"`
+	Mesh        *int         `json:"mesh"`
+	Skin        *int         `json:"skin"`
+}
+
+type skin struct {
+	Name                string `json:"name"`
+	InverseBindMatrices *int   `json:"inverseBindMatrices"`
+	Joints              []int  `json:"joints"`
+}
+
+type animationSampler struct {
+	Input         int    `json:"input"`
+	Output        int    `json:"output"`
+	Interpolation string `json:"interpolation"`
+}
+
+type animationChannel struct {
+	Sampler int `json:"sampler"`
+	Target  struct {
+		Node *int   `json:"node"`
+		Path string `json:"path"`
+	} `json:"target"`
+}
+
+type animationEvent struct {
+	Name string  `json:"name"`
+	Time float32 `json:"time"`
+}
+
+type animation struct {
+	Name     string             `json:"name"`
+	Channels []animationChannel `json:"channels"`
+	Samplers []animationSampler `json:"samplers"`
+
+	// Application-specific data (may be any JSON value)
+	Extras json.RawMessage `json:"extras"`
+}
+
+// events reads the animation's events, which glTF has no concept of, from its
+// extras (as {"events": [{"name": ..., "time": ...}]})
+func (a animation) events() []animationEvent {
+	var extras struct {
+		Events []animationEvent `json:"events"`
+	}
+	if len(a.Extras) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(a.Extras, &extras); err != nil {
+		log.Printf("Warning: ignoring unrecognised extras in animation %v", a.Name)
+		return nil
+	}
+
+	return extras.Events
+}
+
+type texture struct {
+	Source *int `json:"source"`
+}
+
+type image struct {
+	URI        string `json:"uri"`
+	MimeType   string `json:"mimeType"`
+	BufferView *int   `json:"bufferView"`
+}
+
+type buffer struct {
+	URI        string `json:"uri"`
+	ByteLength int    `json:"byteLength"`
+}
+
+type bufferView struct {
+	Buffer     int `json:"buffer"`
+	ByteOffset int `json:"byteOffset"`
+	ByteLength int `json:"byteLength"`
+	ByteStride int `json:"byteStride"`
+}
+
+type accessor struct {
+	BufferView    *int            `json:"bufferView"`
+	ByteOffset    int             `json:"byteOffset"`
+	ComponentType int             `json:"componentType"`
+	Normalized    bool            `json:"normalized"`
+	Count         int             `json:"count"`
+	Type          string          `json:"type"`
+	Sparse        json.RawMessage `json:"sparse"`
+}
+
+type scene struct {
+	Nodes []int `json:"nodes"`
+}
+
+// Document represents a parsed glTF 2.0 asset (with all buffers loaded)
+type Document struct {
+	Asset struct {
+		Version string `json:"version"`
+	} `json:"asset"`
+
+	Scene       *int         `json:"scene"`
+	Scenes      []scene      `json:"scenes"`
+	Nodes       []node       `json:"nodes"`
+	Meshes      []mesh       `json:"meshes"`
+	Skins       []skin       `json:"skins"`
+	Animations  []animation  `json:"animations"`
+	Materials   []material   `json:"materials"`
+	Textures    []texture    `json:"textures"`
+	Images      []image      `json:"images"`
+	Buffers     []buffer     `json:"buffers"`
+	BufferViews []bufferView `json:"bufferViews"`
+	Accessors   []accessor   `json:"accessors"`
+
+	dir  string
+	data [][]byte
+}
+
+func readURI(dir, uri string) ([]byte, error) {
+	if strings.HasPrefix(uri, "data:") {
+		i := strings.Index(uri, ";base64,")
+		if i == -1 {
+			return nil, errors.New("only base64 data URIs are supported")
+		}
+
+		return base64.StdEncoding.DecodeString(uri[i+len(";base64,"):])
+	}
+
+	return ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(uri)))
+}
+
+func parseGLB(data []byte) (jsonData, bin []byte, err error) {
+	if len(data) < 12 {
+		return nil, nil, errors.New("file too short")
+	}
+	if binary.LittleEndian.Uint32(data[4:]) != 2 {
+		return nil, nil, fmt.Errorf("unsupported GLB version %v", binary.LittleEndian.Uint32(data[4:]))
+	}
+
+	length := int(binary.LittleEndian.Uint32(data[8:]))
+	if length > len(data) {
+		return nil, nil, errors.New("truncated file")
+	}
+
+	for off := 12; off+8 <= length; {
+		chunkLen := int(binary.LittleEndian.Uint32(data[off:]))
+		chunkType := binary.LittleEndian.Uint32(data[off+4:])
+		off += 8
+		if off+chunkLen > length {
+			return nil, nil, errors.New("truncated chunk")
+		}
+
+		switch chunkType {
+		case glbChunkJSON:
+			jsonData = data[off : off+chunkLen]
+		case glbChunkBIN:
+			bin = data[off : off+chunkLen]
+		}
+		off += chunkLen
+	}
+	if jsonData == nil {
+		return nil, nil, errors.New("missing JSON chunk")
+	}
+
+	return jsonData, bin, nil
+}
+
+// ReadFile reads a glTF 2.0 asset from a .gltf (JSON) or .glb (binary) file
+func ReadFile(file string) (*Document, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %v: %w", file, err)
+	}
+
+	var bin []byte
+	if len(data) >= 4 && binary.LittleEndian.Uint32(data) == glbMagic {
+		if data, bin, err = parseGLB(data); err != nil {
+			return nil, fmt.Errorf("failed to parse GLB container: %w", err)
+		}
+	}
+
+	d := &Document{dir: filepath.Dir(file)}
+	if err := json.Unmarshal(data, d); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %w", err)
+	}
+	if !strings.HasPrefix(d.Asset.Version, "2.") {
+		return nil, fmt.Errorf("unsupported glTF version %q", d.Asset.Version)
+	}
+
+	d.data = make([][]byte, len(d.Buffers))
+	for i, b := range d.Buffers {
+		if b.URI == "" {
+			// The first buffer in a GLB with no URI refers to the BIN chunk
+			if i != 0 || bin == nil {
+				return nil, fmt.Errorf("buffer %v has no data", i)
+			}
+			d.data[i] = bin
+		} else if d.data[i], err = readURI(d.dir, b.URI); err != nil {
+			return nil, fmt.Errorf("failed to load buffer %v: %w", i, err)
+		}
+
+		if len(d.data[i]) < b.ByteLength {
+			return nil, fmt.Errorf("buffer %v is too short", i)
+		}
+	}
+
+	return d, nil
+}
+
+func (d *Document) bufferViewData(i int) ([]byte, int, error) {
+	if i < 0 || i >= len(d.BufferViews) {
+		return nil, 0, fmt.Errorf("invalid buffer view %v", i)
+	}
+
+	bv := d.BufferViews[i]
+	if bv.Buffer < 0 || bv.Buffer >= len(d.data) {
+		return nil, 0, fmt.Errorf("invalid buffer %v", bv.Buffer)
+	}
+	data := d.data[bv.Buffer]
+	if bv.ByteOffset+bv.ByteLength > len(data) {
+		return nil, 0, fmt.Errorf("buffer view %v out of range", i)
+	}
+
+	return data[bv.ByteOffset : bv.ByteOffset+bv.ByteLength], bv.ByteStride, nil
+}
+
+func componentSize(ct int) int {
+	switch ct {
+	case componentByte, componentUnsignedByte:
+		return 1
+	case componentShort, componentUnsignedShort:
+		return 2
+	case componentUnsignedInt, componentFloat:
+		return 4
+	}
+
+	return 0
+}
+
+// readComponent reads a single accessor component, converting it to float
+// (with normalization applied if requested)
+func readComponent(b []byte, ct int, normalized bool) float32 {
+	switch ct {
+	case componentByte:
+		v := float32(int8(b[0]))
+		if normalized {
+			return float32(math.Max(float64(v)/127, -1))
+		}
+		return v
+	case componentUnsignedByte:
+		if normalized {
+			return float32(b[0]) / 255
+		}
+		return float32(b[0])
+	case componentShort:
+		v := float32(int16(binary.LittleEndian.Uint16(b)))
+		if normalized {
+			return float32(math.Max(float64(v)/32767, -1))
+		}
+		return v
+	case componentUnsignedShort:
+		v := float32(binary.LittleEndian.Uint16(b))
+		if normalized {
+			return v / 65535
+		}
+		return v
+	case componentUnsignedInt:
+		return float32(binary.LittleEndian.Uint32(b))
+	case componentFloat:
+		return math.Float32frombits(binary.LittleEndian.Uint32(b))
+	}
+
+	return 0
+}
+
+// accessorLayout locates the components of an accessor's elements
+type accessorLayout struct {
+	accessor
+	// Components per element
+	n    int
+	size int
+	// nil if the accessor doesn't have a buffer view (all zeros)
+	data   []byte
+	stride int
+}
+
+// component returns the bytes of component c of element e
+func (l accessorLayout) component(e, c int) []byte {
+	return l.data[l.ByteOffset+e*l.stride+c*l.size:]
+}
+
+func (d *Document) accessorLayout(i int) (accessorLayout, error) {
+	if i < 0 || i >= len(d.Accessors) {
+		return accessorLayout{}, fmt.Errorf("invalid accessor %v", i)
+	}
+	l := accessorLayout{accessor: d.Accessors[i]}
+	if l.Sparse != nil {
+		return accessorLayout{}, fmt.Errorf("accessor %v: sparse accessors are not supported", i)
+	}
+
+	var ok bool
+	if l.n, ok = typeComponents[l.Type]; !ok {
+		return accessorLayout{}, fmt.Errorf("accessor %v: unknown type %v", i, l.Type)
+	}
+	if l.size = componentSize(l.ComponentType); l.size == 0 {
+		return accessorLayout{}, fmt.Errorf("accessor %v: unknown component type %v", i, l.ComponentType)
+	}
+	if l.BufferView == nil {
+		return l, nil
+	}
+
+	var err error
+	if l.data, l.stride, err = d.bufferViewData(*l.BufferView); err != nil {
+		return accessorLayout{}, fmt.Errorf("accessor %v: %w", i, err)
+	}
+	if l.stride == 0 {
+		l.stride = l.size * l.n
+	}
+	if l.Count > 0 && l.ByteOffset+(l.Count-1)*l.stride+l.size*l.n > len(l.data) {
+		return accessorLayout{}, fmt.Errorf("accessor %v out of range", i)
+	}
+
+	return l, nil
+}
+
+// readAccessor reads an accessor's elements, returning them as a flat slice
+// of floats along with the number of components per element
+func (d *Document) readAccessor(i int) ([]float32, int, error) {
+	l, err := d.accessorLayout(i)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	out := make([]float32, l.Count*l.n)
+	if l.data == nil {
+		return out, l.n, nil
+	}
+	for e := 0; e < l.Count; e++ {
+		for c := 0; c < l.n; c++ {
+			out[e*l.n+c] = readComponent(l.component(e, c), l.ComponentType, l.Normalized)
+		}
+	}
+
+	return out, l.n, nil
+}
+
+// readUints reads an integer accessor (e.g. indices or joint IDs) without
+// going through floats, which can't hold every 32-bit value
+func (d *Document) readUints(i int) ([]uint32, int, error) {
+	l, err := d.accessorLayout(i)
+	if err != nil {
+		return nil, 0, err
+	}
+	if l.ComponentType != componentUnsignedByte && l.ComponentType != componentUnsignedShort &&
+		l.ComponentType != componentUnsignedInt {
+		return nil, 0, fmt.Errorf("accessor %v: expected unsigned integer components", i)
+	}
+
+	out := make([]uint32, l.Count*l.n)
+	if l.data == nil {
+		return out, l.n, nil
+	}
+	for e := 0; e < l.Count; e++ {
+		for c := 0; c < l.n; c++ {
+			b := l.component(e, c)
+			switch l.ComponentType {
+			case componentUnsignedByte:
+				out[e*l.n+c] = uint32(b[0])
+			case componentUnsignedShort:
+				out[e*l.n+c] = uint32(binary.LittleEndian.Uint16(b))
+			case componentUnsignedInt:
+				out[e*l.n+c] = binary.LittleEndian.Uint32(b)
+			}
+		}
+	}
+
+	return out, l.n, nil
+}
+
+func (d *Document) imageData(i int) ([]byte, error) {
+	if i < 0 || i >= len(d.Images) {
+		return nil, fmt.Errorf("invalid image %v", i)
+	}
+
+	img := d.Images[i]
+	if img.BufferView != nil {
+		data, _, err := d.bufferViewData(*img.BufferView)
+		return data, err
+	}
+
+	return readURI(d.dir, img.URI)
+}
+
+// rootNodes returns the root nodes of the default scene (or all parentless
+// nodes if the asset doesn't define any scenes)
+func (d *Document) rootNodes() []int {
+	if len(d.Scenes) > 0 {
+		s := 0
+		if d.Scene != nil && *d.Scene < len(d.Scenes) {
+			s = *d.Scene
+		}
+
+		return d.Scenes[s].Nodes
+	}
+
+	hasParent := make([]bool, len(d.Nodes))
+	for _, n := range d.Nodes {
+		for _, c := range n.Children {
+			if c >= 0 && c < len(hasParent) {
+				hasParent[c] = true
+			}
+		}
+	}
+
+	var roots []int
+	for i, p := range hasParent {
+		if !p {
+			roots = append(roots, i)
+		}
+	}
+
+	return roots
+}
+
+func isPNG(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n"))
+}
@@ -0,0 +1,36 @@
+package gltf
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestReadUints(t *testing.T) {
+	// Too large to be represented exactly as a float32
+	values := []uint32{0, 1<<24 + 1, 0xffffffff}
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(data[i*4:], v)
+	}
+
+	view := 0
+	d := &Document{
+		BufferViews: []bufferView{{ByteLength: len(data)}},
+		Accessors: []accessor{{
+			BufferView:    &view,
+			ComponentType: componentUnsignedInt,
+			Count:         len(values),
+			Type:          "SCALAR",
+		}},
+		data: [][]byte{data},
+	}
+
+	got, n, err := d.readUints(0)
+	if err != nil {
+		t.Fatalf("failed to read accessor: %v", err)
+	}
+	if n != 1 || !reflect.DeepEqual(got, values) {
+		t.Errorf("got %v (%v components), expected %v", got, n, values)
+	}
+}
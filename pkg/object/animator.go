@@ -0,0 +1,219 @@
+package object
+
+import "fmt"
+
+// ConditionOp is a comparison used by a transition condition
+type ConditionOp int
+
+const (
+	// OpGreater passes if the parameter is greater than the value
+	OpGreater ConditionOp = iota
+	// OpLess passes if the parameter is less than the value
+	OpLess
+	// OpEqual passes if the parameter is equal to the value
+	OpEqual
+	// OpNotEqual passes if the parameter is not equal to the value
+	OpNotEqual
+	// OpTrigger passes if the named trigger has been set (it is consumed when
+	// the transition is taken)
+	OpTrigger
+)
+
+// TransitionCondition compares one of an animator's parameters to a value
+type TransitionCondition struct {
+	Param string
+	Op    ConditionOp
+	Value float32
+}
+
+// AnimationTransition moves an animator from one state to another
+type AnimationTransition struct {
+	To string
+	// Duration of the crossfade in seconds
+	Duration float32
+	// Conditions must all pass for the transition to be taken
+	Conditions []TransitionCondition
+	// OnFinish only allows the transition once the state's animation has
+	// played through at least once
+	OnFinish bool
+}
+
+// AnimationState is a state in an animation state machine, bound to an
+// animation
+type AnimationState struct {
+	Name      string
+	Animation *Animation
+	Playback  Playback
+
+	// Transitions are checked in order, the first which passes is taken
+	Transitions []AnimationTransition
+}
+
+// AnimationStateMachine is a set of animation states and the transitions
+// between them, which can be shared by any number of animators
+type AnimationStateMachine struct {
+	Initial string
+	States  map[string]*AnimationState
+}
+
+// NewAnimationStateMachine creates a new state machine, starting in the
+// initial state
+func NewAnimationStateMachine(initial string, states ...*AnimationState) (*AnimationStateMachine, error) {
+	m := &AnimationStateMachine{
+		Initial: initial,
+		States:  make(map[string]*AnimationState, len(states)),
+	}
+	for _, s := range states {
+		if _, ok := m.States[s.Name]; ok {
+			return nil, fmt.Errorf("duplicate state %q", s.Name)
+		}
+
+		m.States[s.Name] = s
+	}
+
+	if _, ok := m.States[initial]; !ok {
+		return nil, fmt.Errorf("unknown initial state %q", initial)
+	}
+	for _, s := range states {
+		for _, tr := range s.Transitions {
+			if _, ok := m.States[tr.To]; !ok {
+				return nil, fmt.Errorf("state %q: transition to unknown state %q", s.Name, tr.To)
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// Animator plays animations for a single instance of an object according to
+// a state machine
+type Animator struct {
+	machine *AnimationStateMachine
+	fade    *Crossfade
+
+	current *AnimationState
+	entered float32
+
+	params   map[string]float32
+	triggers map[string]bool
+}
+
+// NewAnimator creates an animator which enters the state machine's initial
+// state at time t
+func NewAnimator(m *AnimationStateMachine, t float32) *Animator {
+	a := &Animator{
+		machine: m,
+		fade:    NewCrossfade(nil, t),
+
+		params:   make(map[string]float32),
+		triggers: make(map[string]bool),
+	}
+	a.enter(m.States[m.Initial], 0, t)
+
+	return a
+}
+
+func (a *Animator) enter(s *AnimationState, duration, t float32) {
+	a.current = s
+	a.entered = t
+	a.fade.PlayWith(s.Animation, s.Playback, duration, t)
+}
+
+// State returns the current state
+func (a *Animator) State() *AnimationState {
+	return a.current
+}
+
+// SetFloat sets a parameter
+func (a *Animator) SetFloat(name string, v float32) {
+	a.params[name] = v
+}
+
+// Float returns the value of a parameter
+func (a *Animator) Float(name string) float32 {
+	return a.params[name]
+}
+
+// SetBool sets a parameter to 1 (true) or 0 (false)
+func (a *Animator) SetBool(name string, v bool) {
+	if v {
+		a.params[name] = 1
+	} else {
+		a.params[name] = 0
+	}
+}
+
+// SetTrigger sets a trigger, which stays set until a transition uses it
+func (a *Animator) SetTrigger(name string) {
+	a.triggers[name] = true
+}
+
+// ResetTrigger clears a trigger
+func (a *Animator) ResetTrigger(name string) {
+	delete(a.triggers, name)
+}
+
+// Finished returns true if the current state's animation has played through
+// at least once by time t
+func (a *Animator) Finished(t float32) bool {
+	anim := a.current.Animation
+	if anim == nil {
+		return true
+	}
+
+	speed := a.current.Playback.Speed
+	if speed == 0 {
+		speed = 1
+	}
+	return (t-a.entered)*speed >= anim.Length()
+}
+
+func (a *Animator) passes(tr AnimationTransition, t float32) bool {
+	if tr.OnFinish && !a.Finished(t) {
+		return false
+	}
+
+	for _, c := range tr.Conditions {
+		v := a.params[c.Param]
+
+		var ok bool
+		switch c.Op {
+		case OpGreater:
+			ok = v > c.Value
+		case OpLess:
+			ok = v < c.Value
+		case OpEqual:
+			ok = v == c.Value
+		case OpNotEqual:
+			ok = v != c.Value
+		case OpTrigger:
+			ok = a.triggers[c.Param]
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Update takes the first passing transition from the current state (if any)
+// and returns the weighted animations to pass to Object.UpdateBlend at time t
+func (a *Animator) Update(t float32) []AnimationLayer {
+	for _, tr := range a.current.Transitions {
+		if !a.passes(tr, t) {
+			continue
+		}
+
+		for _, c := range tr.Conditions {
+			if c.Op == OpTrigger {
+				delete(a.triggers, c.Param)
+			}
+		}
+
+		a.enter(a.machine.States[tr.To], tr.Duration, t)
+		break
+	}
+
+	return a.fade.Layers(t)
+}
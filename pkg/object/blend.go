@@ -0,0 +1,164 @@
+package object
+
+import "github.com/go-gl/mathgl/mgl32"
+
+// AnimationLayer is a single animation contributing to a blended pose
+type AnimationLayer struct {
+	Animation *Animation
+	// Time is the playback position in seconds since the animation started,
+	// which shouldn't be wrapped (it's looped or clamped to the animation's
+	// duration when evaluated, depending on Once)
+	Time float32
+	// PrevTime is the playback position at the previous update, events
+	// between it and Time are reported
+	PrevTime float32
+	// First is set for the layer's first update, so that events at PrevTime
+	// (e.g. at the start of the animation) are reported too
+	First bool
+	// Weight is the layer's contribution relative to the other layers
+	Weight float32
+	// Once holds the final frame instead of looping
+	Once bool
+}
+
+// Playback controls how an animation is played
+type Playback struct {
+	// Speed multiplies the animation's playback rate (0 is treated as 1)
+	Speed float32
+	// Once plays the animation a single time, holding the final frame
+	Once bool
+}
+
+type fadeLayer struct {
+	anim     *Animation
+	playback Playback
+	// Time at which the animation started playing
+	start float32
+	// Weight at the point the current transition began
+	from float32
+	// Whether the layer has been returned by Layers yet
+	started bool
+}
+
+// Crossfade manages timed transitions between animations, blending the
+// outgoing animations out as the new one is blended in
+type Crossfade struct {
+	// The last layer is the one being faded in
+	layers []fadeLayer
+
+	fadeStart    float32
+	fadeDuration float32
+
+	// Time Layers was last called at
+	last float32
+}
+
+// NewCrossfade creates a new crossfade which starts out playing anim (which
+// may be nil) at time t
+func NewCrossfade(anim *Animation, t float32) *Crossfade {
+	c := &Crossfade{last: t}
+	if anim != nil {
+		c.layers = []fadeLayer{{anim: anim, start: t, from: 1}}
+	}
+
+	return c
+}
+
+// Current returns the animation being faded to
+func (c *Crossfade) Current() *Animation {
+	if len(c.layers) == 0 {
+		return nil
+	}
+
+	return c.layers[len(c.layers)-1].anim
+}
+
+func (c *Crossfade) progress(t float32) float32 {
+	if c.fadeDuration <= 0 {
+		return 1
+	}
+
+	return mgl32.Clamp((t-c.fadeStart)/c.fadeDuration, 0, 1)
+}
+
+func (c *Crossfade) weight(i int, f float32) float32 {
+	l := c.layers[i]
+	if i == len(c.layers)-1 {
+		return l.from + (1-l.from)*f
+	}
+
+	return l.from * (1 - f)
+}
+
+// Play starts a transition to anim (or the rest pose if nil) at time t lasting
+// duration seconds. If anim is still playing from a previous transition it
+// carries on from where it is, otherwise it starts from the beginning.
+func (c *Crossfade) Play(anim *Animation, duration, t float32) {
+	c.PlayWith(anim, Playback{}, duration, t)
+}
+
+// PlayWith is like Play, but with control over playback. A looping animation
+// which is still playing carries on from where it is, but one played once
+// always restarts.
+func (c *Crossfade) PlayWith(anim *Animation, p Playback, duration, t float32) {
+	f := c.progress(t)
+
+	layers := make([]fadeLayer, 0, len(c.layers)+1)
+	target := fadeLayer{anim: anim, playback: p, start: t}
+	for i, l := range c.layers {
+		l.from = c.weight(i, f)
+		if l.anim == anim && !p.Once && !l.playback.Once {
+			target.start, target.from, target.started = l.start, l.from, l.started
+			continue
+		}
+		if l.from <= 0 {
+			continue
+		}
+
+		layers = append(layers, l)
+	}
+	c.layers = append(layers, target)
+	c.fadeStart = t
+	c.fadeDuration = duration
+}
+
+// Layers returns the weighted animations that make up the blend at time t,
+// suitable for passing to Object.UpdateBlend
+func (c *Crossfade) Layers(t float32) []AnimationLayer {
+	f := c.progress(t)
+	if f == 1 && len(c.layers) > 1 {
+		// Transition finished, outgoing animations no longer contribute
+		c.layers = c.layers[len(c.layers)-1:]
+		c.layers[0].from = 1
+	}
+
+	layers := make([]AnimationLayer, 0, len(c.layers))
+	for i, l := range c.layers {
+		w := c.weight(i, f)
+		if w <= 0 {
+			continue
+		}
+
+		speed := l.playback.Speed
+		if speed == 0 {
+			speed = 1
+		}
+		prev := c.last
+		if prev < l.start {
+			prev = l.start
+		}
+
+		layers = append(layers, AnimationLayer{
+			Animation: l.anim,
+			Time:      (t - l.start) * speed,
+			PrevTime:  (prev - l.start) * speed,
+			First:     !l.started,
+			Weight:    w,
+			Once:      l.playback.Once,
+		})
+		c.layers[i].started = true
+	}
+	c.last = t
+
+	return layers
+}
@@ -2,6 +2,9 @@ package object
 
 import (
 	"math/rand"
+	"runtime"
+	"sync"
+	"time"
 
 	"github.com/devplayer0/cs4052/pkg/util"
 	"github.com/go-gl/mathgl/mgl32"
@@ -13,6 +16,32 @@ type Boid struct {
 
 	Velocity     mgl32.Vec3
 	Acceleration mgl32.Vec3
+
+	// Offset of the point the wander behaviour is steering towards
+	wander mgl32.Vec3
+	// The set of boids this one belongs to
+	species *Boids
+	// State of the random number generator used by behaviours
+	rng uint64
+
+	// Neighbours found at the start of the current step
+	nearby []neighbour
+	// Velocity and position calculated for the end of the current step, which
+	// aren't applied until every boid has been updated
+	nextVelocity mgl32.Vec3
+	nextPosition mgl32.Vec3
+}
+
+// random returns a random number in [0, 1) from the boid's own generator
+// (SplitMix64), so that the order boids are updated in doesn't matter
+func (b *Boid) random() float32 {
+	b.rng += 0x9e3779b97f4a7c15
+	z := b.rng
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z ^= z >> 31
+
+	return float32(z>>40) / (1 << 24)
 }
 
 // Distance finds the distance between two boids
@@ -21,17 +50,18 @@ func (b *Boid) Distance(ob *Boid) float32 {
 }
 
 // Cohesion applies the cohesion rule, where a boid tries to steer towards the
-// centre of mass for the local flock (other boids within a certain distance)
+// centre of mass for the local flock (other boids of the same species within a
+// certain distance)
 // This is basically the average of position
 func (b *Boid) Cohesion(bs *Boids) {
 	n := 0
 	var perceivedCOM mgl32.Vec3
-	for _, ob := range bs.Instances {
-		if ob == b || b.Distance(ob) > bs.Perception {
+	for _, nb := range b.nearby {
+		if nb.boid.species != bs || nb.distance > bs.Perception {
 			continue
 		}
 
-		perceivedCOM = perceivedCOM.Add(ob.Position)
+		perceivedCOM = perceivedCOM.Add(nb.boid.Position)
 		n++
 	}
 	if n == 0 {
@@ -50,14 +80,12 @@ func (b *Boid) Cohesion(bs *Boids) {
 func (b *Boid) Separation(bs *Boids) {
 	n := 0
 	var avg mgl32.Vec3
-	for _, ob := range bs.Instances {
-		diff := ob.Position.Sub(b.Position)
-		distance := diff.Len()
-		if ob == b || distance > bs.SeparationDistance {
+	for _, nb := range b.nearby {
+		if !bs.separates(nb.boid.species) || nb.distance == 0 || nb.distance > bs.SeparationDistance {
 			continue
 		}
 
-		avg = avg.Sub(diff.Mul(1 / distance))
+		avg = avg.Sub(nb.diff.Mul(1 / nb.distance))
 		n++
 	}
 	if n == 0 {
@@ -70,17 +98,18 @@ func (b *Boid) Separation(bs *Boids) {
 }
 
 // Alignment applies the alignment rule, where a boid tries to steer its
-// velocity to match others within a certain distance (the "local flock")
+// velocity to match others of the same species within a certain distance (the
+// "local flock")
 // This is basically the average of velocity
 func (b *Boid) Alignment(bs *Boids) {
 	n := 0
 	var perceivedV mgl32.Vec3
-	for _, ob := range bs.Instances {
-		if ob == b || b.Distance(ob) > bs.Perception {
+	for _, nb := range b.nearby {
+		if nb.boid.species != bs || nb.distance > bs.Perception {
 			continue
 		}
 
-		perceivedV = perceivedV.Add(ob.Velocity)
+		perceivedV = perceivedV.Add(nb.boid.Velocity)
 		n++
 	}
 	if n == 0 {
@@ -94,44 +123,93 @@ func (b *Boid) Alignment(bs *Boids) {
 	b.Acceleration = b.Acceleration.Add(alignment)
 }
 
-// Edges makes sure the boids can't leave their bounds by applying an opposing
-// force if they are at the edge
+// Edges makes sure the boids can't leave their bounds by turning them back if
+// they are at the edge (by changing the velocity for the end of the step)
 func (b *Boid) Edges(bs *Boids) {
 	if b.Position.X() > bs.Bounds.Max.X() {
-		b.Velocity[0] = -bs.RepelForce
+		b.nextVelocity[0] = -bs.EdgeSpeed
 	} else if b.Position.X() < bs.Bounds.Min.X() {
-		b.Velocity[0] = bs.RepelForce
+		b.nextVelocity[0] = bs.EdgeSpeed
 	}
 	if b.Position.Y() > bs.Bounds.Max.Y() {
-		b.Velocity[1] = -bs.MaxSpeed
+		b.nextVelocity[1] = -bs.MaxSpeed
 	} else if b.Position.Y() < bs.Bounds.Min.Y() {
-		b.Velocity[1] = bs.RepelForce
+		b.nextVelocity[1] = bs.EdgeSpeed
 	}
 	if b.Position.Z() > bs.Bounds.Max.Z() {
-		b.Velocity[2] = -bs.RepelForce
+		b.nextVelocity[2] = -bs.EdgeSpeed
 	} else if b.Position.Z() < bs.Bounds.Min.Z() {
-		b.Velocity[2] = bs.RepelForce
+		b.nextVelocity[2] = bs.EdgeSpeed
+	}
+}
+
+// Steer applies each of the flock's steering behaviours
+func (b *Boid) Steer(bs *Boids) {
+	for _, wb := range bs.Behaviours {
+		steer := limit(wb.Behaviour.Steer(b, bs), bs.MaxForce)
+		b.Acceleration = b.Acceleration.Add(steer.Mul(wb.Weight))
 	}
 }
 
-// LimitSpeed ensures a boid's velocity never exceeds a maximum value
+// LimitSpeed ensures a boid's velocity (for the end of the step) never exceeds
+// a maximum value
 func (b *Boid) LimitSpeed(bs *Boids) {
-	if b.Velocity.Len() > bs.MaxSpeed {
-		b.Velocity = b.Velocity.Normalize().Mul(bs.MaxSpeed)
+	if b.nextVelocity.Len() > bs.MaxSpeed {
+		b.nextVelocity = b.nextVelocity.Normalize().Mul(bs.MaxSpeed)
 	}
 }
 
-// Boids manages a set of boids
+// DefaultBoidStep is the default fixed time step boids are simulated with
+const DefaultBoidStep = 1.0 / 60
+
+// maxBoidSteps limits how many steps a single update can simulate, so that a
+// long frame doesn't cause an even longer one
+const maxBoidSteps = 8
+
+// minBoidChunk is the smallest number of boids worth updating in a separate
+// goroutine
+const minBoidChunk = 256
+
+// Boids manages a set of boids. Distances are in world units and times are in
+// seconds (so speeds are per second and forces are accelerations per second
+// squared).
 type Boids struct {
-	Bounds             util.Bounds
-	MaxSpeed           float32
-	RepelForce         float32
+	Bounds   util.Bounds
+	MaxSpeed float32
+	// RepelForce is the magnitude of the separation acceleration
+	RepelForce float32
+	// EdgeSpeed is the speed at which boids outside the bounds are turned back
+	EdgeSpeed          float32
 	Perception         float32
 	CohesionFactor     float32
 	AlignmentFactor    float32
 	SeparationDistance float32
 
+	// Behaviours are additional steering behaviours applied after the rules
+	Behaviours []WeightedBehaviour
+	// Relations describe how boids react to other species in the same
+	// simulation
+	Relations []SpeciesRelation
+	// MaxForce limits the acceleration from each behaviour
+	MaxForce float32
+
+	// Step is the fixed time step the simulation advances by
+	Step float32
+	// Workers is the maximum number of goroutines to update boids with (0 to
+	// use GOMAXPROCS). The results don't depend on the number.
+	Workers int
+
 	Instances []*Boid
+
+	rng *rand.Rand
+	// Time not yet simulated
+	accumulator float32
+	// Length of the current step
+	dt float32
+
+	grid *spatialGrid
+	// Neighbour buffers for each worker
+	scratch [][]neighbour
 }
 
 // NewBoids creates a new boids manager
@@ -140,44 +218,178 @@ func NewBoids(bounds util.Bounds, maxSpeed float32) *Boids {
 		Bounds:             bounds,
 		MaxSpeed:           maxSpeed,
 		Perception:         6,
-		RepelForce:         0.0001,
-		CohesionFactor:     0.000004,
-		AlignmentFactor:    0.0001,
+		RepelForce:         0.36,
+		EdgeSpeed:          0.006,
+		CohesionFactor:     0.0144,
+		AlignmentFactor:    0.006,
 		SeparationDistance: 2,
+		MaxForce:           1,
+
+		Step: DefaultBoidStep,
+
+		rng:  rand.New(rand.NewSource(time.Now().UnixNano())),
+		grid: &spatialGrid{},
 	}
 
 	return b
 }
 
+// Seed seeds the random number generator used to create boids, making the
+// simulation reproducible
+func (bs *Boids) Seed(seed int64) {
+	bs.rng.Seed(seed)
+}
+
+// Rand returns the (seeded) random number generator used to create boids, for
+// anything else which should be reproducible along with the simulation
+func (bs *Boids) Rand() *rand.Rand {
+	return bs.rng
+}
+
+func (bs *Boids) randVec3() mgl32.Vec3 {
+	return mgl32.Vec3{bs.rng.Float32(), bs.rng.Float32(), bs.rng.Float32()}
+}
+
 // MakeBoid creates a new boid with a random position (within the bounds) and
 // a random velocity
 func (bs *Boids) MakeBoid() *Boid {
 	hi := bs.Bounds.Max.Sub(bs.Bounds.Min)
-	hi[0] *= rand.Float32()
-	hi[1] *= rand.Float32()
-	hi[2] *= rand.Float32()
+	r := bs.randVec3()
+	hi[0] *= r[0]
+	hi[1] *= r[1]
+	hi[2] *= r[2]
 
 	b := &Boid{
-		Velocity: util.RandVec3().Mul(-2 * bs.MaxSpeed).Add(mgl32.Vec3{bs.MaxSpeed, bs.MaxSpeed, bs.MaxSpeed}),
+		Velocity: bs.randVec3().Mul(-2 * bs.MaxSpeed).Add(mgl32.Vec3{bs.MaxSpeed, bs.MaxSpeed, bs.MaxSpeed}),
 		Position: hi.Add(bs.Bounds.Min),
+
+		species: bs,
+		rng:     bs.rng.Uint64(),
 	}
 
 	return b
 }
 
-// Update applies each of the rules to each boid and updates the current
-// velocity / position
-func (bs *Boids) Update() {
+// radius returns the largest distance any of the rules look for neighbours
+func (bs *Boids) radius() float32 {
+	r := bs.Perception
+	if bs.SeparationDistance > r {
+		r = bs.SeparationDistance
+	}
+	if r <= 0 {
+		// Grid cells must have a size
+		r = 1
+	}
+
+	return r
+}
+
+// fixedSteps adds dt to the accumulator and calls step for each fixed step of
+// time accumulated (any remainder is carried over)
+func fixedSteps(accumulator *float32, dt, stepSize float32, step func()) {
+	*accumulator += dt
+
+	steps := 0
+	for *accumulator >= stepSize {
+		*accumulator -= stepSize
+		if steps == maxBoidSteps {
+			// Drop the time we can't catch up on
+			*accumulator = util.Mod(*accumulator, stepSize)
+			break
+		}
+
+		step()
+		steps++
+	}
+}
+
+// Update advances the simulation by dt seconds in fixed steps (any remainder
+// is carried over to the next update). Boids which are part of a
+// BoidSimulation should be updated through it instead.
+func (bs *Boids) Update(dt float32) {
+	fixedSteps(&bs.accumulator, dt, bs.Step, func() {
+		bs.claim()
+		bs.grid.rebuild(bs.Instances, bs.radius())
+		bs.step(bs.Step, bs.Workers)
+		bs.commit()
+	})
+}
+
+// claim marks each of the boids as belonging to this set (for boids which
+// weren't created by MakeBoid)
+func (bs *Boids) claim() {
 	for _, b := range bs.Instances {
-		b.Cohesion(bs)
-		b.Separation(bs)
-		b.Alignment(bs)
-		b.Edges(bs)
+		b.species = bs
+	}
+}
+
+// update applies each of the rules to a boid and calculates its velocity /
+// position after dt seconds
+func (bs *Boids) update(b *Boid, dt float32) {
+	b.Cohesion(bs)
+	b.Separation(bs)
+	b.Alignment(bs)
+	b.Interact(bs)
+	b.Steer(bs)
+
+	b.nextVelocity = b.Velocity
+	b.Edges(bs)
+	b.nextVelocity = b.nextVelocity.Add(b.Acceleration.Mul(dt))
+	b.LimitSpeed(bs)
+	b.Acceleration = mgl32.Vec3{}
+
+	b.nextPosition = b.Position.Add(b.nextVelocity.Mul(dt))
+}
+
+// step updates each boid by dt seconds in chunks across up to workers
+// goroutines (the grid must have been rebuilt). Boids only see the state of
+// others from the start of the step, so the results don't depend on the
+// order they're updated in.
+func (bs *Boids) step(dt float32, workers int) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if max := (len(bs.Instances) + minBoidChunk - 1) / minBoidChunk; workers > max {
+		workers = max
+	}
+	if workers == 0 {
+		return
+	}
+	for len(bs.scratch) < workers {
+		bs.scratch = append(bs.scratch, nil)
+	}
 
-		b.Velocity = b.Velocity.Add(b.Acceleration)
-		b.LimitSpeed(bs)
-		b.Acceleration = mgl32.Vec3{}
+	chunk := (len(bs.Instances) + workers - 1) / workers
+	radius := bs.radius()
+	bs.dt = dt
 
-		b.Position = b.Position.Add(b.Velocity)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		start := w * chunk
+		end := start + chunk
+		if end > len(bs.Instances) {
+			end = len(bs.Instances)
+		}
+
+		wg.Add(1)
+		go func(w int, boids []*Boid) {
+			defer wg.Done()
+
+			for _, b := range boids {
+				bs.scratch[w] = bs.grid.gather(b, radius, bs.scratch[w][:0])
+				b.nearby = bs.scratch[w]
+				bs.update(b, dt)
+				b.nearby = nil
+			}
+		}(w, bs.Instances[start:end])
+	}
+	wg.Wait()
+}
+
+// commit applies the velocities / positions calculated by step
+func (bs *Boids) commit() {
+	for _, b := range bs.Instances {
+		b.Velocity = b.nextVelocity
+		b.Position = b.nextPosition
 	}
 }
@@ -0,0 +1,181 @@
+package object
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+
+	"github.com/devplayer0/cs4052/pkg/util"
+)
+
+// testBoidDensity is the number of boids per unit volume (the bounds grow
+// with the number of boids)
+const testBoidDensity = 0.05
+
+// newTestBoids creates n seeded boids in a cube sized for testBoidDensity
+func newTestBoids(n int, seed int64) *Boids {
+	side := float32(math.Cbrt(float64(n) / testBoidDensity))
+	bs := NewBoids(util.Bounds{
+		Min: mgl32.Vec3{-side / 2, -side / 2, -side / 2},
+		Max: mgl32.Vec3{side / 2, side / 2, side / 2},
+	}, 1.2)
+	bs.Seed(seed)
+	bs.Behaviours = []WeightedBehaviour{
+		{Behaviour: &Wander{Radius: 1, Distance: 2, Jitter: 4}, Weight: 1},
+	}
+	for i := 0; i < n; i++ {
+		bs.Instances = append(bs.Instances, bs.MakeBoid())
+	}
+
+	return bs
+}
+
+func checkSameBoids(t *testing.T, a, b *Boids) {
+	t.Helper()
+
+	if len(a.Instances) != len(b.Instances) {
+		t.Fatalf("got %v boids, expected %v", len(b.Instances), len(a.Instances))
+	}
+	for i := range a.Instances {
+		ba, bb := a.Instances[i], b.Instances[i]
+		if ba.Position != bb.Position || ba.Velocity != bb.Velocity {
+			t.Fatalf("boid %v differs: %v / %v, expected %v / %v", i, bb.Position, bb.Velocity, ba.Position, ba.Velocity)
+		}
+	}
+}
+
+const (
+	testBoidCount = 2000
+	testBoidSeed  = 42
+	testSteps     = 60
+)
+
+func TestBoidsWorkersReproducible(t *testing.T) {
+	// Enough workers to split the boids into chunks even on a single CPU
+	workers := runtime.GOMAXPROCS(0)
+	if workers < 4 {
+		workers = 4
+	}
+
+	single := newTestBoids(testBoidCount, testBoidSeed)
+	single.Workers = 1
+	parallel := newTestBoids(testBoidCount, testBoidSeed)
+	parallel.Workers = workers
+
+	for i := 0; i < testSteps; i++ {
+		single.Update(single.Step)
+		parallel.Update(parallel.Step)
+	}
+
+	checkSameBoids(t, single, parallel)
+}
+
+func TestBoidSimulationMatchesBoids(t *testing.T) {
+	bs := newTestBoids(testBoidCount, testBoidSeed)
+	simulated := newTestBoids(testBoidCount, testBoidSeed)
+	s := NewBoidSimulation(simulated)
+
+	for i := 0; i < testSteps; i++ {
+		bs.Update(bs.Step)
+		s.Update(s.Step)
+	}
+
+	checkSameBoids(t, bs, simulated)
+}
+
+// bruteForceGather finds the neighbours of b by checking every boid
+func bruteForceGather(boids []*Boid, b *Boid, radius float32) []*Boid {
+	var ns []*Boid
+	for _, o := range boids {
+		if o == b {
+			continue
+		}
+		if diff := o.Position.Sub(b.Position); diff.Dot(diff) <= radius*radius {
+			ns = append(ns, o)
+		}
+	}
+
+	return ns
+}
+
+func TestGridGatherMatchesBruteForce(t *testing.T) {
+	bs := newTestBoids(testBoidCount, testBoidSeed)
+	// Some boids outside the bounds and exactly on cell edges
+	bs.Instances[0].Position = bs.Bounds.Max.Mul(3)
+	bs.Instances[1].Position = mgl32.Vec3{0, 0, 0}
+	bs.Instances[2].Position = mgl32.Vec3{bs.radius(), 0, 0}
+
+	for _, radius := range []float32{bs.radius(), bs.radius() / 2, bs.radius() * 3} {
+		g := &spatialGrid{}
+		g.rebuild(bs.Instances, bs.radius())
+
+		for i, b := range bs.Instances {
+			expected := make(map[*Boid]bool)
+			for _, o := range bruteForceGather(bs.Instances, b, radius) {
+				expected[o] = true
+			}
+
+			// gather doesn't return boids in any particular order
+			got := g.gather(b, radius, nil)
+			seen := make(map[*Boid]bool, len(got))
+			for _, n := range got {
+				if !expected[n.boid] || seen[n.boid] {
+					t.Fatalf("radius %v, boid %v: unexpected neighbour %v", radius, i, n.boid.Position)
+				}
+				seen[n.boid] = true
+			}
+			if len(seen) != len(expected) {
+				t.Fatalf("radius %v, boid %v: got %v neighbours, expected %v", radius, i, len(seen), len(expected))
+			}
+		}
+	}
+}
+
+func BenchmarkBoidsUpdate(b *testing.B) {
+	for _, n := range []int{1000, 10000, 50000} {
+		b.Run(fmt.Sprintf("%v", n), func(b *testing.B) {
+			bs := newTestBoids(n, 1)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				bs.Update(bs.Step)
+			}
+		})
+	}
+}
+
+func TestBoidsFrameRateIndependent(t *testing.T) {
+	// A power of two, so that fractions of a step add up exactly
+	const step = 1.0 / 64
+
+	newBoids := func() *Boids {
+		bs := newTestBoids(testBoidCount/4, testBoidSeed)
+		bs.Step = step
+		return bs
+	}
+	reference := newBoids()
+	reference.Update(step)
+	reference.Update(step)
+
+	t.Run("double step", func(t *testing.T) {
+		bs := newBoids()
+		bs.Update(2 * step)
+		checkSameBoids(t, reference, bs)
+	})
+	t.Run("remainder", func(t *testing.T) {
+		once := newBoids()
+		once.Update(step)
+
+		// The remaining half step shouldn't be simulated until it adds up to
+		// a whole one
+		bs := newBoids()
+		bs.Update(1.5 * step)
+		checkSameBoids(t, once, bs)
+
+		bs.Update(0.5 * step)
+		checkSameBoids(t, reference, bs)
+	})
+}
@@ -0,0 +1,85 @@
+package object
+
+import (
+	"github.com/go-gl/gl/v4.6-core/gl"
+	"github.com/go-gl/mathgl/mgl32"
+
+	"github.com/devplayer0/cs4052/pkg/util"
+)
+
+// Shader storage buffer binding points used by the instanced skinned mesh
+// shader
+const (
+	instanceModelsBinding = 0
+	instanceJointsBinding = 1
+)
+
+// Crowd draws many instances of an object, each with its own transform and
+// pose, using a single instanced draw call per mesh
+type Crowd struct {
+	object *Object
+	shader *util.Program
+
+	models   []mgl32.Mat4
+	palettes []mgl32.Mat4
+
+	modelBuffer *util.Buffer
+	jointBuffer *util.Buffer
+}
+
+// NewCrowd creates a crowd of an object (which must have been uploaded with a
+// compatible non-instanced shader), drawn with an instanced shader
+func NewCrowd(o *Object, shader *util.Program) *Crowd {
+	return &Crowd{
+		object: o,
+		shader: shader,
+
+		modelBuffer: util.NewBuffer(gl.SHADER_STORAGE_BUFFER),
+		jointBuffer: util.NewBuffer(gl.SHADER_STORAGE_BUFFER),
+	}
+}
+
+// Len returns the number of instances in the crowd
+func (c *Crowd) Len() int {
+	return len(c.models)
+}
+
+// Reset removes all instances (to be called before re-adding them each frame)
+func (c *Crowd) Reset() {
+	c.models = c.models[:0]
+	c.palettes = c.palettes[:0]
+}
+
+// Add adds an instance at trans using the object's current joint transforms
+// (i.e. after calling Update / UpdateBlend with the same transform)
+func (c *Crowd) Add(trans mgl32.Mat4) {
+	c.models = append(c.models, trans)
+	c.palettes = append(c.palettes, c.object.currentTransforms[:c.object.jointCount]...)
+}
+
+// AddPose adds an instance with a pose evaluated by Object.Evaluate (at the
+// transform it was evaluated at)
+func (c *Crowd) AddPose(p *Pose) {
+	c.models = append(c.models, p.trans)
+	c.palettes = append(c.palettes, p.joints[:c.object.jointCount]...)
+}
+
+// Draw uploads the instances and draws the crowd
+func (c *Crowd) Draw(proj mgl32.Mat4, cam *util.Camera, envMap, depthMaps *util.Texture) {
+	if len(c.models) == 0 {
+		return
+	}
+
+	c.modelBuffer.SetMat4(c.models)
+	c.modelBuffer.BindBase(instanceModelsBinding)
+	c.jointBuffer.SetMat4(c.palettes)
+	c.jointBuffer.BindBase(instanceJointsBinding)
+
+	c.shader.Use()
+	c.shader.SetUniformInt("joint_count", int32(c.object.jointCount))
+	for _, in := range c.object.instances {
+		c.shader.SetUniformMat4("mesh_transform", in.Transform)
+		c.shader.SetUniformMat4("inv_mesh_transform", in.InvTransform)
+		in.Mesh.DrawInstanced(c.shader, proj, cam, len(c.models), envMap, depthMaps)
+	}
+}
@@ -0,0 +1,73 @@
+package object
+
+// AnimationEvent is a named point in an animation (e.g. a footstep), used to
+// synchronise sounds, effects etc. with the animation
+type AnimationEvent struct {
+	Name string
+	// Time in ticks
+	Time float32
+}
+
+// TriggeredEvent is an animation event which was crossed during an update
+type TriggeredEvent struct {
+	Animation *Animation
+	Name      string
+	// Weight of the layer the animation was playing in
+	Weight float32
+}
+
+// eventsBetween calls cb for each event after from (or at it, if first is
+// set) and up to (and including) to, both in seconds. Looping animations report
+// events across the end of the animation, but never more than once per update.
+func (a *Animation) eventsBetween(from, to float32, once, first bool, cb func(e AnimationEvent)) {
+	if len(a.Events) == 0 || to < from || (to == from && !first) {
+		return
+	}
+
+	after := func(t, lo float32) bool {
+		return t > lo || (first && t == lo)
+	}
+
+	report := func(match func(t float32) bool) {
+		for _, e := range a.Events {
+			if match(e.Time) {
+				cb(e)
+			}
+		}
+	}
+
+	if (to-from)*a.TPS >= a.Duration && !once {
+		report(func(t float32) bool { return true })
+		return
+	}
+
+	lo, hi := a.ticks(from, once), a.ticks(to, once)
+	if hi >= lo {
+		report(func(t float32) bool { return after(t, lo) && t <= hi })
+		return
+	}
+
+	// Wrapped around the end of the animation
+	report(func(t float32) bool { return after(t, lo) })
+	report(func(t float32) bool { return t <= hi })
+}
+
+// layerEvents finds the events crossed by each layer since its previous time
+func layerEvents(layers []AnimationLayer) []TriggeredEvent {
+	var events []TriggeredEvent
+	for _, l := range layers {
+		if l.Animation == nil {
+			continue
+		}
+
+		l.Animation.eventsBetween(l.PrevTime, l.Time, l.Once, l.First, func(e AnimationEvent) {
+			events = append(events, TriggeredEvent{
+				Animation: l.Animation,
+				Name:      e.Name,
+				Weight:    l.Weight,
+			})
+		})
+	}
+
+	return events
+}
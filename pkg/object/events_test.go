@@ -0,0 +1,54 @@
+package object
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEventsBetween(t *testing.T) {
+	// A 1 second loop
+	a := &Animation{
+		Duration: 10,
+		TPS:      10,
+		Events: []AnimationEvent{
+			{"start", 0},
+			{"a", 2},
+			{"b", 5},
+			{"end", 10},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		from, to float32
+		once     bool
+		first    bool
+		expected []string
+	}{
+		{"between", 0.1, 0.6, false, false, []string{"a", "b"}},
+		{"at from", 0.2, 0.4, false, false, nil},
+		{"at from on the first update", 0.2, 0.4, false, true, []string{"a"}},
+		{"first update without moving", 0, 0, false, true, []string{"start"}},
+		{"paused", 0.2, 0.2, false, false, nil},
+		{"at to", 0.1, 0.2, false, false, []string{"a"}},
+		// The end and start of a loop are the same point
+		{"wrapped", 0.8, 1.1, false, false, []string{"end", "start"}},
+		{"longer than the loop", 0.3, 1.5, false, false, []string{"start", "a", "b", "end"}},
+		{"once", 0.3, 0.9, true, false, []string{"b"}},
+		{"once reaching the end", 0.9, 1.5, true, false, []string{"end"}},
+		{"once past the end", 1.5, 2.5, true, false, nil},
+		{"once longer than the clip", 0, 5, true, false, []string{"a", "b", "end"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			a.eventsBetween(tt.from, tt.to, tt.once, tt.first, func(e AnimationEvent) {
+				got = append(got, e.Name)
+			})
+
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("got %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
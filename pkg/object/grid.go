@@ -0,0 +1,122 @@
+package object
+
+import (
+	"github.com/go-gl/mathgl/mgl32"
+
+	"github.com/devplayer0/cs4052/pkg/util"
+)
+
+type gridCell [3]int32
+
+// spatialGrid is a uniform grid of boids stored as a spatial hash, used to only
+// check boids in nearby cells for neighbour queries. Boids are sorted by the
+// hash of their cell so that each bucket is a contiguous slice.
+type spatialGrid struct {
+	cellSize float32
+	mask     uint32
+
+	// starts[h] is the index in boids of the first boid in bucket h
+	starts []int32
+	boids  []*Boid
+	cells  []gridCell
+	hashes []uint32
+	// Copies of each boid's position, to avoid chasing pointers when checking
+	// the distance to boids in nearby cells
+	positions []mgl32.Vec3
+}
+
+func (g *spatialGrid) cell(p mgl32.Vec3) gridCell {
+	return gridCell{
+		int32(util.Floor(p.X() / g.cellSize)),
+		int32(util.Floor(p.Y() / g.cellSize)),
+		int32(util.Floor(p.Z() / g.cellSize)),
+	}
+}
+
+func (g *spatialGrid) hash(c gridCell) uint32 {
+	h := uint32(c[0])*73856093 ^ uint32(c[1])*19349663 ^ uint32(c[2])*83492791
+	return h & g.mask
+}
+
+// rebuild re-inserts each of the boids into cells of the given size
+func (g *spatialGrid) rebuild(boids []*Boid, cellSize float32) {
+	g.cellSize = cellSize
+
+	// Around 2 buckets per boid keeps collisions low
+	size := uint32(1)
+	for size < 2*uint32(len(boids)) {
+		size <<= 1
+	}
+	g.mask = size - 1
+
+	if cap(g.starts) < int(size)+1 {
+		g.starts = make([]int32, size+1)
+	}
+	g.starts = g.starts[:size+1]
+	for i := range g.starts {
+		g.starts[i] = 0
+	}
+	if cap(g.boids) < len(boids) {
+		g.boids = make([]*Boid, len(boids))
+		g.cells = make([]gridCell, len(boids))
+		g.hashes = make([]uint32, len(boids))
+		g.positions = make([]mgl32.Vec3, len(boids))
+	}
+	n := len(boids)
+	g.boids, g.cells, g.hashes, g.positions = g.boids[:n], g.cells[:n], g.hashes[:n], g.positions[:n]
+
+	// Counting sort by hash
+	for i, b := range boids {
+		g.hashes[i] = g.hash(g.cell(b.Position))
+		g.starts[g.hashes[i]+1]++
+	}
+	for h := uint32(1); h <= size; h++ {
+		g.starts[h] += g.starts[h-1]
+	}
+	next := make([]int32, size)
+	copy(next, g.starts[:size])
+	for i, b := range boids {
+		j := next[g.hashes[i]]
+		next[g.hashes[i]]++
+
+		g.boids[j] = b
+		g.cells[j] = g.cell(b.Position)
+		g.positions[j] = b.Position
+	}
+}
+
+// neighbour is a boid near another, with the offset to it
+type neighbour struct {
+	boid     *Boid
+	diff     mgl32.Vec3
+	distance float32
+}
+
+// gather appends each boid (other than b) within radius of b to ns
+func (g *spatialGrid) gather(b *Boid, radius float32, ns []neighbour) []neighbour {
+	lo := g.cell(b.Position.Sub(mgl32.Vec3{radius, radius, radius}))
+	hi := g.cell(b.Position.Add(mgl32.Vec3{radius, radius, radius}))
+
+	r2 := radius * radius
+	var c gridCell
+	for c[0] = lo[0]; c[0] <= hi[0]; c[0]++ {
+		for c[1] = lo[1]; c[1] <= hi[1]; c[1]++ {
+			for c[2] = lo[2]; c[2] <= hi[2]; c[2]++ {
+				h := g.hash(c)
+				for i := g.starts[h]; i < g.starts[h+1]; i++ {
+					// Other cells can share the bucket
+					if g.cells[i] != c {
+						continue
+					}
+
+					diff := g.positions[i].Sub(b.Position)
+					if d2 := diff.Dot(diff); d2 <= r2 && g.boids[i] != b {
+						ns = append(ns, neighbour{g.boids[i], diff, util.Sqrt(d2)})
+					}
+				}
+			}
+		}
+	}
+
+	return ns
+}
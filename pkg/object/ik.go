@@ -0,0 +1,309 @@
+package object
+
+import (
+	"fmt"
+
+	"github.com/go-gl/mathgl/mgl32"
+
+	"github.com/devplayer0/cs4052/pkg/util"
+)
+
+// IKSolver selects the algorithm used to solve an IK chain
+type IKSolver int
+
+const (
+	// IKTwoBone solves a chain of exactly 3 nodes (e.g. hip, knee and foot)
+	// analytically
+	IKTwoBone IKSolver = iota
+	// IKFABRIK solves chains of any length with Forward And Backward Reaching
+	// Inverse Kinematics
+	IKFABRIK
+	// IKCCD solves chains of any length with Cyclic Coordinate Descent
+	IKCCD
+)
+
+const (
+	defaultIKIterations = 10
+	defaultIKTolerance  = 0.001
+)
+
+// IKChain is a chain of nodes which is solved to make its end reach a target,
+// after animation and before the skinning transforms are calculated
+type IKChain struct {
+	solver IKSolver
+	// From the root of the chain to the end effector
+	nodes []*node
+
+	Enabled bool
+	// Target is the world space position for the end of the chain to reach
+	// (for the object's own pose, other poses use Pose.IKTargets)
+	Target mgl32.Vec3
+	// Pole is an optional world space position which the middle of a two-bone
+	// chain bends towards (otherwise it bends the way it's animated)
+	Pole *mgl32.Vec3
+	// Weight blends between the animated (0) and solved (1) pose
+	Weight float32
+
+	// Iterations and Tolerance (distance from the target) limit iterative
+	// solvers
+	Iterations int
+	Tolerance  float32
+}
+
+// IKTarget is a target for an IK chain when evaluating a particular Pose
+type IKTarget struct {
+	// Position is the world space position for the end of the chain to reach
+	Position mgl32.Vec3
+	// Pole is as in IKChain (optional)
+	Pole *mgl32.Vec3
+}
+
+// AddIKChain sets up an IK chain from the node named root to its descendant
+// named end. The chain starts out disabled.
+func (o *Object) AddIKChain(root, end string, solver IKSolver) (*IKChain, error) {
+	e := o.hierarchy.find(end)
+	if e == nil {
+		return nil, fmt.Errorf("end node %q not found", end)
+	}
+
+	var nodes []*node
+	for n := e; ; n = n.Parent {
+		if n == nil {
+			return nil, fmt.Errorf("node %q is not an ancestor of %q", root, end)
+		}
+
+		nodes = append([]*node{n}, nodes...)
+		if n.Name == root {
+			break
+		}
+	}
+
+	if len(nodes) < 2 {
+		return nil, fmt.Errorf("IK chain must have at least 2 nodes")
+	}
+	if solver == IKTwoBone && len(nodes) != 3 {
+		return nil, fmt.Errorf("two-bone IK chain must have 3 nodes (got %v)", len(nodes))
+	}
+
+	c := &IKChain{
+		solver: solver,
+		nodes:  nodes,
+
+		Weight:     1,
+		Iterations: defaultIKIterations,
+		Tolerance:  defaultIKTolerance,
+	}
+	o.ikChains = append(o.ikChains, c)
+
+	return c, nil
+}
+
+// RemoveIKChain removes an IK chain from the object
+func (o *Object) RemoveIKChain(c *IKChain) {
+	for i, oc := range o.ikChains {
+		if oc == c {
+			o.ikChains = append(o.ikChains[:i], o.ikChains[i+1:]...)
+			return
+		}
+	}
+}
+
+// solveIK applies each of the enabled IK chains to a pose. The object's own
+// pose uses each chain's Target, but other poses (e.g. crowd instances) only
+// solve the chains they have their own targets for.
+func (o *Object) solveIK(p *Pose, trans mgl32.Mat4) {
+	for _, c := range o.ikChains {
+		if !c.Enabled || c.Weight <= 0 {
+			continue
+		}
+
+		t := IKTarget{c.Target, c.Pole}
+		if p != o.current {
+			var ok bool
+			if t, ok = p.IKTargets[c]; !ok {
+				continue
+			}
+		}
+
+		// Solved at full weight and then blended with the animated pose
+		var animated []mgl32.Mat4
+		if c.Weight < 1 {
+			animated = make([]mgl32.Mat4, len(c.nodes))
+			for i, n := range c.nodes {
+				animated[i] = p.nodes.local[n.index]
+			}
+		}
+
+		switch c.solver {
+		case IKTwoBone:
+			c.solveTwoBone(o.nodes, p.nodes, trans, t)
+		case IKFABRIK:
+			c.solveFABRIK(o.nodes, p.nodes, trans, t.Position)
+		case IKCCD:
+			c.solveCCD(o.nodes, p.nodes, trans, t.Position)
+		}
+
+		if animated != nil {
+			c.blend(o.nodes, p.nodes, trans, animated)
+		}
+	}
+}
+
+// blend interpolates the local transforms of the chain's nodes from the
+// animated ones to the solved ones by the chain's weight
+func (c *IKChain) blend(nodes []*node, p *pose, trans mgl32.Mat4, animated []mgl32.Mat4) {
+	for i, n := range c.nodes {
+		aPos, aRot, aScale := util.DecomposeTransform(animated[i])
+		sPos, sRot, sScale := util.DecomposeTransform(p.local[n.index])
+
+		pos := util.InterpolateVec3(aPos, sPos, c.Weight)
+		rot := util.QuatSlerp(aRot, sRot, c.Weight)
+		scale := util.InterpolateVec3(aScale, sScale, c.Weight)
+		p.local[n.index] = mgl32.Translate3D(pos.X(), pos.Y(), pos.Z()).
+			Mul4(rot.Normalize().Mat4()).
+			Mul4(mgl32.Scale3D(scale.X(), scale.Y(), scale.Z()))
+	}
+
+	p.updateFinal(nodes, trans, c.nodes[0].index)
+}
+
+func (c *IKChain) position(p *pose, i int) mgl32.Vec3 {
+	return util.PosFromTrans(p.final[c.nodes[i].index])
+}
+
+// rotate rotates node i of the chain (in world space, about its own position)
+// so that the direction from it to `from` points towards `to`
+func (c *IKChain) rotate(nodes []*node, p *pose, trans mgl32.Mat4, i int, from, to mgl32.Vec3) {
+	n := c.nodes[i]
+	pivot := util.PosFromTrans(p.final[n.index])
+
+	a, b := from.Sub(pivot), to.Sub(pivot)
+	if a.Len() < 1e-6 || b.Len() < 1e-6 {
+		return
+	}
+
+	rot := mgl32.QuatBetweenVectors(a.Normalize(), b.Normalize())
+
+	final := util.TransFromPos(pivot).
+		Mul4(rot.Mat4()).
+		Mul4(util.TransFromPos(pivot.Mul(-1))).
+		Mul4(p.final[n.index])
+	p.local[n.index] = p.parentFinal(n, trans).Inv().Mul4(final)
+	p.updateFinal(nodes, trans, n.index)
+}
+
+// applyPositions rotates each node of the chain so that the next node lies in
+// the direction of its position in positions
+func (c *IKChain) applyPositions(nodes []*node, p *pose, trans mgl32.Mat4, positions []mgl32.Vec3) {
+	for i := 0; i < len(c.nodes)-1; i++ {
+		from := c.position(p, i+1)
+		to := c.position(p, i).Add(positions[i+1].Sub(positions[i]))
+		c.rotate(nodes, p, trans, i, from, to)
+	}
+}
+
+// perpendicular finds a unit vector perpendicular to v
+func perpendicular(v mgl32.Vec3) mgl32.Vec3 {
+	axis := mgl32.Vec3{1, 0, 0}
+	if util.Abs(v.X()) > 0.9 {
+		axis = mgl32.Vec3{0, 1, 0}
+	}
+
+	return v.Cross(axis).Normalize()
+}
+
+func (c *IKChain) solveTwoBone(nodes []*node, p *pose, trans mgl32.Mat4, t IKTarget) {
+	a, b, e := c.position(p, 0), c.position(p, 1), c.position(p, 2)
+	l1, l2 := b.Sub(a).Len(), e.Sub(b).Len()
+
+	toTarget := t.Position.Sub(a)
+	d := toTarget.Len()
+	if d < 1e-6 || l1 < 1e-6 || l2 < 1e-6 {
+		return
+	}
+	dir := toTarget.Mul(1 / d)
+	// Can't reach further than fully extended or closer than fully bent
+	d = mgl32.Clamp(d, util.Abs(l1-l2)+1e-4, l1+l2-1e-4)
+
+	// Bend in the plane containing the target and the pole (or the current
+	// middle joint)
+	bend := b
+	if t.Pole != nil {
+		bend = *t.Pole
+	}
+	perp := bend.Sub(a)
+	perp = perp.Sub(dir.Mul(perp.Dot(dir)))
+	if perp.Len() < 1e-6 {
+		perp = perpendicular(dir)
+	} else {
+		perp = perp.Normalize()
+	}
+
+	// Law of cosines for the angle at the root
+	cosA := mgl32.Clamp((l1*l1+d*d-l2*l2)/(2*l1*d), -1, 1)
+	sinA := util.Sqrt(1 - cosA*cosA)
+
+	mid := a.Add(dir.Mul(cosA * l1)).Add(perp.Mul(sinA * l1))
+	end := a.Add(dir.Mul(d))
+	c.applyPositions(nodes, p, trans, []mgl32.Vec3{a, mid, end})
+}
+
+func (c *IKChain) solveFABRIK(nodes []*node, p *pose, trans mgl32.Mat4, target mgl32.Vec3) {
+	n := len(c.nodes)
+	positions := make([]mgl32.Vec3, n)
+	lengths := make([]float32, n-1)
+	var total float32
+	for i := range positions {
+		positions[i] = c.position(p, i)
+		if i > 0 {
+			lengths[i-1] = positions[i].Sub(positions[i-1]).Len()
+			total += lengths[i-1]
+		}
+	}
+	root := positions[0]
+
+	if target.Sub(root).Len() >= total {
+		// Out of reach, just straighten towards the target
+		dir := target.Sub(root).Normalize()
+		for i := 1; i < n; i++ {
+			positions[i] = positions[i-1].Add(dir.Mul(lengths[i-1]))
+		}
+	} else {
+		for it := 0; it < c.Iterations; it++ {
+			if positions[n-1].Sub(target).Len() <= c.Tolerance {
+				break
+			}
+
+			// Backward: from the end (placed at the target) to the root
+			positions[n-1] = target
+			for i := n - 2; i >= 0; i-- {
+				dir := positions[i].Sub(positions[i+1]).Normalize()
+				positions[i] = positions[i+1].Add(dir.Mul(lengths[i]))
+			}
+
+			// Forward: from the root (placed back at its origin) to the end
+			positions[0] = root
+			for i := 1; i < n; i++ {
+				dir := positions[i].Sub(positions[i-1]).Normalize()
+				positions[i] = positions[i-1].Add(dir.Mul(lengths[i-1]))
+			}
+		}
+	}
+
+	c.applyPositions(nodes, p, trans, positions)
+}
+
+func (c *IKChain) solveCCD(nodes []*node, p *pose, trans mgl32.Mat4, target mgl32.Vec3) {
+	end := len(c.nodes) - 1
+	for it := 0; it < c.Iterations; it++ {
+		if c.position(p, end).Sub(target).Len() <= c.Tolerance {
+			break
+		}
+
+		// Rotate each joint (from the one nearest the end) to point the end
+		// towards the target
+		for i := end - 1; i >= 0; i-- {
+			c.rotate(nodes, p, trans, i, c.position(p, end), target)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package object
+
+import (
+	"math"
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+
+	"github.com/devplayer0/cs4052/pkg/util"
+)
+
+// newTestLeg creates an object with a hip, knee and foot (each bone 1 unit
+// long, slightly bent at the knee) and a two-bone chain through them
+func newTestLeg(t *testing.T) (*Object, *IKChain) {
+	t.Helper()
+
+	hip := &node{Name: "hip", Transform: mgl32.Ident4()}
+	knee := &node{Name: "knee", Transform: util.TransFromPos(mgl32.Vec3{0, -0.99, 0.14}), Parent: hip}
+	foot := &node{Name: "foot", Transform: util.TransFromPos(mgl32.Vec3{0, -0.99, -0.14}), Parent: knee}
+	hip.Children = []*node{knee}
+	knee.Children = []*node{foot}
+
+	o := &Object{hierarchy: hip}
+	o.nodes = hip.flatten(nil)
+	o.current = &Pose{
+		nodes: newPose(len(o.nodes)),
+		trans: mgl32.Ident4(),
+	}
+
+	c, err := o.AddIKChain("hip", "foot", IKTwoBone)
+	if err != nil {
+		t.Fatalf("failed to add chain: %v", err)
+	}
+	c.Enabled = true
+
+	return o, c
+}
+
+func footPosition(o *Object) mgl32.Vec3 {
+	return util.PosFromTrans(o.current.nodes.final[o.nodes[2].index])
+}
+
+// rotationAngle returns the angle of a node's local rotation
+func rotationAngle(o *Object, i int) float32 {
+	_, rot, _ := util.DecomposeTransform(o.current.nodes.local[i])
+	return 2 * float32(math.Acos(float64(mgl32.Clamp(util.Abs(rot.W), 0, 1))))
+}
+
+func TestIKTwoBoneReach(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   mgl32.Vec3
+		expected mgl32.Vec3
+	}{
+		{"in reach", mgl32.Vec3{0.5, -1.5, 0}, mgl32.Vec3{0.5, -1.5, 0}},
+		// Fully extended towards the target
+		{"out of reach", mgl32.Vec3{0, -10, 0}, mgl32.Vec3{0, -2, 0}},
+		{"too close", mgl32.Vec3{0, -0.001, 0}, mgl32.Vec3{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, c := newTestLeg(t)
+			c.Target = tt.target
+			o.Evaluate(o.current, mgl32.Ident4(), nil)
+
+			if got := footPosition(o); got.Sub(tt.expected).Len() > 0.01 {
+				t.Errorf("foot at %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestIKWeight(t *testing.T) {
+	target := mgl32.Vec3{0.8, -1.2, 0}
+
+	o, _ := newTestLeg(t)
+	o.Evaluate(o.current, mgl32.Ident4(), nil)
+	animated := footPosition(o)
+
+	solved := make(map[float32][2]float32)
+	for _, w := range []float32{0, 0.5, 1} {
+		o, c := newTestLeg(t)
+		c.Target = target
+		c.Weight = w
+		o.Evaluate(o.current, mgl32.Ident4(), nil)
+
+		foot := footPosition(o)
+		switch w {
+		case 0:
+			if !foot.ApproxEqualThreshold(animated, 1e-4) {
+				t.Errorf("weight 0: foot at %v, expected the animated %v", foot, animated)
+			}
+		case 1:
+			if foot.Sub(target).Len() > 0.01 {
+				t.Errorf("weight 1: foot at %v, expected the target %v", foot, target)
+			}
+		}
+
+		solved[w] = [2]float32{rotationAngle(o, 0), rotationAngle(o, 1)}
+	}
+
+	// Half way between the animated and solved rotation of each joint
+	for i, name := range []string{"hip", "knee"} {
+		full, half := solved[1][i], solved[0.5][i]
+		if full < 0.01 {
+			t.Fatalf("%v: solve didn't rotate the joint", name)
+		}
+
+		animatedAngle := solved[0][i]
+		if expected := (animatedAngle + full) / 2; util.Abs(half-expected) > 0.01 {
+			t.Errorf("%v: weight 0.5 rotated by %v, expected %v", name, half, expected)
+		}
+	}
+}
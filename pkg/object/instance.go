@@ -0,0 +1,93 @@
+package object
+
+import "github.com/go-gl/mathgl/mgl32"
+
+// Pose is an evaluated pose of an object, kept separately from the object so
+// that many instances can share the object (and its GPU meshes)
+type Pose struct {
+	// IKTargets are the targets of the IK chains solved for this pose (chains
+	// without one are skipped, unless this is the object's own pose)
+	IKTargets map[*IKChain]IKTarget
+
+	nodes *pose
+	// Skinning transforms indexed by joint ID
+	joints []mgl32.Mat4
+	trans  mgl32.Mat4
+}
+
+// NewPose creates a pose for the object (in its rest pose at the origin)
+func (o *Object) NewPose() *Pose {
+	p := &Pose{
+		nodes:  newPose(len(o.nodes)),
+		joints: make([]mgl32.Mat4, o.jointCount),
+		trans:  mgl32.Ident4(),
+	}
+	o.Evaluate(p, p.trans, nil)
+
+	return p
+}
+
+// Transform returns the transform the pose was evaluated at
+func (p *Pose) Transform() mgl32.Mat4 {
+	return p.trans
+}
+
+// Evaluate calculates a pose of the object at trans for a weighted blend of
+// animations without changing the object's own state, returning any animation
+// events crossed and the root motion extracted since each layer's previous
+// time
+func (o *Object) Evaluate(p *Pose, trans mgl32.Mat4, layers []AnimationLayer) ([]TriggeredEvent, RootMotion) {
+	p.trans = trans
+	p.nodes.evaluate(o.nodes, trans, layers)
+	o.solveIK(p, trans)
+
+	invTrans := trans.Inv()
+	for _, n := range o.nodes {
+		if n.Joint != nil {
+			p.joints[n.Joint.ID] = invTrans.Mul4(p.nodes.final[n.index]).Mul4(n.Joint.InverseBind)
+		}
+	}
+
+	return layerEvents(layers), o.rootMotion(layers)
+}
+
+// InstanceAnimation is lightweight per-instance playback state for an
+// animation, so that instances sharing an object can be desynchronised
+type InstanceAnimation struct {
+	Animation *Animation
+	// Offset is added to the time (in seconds) to shift the instance's phase
+	Offset float32
+	// Speed multiplies the playback rate (0 is treated as 1)
+	Speed float32
+
+	// Time of the previous call to Layers
+	last    float32
+	started bool
+}
+
+// Layers returns the animation layer to evaluate the instance with at time t
+// (nil if there's no animation)
+func (ia *InstanceAnimation) Layers(t float32) []AnimationLayer {
+	if ia.Animation == nil {
+		return nil
+	}
+
+	speed := ia.Speed
+	if speed == 0 {
+		speed = 1
+	}
+	prev := t
+	if ia.started && ia.last <= t {
+		prev = ia.last
+	}
+	first := !ia.started
+	ia.last, ia.started = t, true
+
+	return []AnimationLayer{{
+		Animation: ia.Animation,
+		Time:      (t + ia.Offset) * speed,
+		PrevTime:  (prev + ia.Offset) * speed,
+		First:     first,
+		Weight:    1,
+	}}
+}
@@ -0,0 +1,196 @@
+package object
+
+import (
+	"sort"
+
+	"github.com/go-gl/mathgl/mgl32"
+
+	"github.com/devplayer0/cs4052/pkg/pb"
+	"github.com/devplayer0/cs4052/pkg/util"
+)
+
+type vec3Key struct {
+	Time  float32
+	Value mgl32.Vec3
+	// Tangents for cubic spline interpolation
+	In, Out mgl32.Vec3
+}
+type quatKey struct {
+	Time  float32
+	Value mgl32.Quat
+	// Tangents for cubic spline interpolation
+	In, Out mgl32.Vec4
+}
+
+type nodeAnim struct {
+	Pos   []vec3Key
+	Rot   []quatKey
+	Scale []vec3Key
+
+	PosInterp   pb.AnimChannel_Interpolation
+	RotInterp   pb.AnimChannel_Interpolation
+	ScaleInterp pb.AnimChannel_Interpolation
+}
+
+func loadVec3Keys(keys []*pb.Vec3Key) []vec3Key {
+	out := make([]vec3Key, len(keys))
+	for i, k := range keys {
+		out[i] = vec3Key{
+			Time:  k.Time,
+			Value: util.PBVec3(k.Value),
+		}
+		if k.InTangent != nil {
+			out[i].In = util.PBVec3(k.InTangent)
+		}
+		if k.OutTangent != nil {
+			out[i].Out = util.PBVec3(k.OutTangent)
+		}
+	}
+
+	return out
+}
+func loadQuatKeys(keys []*pb.Vec4Key) []quatKey {
+	out := make([]quatKey, len(keys))
+	for i, k := range keys {
+		out[i] = quatKey{
+			Time:  k.Time,
+			Value: util.PBQuat(k.Value),
+		}
+		if k.InTangent != nil {
+			out[i].In = util.PBVec4(k.InTangent)
+		}
+		if k.OutTangent != nil {
+			out[i].Out = util.PBVec4(k.OutTangent)
+		}
+	}
+
+	return out
+}
+
+func loadNodeAnim(c *pb.AnimChannel) nodeAnim {
+	return nodeAnim{
+		Pos:   loadVec3Keys(c.PosFrames),
+		Rot:   loadQuatKeys(c.RotFrames),
+		Scale: loadVec3Keys(c.ScaleFrames),
+
+		PosInterp:   c.PosInterpolation,
+		RotInterp:   c.RotInterpolation,
+		ScaleInterp: c.ScaleInterpolation,
+	}
+}
+
+// keySpan is a pair of keys to interpolate between
+type keySpan struct {
+	a, b int
+	// How far between the keys (0-1)
+	factor float32
+	// Time between the keys (in ticks), used to scale tangents
+	length float32
+}
+
+// findKeys locates the keys on either side of t using a binary search (n is
+// the number of keys and time gives each key's time). Outside of the keys'
+// range, looping animations interpolate between the last and first keys
+// across the end of the clip and others hold the nearest key.
+func findKeys(n int, time func(int) float32, t, duration float32, loop bool) keySpan {
+	// First key after t
+	b := sort.Search(n, func(i int) bool {
+		return time(i) > t
+	})
+	if b > 0 && b < n {
+		a := b - 1
+		length := time(b) - time(a)
+		return keySpan{a, b, keyFactor(t, time(a), time(b)), length}
+	}
+
+	first, last := time(0), time(n-1)
+	if !loop || n == 1 {
+		if b == 0 {
+			return keySpan{0, 0, 0, 0}
+		}
+		return keySpan{n - 1, n - 1, 0, 0}
+	}
+
+	// Wrap around from the last key to the first
+	length := duration - last + first
+	if b == 0 {
+		t += duration
+	}
+	return keySpan{n - 1, 0, keyFactor(t, last, last+length), length}
+}
+
+// keyFactor calculates how far t is between two keys
+func keyFactor(t, a, b float32) float32 {
+	if b <= a {
+		return 0
+	}
+
+	return (t - a) / (b - a)
+}
+
+// hermite calculates the cubic Hermite basis functions for t
+func hermite(t float32) (float32, float32, float32, float32) {
+	t2 := t * t
+	t3 := t2 * t
+
+	return 2*t3 - 3*t2 + 1, t3 - 2*t2 + t, -2*t3 + 3*t2, t3 - t2
+}
+
+func sampleVec3(keys []vec3Key, interp pb.AnimChannel_Interpolation, t, duration float32, loop bool, rest mgl32.Vec3) mgl32.Vec3 {
+	if len(keys) == 0 {
+		return rest
+	}
+
+	s := findKeys(len(keys), func(i int) float32 { return keys[i].Time }, t, duration, loop)
+	ka, kb := keys[s.a], keys[s.b]
+	switch interp {
+	case pb.AnimChannel_STEP:
+		return ka.Value
+	case pb.AnimChannel_CUBIC_SPLINE:
+		h00, h10, h01, h11 := hermite(s.factor)
+		return ka.Value.Mul(h00).
+			Add(ka.Out.Mul(h10 * s.length)).
+			Add(kb.Value.Mul(h01)).
+			Add(kb.In.Mul(h11 * s.length))
+	default:
+		return util.InterpolateVec3(ka.Value, kb.Value, s.factor)
+	}
+}
+
+func sampleQuat(keys []quatKey, interp pb.AnimChannel_Interpolation, t, duration float32, loop bool, rest mgl32.Quat) mgl32.Quat {
+	if len(keys) == 0 {
+		return rest
+	}
+
+	s := findKeys(len(keys), func(i int) float32 { return keys[i].Time }, t, duration, loop)
+	ka, kb := keys[s.a], keys[s.b]
+	switch interp {
+	case pb.AnimChannel_STEP:
+		return ka.Value
+	case pb.AnimChannel_CUBIC_SPLINE:
+		// Interpolate the components and renormalize
+		h00, h10, h01, h11 := hermite(s.factor)
+		v := quatVec4(ka.Value).Mul(h00).
+			Add(ka.Out.Mul(h10 * s.length)).
+			Add(quatVec4(kb.Value).Mul(h01)).
+			Add(kb.In.Mul(h11 * s.length))
+		return mgl32.Quat{W: v.W(), V: v.Vec3()}.Normalize()
+	default:
+		return util.QuatSlerp(ka.Value, kb.Value, s.factor).Normalize()
+	}
+}
+
+func quatVec4(q mgl32.Quat) mgl32.Vec4 {
+	return mgl32.Vec4{q.X(), q.Y(), q.Z(), q.W}
+}
+
+// sample evaluates the channel's translation, rotation and scale for node n
+// at time t (in ticks), falling back to the node's rest pose for components
+// without any keys
+func (a nodeAnim) sample(n *node, t, duration float32, loop bool) (mgl32.Vec3, mgl32.Quat, mgl32.Vec3) {
+	pos := sampleVec3(a.Pos, a.PosInterp, t, duration, loop, n.restPos)
+	rot := sampleQuat(a.Rot, a.RotInterp, t, duration, loop, n.restRot)
+	scale := sampleVec3(a.Scale, a.ScaleInterp, t, duration, loop, n.restScale)
+
+	return pos, rot, scale
+}
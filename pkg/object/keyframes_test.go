@@ -0,0 +1,152 @@
+package object
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+
+	"github.com/devplayer0/cs4052/pkg/pb"
+)
+
+func keyTimes(times []float32) func(int) float32 {
+	return func(i int) float32 { return times[i] }
+}
+
+func TestFindKeys(t *testing.T) {
+	times := []float32{1, 3, 7}
+	const duration = 10
+
+	tests := []struct {
+		name  string
+		times []float32
+		t     float32
+		loop  bool
+		span  keySpan
+	}{
+		{"between", times, 2, false, keySpan{0, 1, 0.5, 2}},
+		{"on a key", times, 3, false, keySpan{1, 2, 0, 4}},
+		{"before the last key", times, 6, true, keySpan{1, 2, 0.75, 4}},
+
+		{"before the first key", times, 0.5, false, keySpan{0, 0, 0, 0}},
+		{"after the last key", times, 8, false, keySpan{2, 2, 0, 0}},
+		{"on the last key", times, 7, false, keySpan{2, 2, 0, 0}},
+
+		// The wrap span is duration - last + first = 4 ticks long
+		{"looping after the last key", times, 8, true, keySpan{2, 0, 0.25, 4}},
+		{"looping on the last key", times, 7, true, keySpan{2, 0, 0, 4}},
+		{"looping before the first key", times, 0.5, true, keySpan{2, 0, 0.875, 4}},
+
+		{"single key", []float32{2}, 5, false, keySpan{0, 0, 0, 0}},
+		{"single key looping", []float32{2}, 5, true, keySpan{0, 0, 0, 0}},
+		{"single key looping before", []float32{2}, 1, true, keySpan{0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := findKeys(len(tt.times), keyTimes(tt.times), tt.t, duration, tt.loop)
+			if got.a != tt.span.a || got.b != tt.span.b ||
+				!mgl32.FloatEqual(got.factor, tt.span.factor) || !mgl32.FloatEqual(got.length, tt.span.length) {
+				t.Errorf("got %+v, expected %+v", got, tt.span)
+			}
+		})
+	}
+}
+
+func TestFindKeysSearch(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	// Uneven key times
+	times := make([]float32, 100)
+	var last float32
+	for i := range times {
+		last += 0.1 + r.Float32()
+		times[i] = last
+	}
+	duration := last + 1
+
+	for i := 0; i < 1000; i++ {
+		tm := times[0] + r.Float32()*(last-times[0])
+
+		// Linear search for the keys on either side
+		a := 0
+		for a+1 < len(times) && times[a+1] <= tm {
+			a++
+		}
+		if a == len(times)-1 {
+			continue
+		}
+
+		s := findKeys(len(times), keyTimes(times), tm, duration, true)
+		if s.a != a || s.b != a+1 {
+			t.Fatalf("t = %v: got keys %v and %v, expected %v and %v", tm, s.a, s.b, a, a+1)
+		}
+		if s.factor < 0 || s.factor > 1 {
+			t.Fatalf("t = %v: factor %v out of range", tm, s.factor)
+		}
+	}
+}
+
+func TestSampleVec3(t *testing.T) {
+	keys := []vec3Key{
+		{Time: 0, Value: mgl32.Vec3{0, 0, 0}, Out: mgl32.Vec3{1, 0, 0}},
+		{Time: 2, Value: mgl32.Vec3{1, 0, 0}},
+	}
+	rest := mgl32.Vec3{5, 5, 5}
+
+	tests := []struct {
+		name     string
+		keys     []vec3Key
+		interp   pb.AnimChannel_Interpolation
+		t        float32
+		expected mgl32.Vec3
+	}{
+		{"no keys", nil, pb.AnimChannel_LINEAR, 1, rest},
+		{"linear", keys, pb.AnimChannel_LINEAR, 1, mgl32.Vec3{0.5, 0, 0}},
+		{"step", keys, pb.AnimChannel_STEP, 1.9, mgl32.Vec3{0, 0, 0}},
+		{"step on a key", keys, pb.AnimChannel_STEP, 2, mgl32.Vec3{1, 0, 0}},
+		{"cubic start", keys, pb.AnimChannel_CUBIC_SPLINE, 0, mgl32.Vec3{0, 0, 0}},
+		// 0.5 * 1 + h10(0.5) * length * out = 0.5 + 0.125 * 2
+		{"cubic middle", keys, pb.AnimChannel_CUBIC_SPLINE, 1, mgl32.Vec3{0.75, 0, 0}},
+		{"cubic end", keys, pb.AnimChannel_CUBIC_SPLINE, 1.999999, mgl32.Vec3{1, 0, 0}},
+		{"held after the end", keys, pb.AnimChannel_CUBIC_SPLINE, 3, mgl32.Vec3{1, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sampleVec3(tt.keys, tt.interp, tt.t, 4, false, rest)
+			if !got.ApproxEqualThreshold(tt.expected, 1e-4) {
+				t.Errorf("got %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSampleQuat(t *testing.T) {
+	a := mgl32.QuatIdent()
+	b := mgl32.QuatRotate(mgl32.DegToRad(90), mgl32.Vec3{0, 1, 0})
+	keys := []quatKey{{Time: 0, Value: a}, {Time: 2, Value: b}}
+
+	tests := []struct {
+		name     string
+		interp   pb.AnimChannel_Interpolation
+		t        float32
+		loop     bool
+		expected mgl32.Quat
+	}{
+		{"linear", pb.AnimChannel_LINEAR, 1, false, mgl32.QuatRotate(mgl32.DegToRad(45), mgl32.Vec3{0, 1, 0})},
+		{"step", pb.AnimChannel_STEP, 1.5, false, a},
+		{"cubic end", pb.AnimChannel_CUBIC_SPLINE, 1.999999, false, b},
+		// Half way back to the first key across the end of the clip
+		{"linear wrap", pb.AnimChannel_LINEAR, 3, true, mgl32.QuatRotate(mgl32.DegToRad(45), mgl32.Vec3{0, 1, 0})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sampleQuat(keys, tt.interp, tt.t, 4, tt.loop, mgl32.QuatIdent())
+			if !got.OrientationEqualThreshold(tt.expected, 1e-4) {
+				t.Errorf("got %v, expected %v", got, tt.expected)
+			}
+			if !mgl32.FloatEqualThreshold(got.Len(), 1, 1e-4) {
+				t.Errorf("got non-unit quaternion %v", got)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"sort"
 
@@ -36,6 +37,10 @@ var MeshWireFrame = false
 // (even in the presence of a normap map texture)
 var DisableNormalMapping = false
 
+// ForcePBR when enabled, renders Phong materials with the metallic-roughness
+// model (see Material.MetallicRoughness)
+var ForcePBR = false
+
 var zeroVec3 = mgl32.Vec3{}
 
 // Vertex represents a vertex in a mesh (position, normal and UV coordinates)
@@ -54,7 +59,8 @@ type JointWeights struct {
 	Values   [MaxWeights]float32
 }
 
-// Material represents a material with textures and specular shininess
+// Material represents a material with textures and specular shininess, or
+// a physically based metallic-roughness material
 type Material struct {
 	Diffuse   mgl32.Vec3
 	Specular  mgl32.Vec3
@@ -67,6 +73,30 @@ type Material struct {
 
 	Shininess      float32
 	Reflectiveness float32
+
+	// PBR selects the metallic-roughness model, where Diffuse is the base
+	// colour (Specular, Shininess and Reflectiveness are unused)
+	PBR       bool
+	Metallic  float32
+	Roughness float32
+
+	// Roughness in green and metallic in blue, multiplying the values above
+	MetallicRoughnessTexture *util.Texture
+	// Ambient occlusion in red
+	OcclusionTexture *util.Texture
+}
+
+// MetallicRoughness returns the material's metallic and roughness values,
+// approximating them for Phong materials. Phong materials are treated as
+// dielectrics and the specular exponent is mapped back to roughness (using
+// shininess = 2 / alpha^2 - 2, with alpha = roughness^2).
+func (m *Material) MetallicRoughness() (float32, float32) {
+	if m.PBR {
+		return m.Metallic, m.Roughness
+	}
+
+	alpha := math.Sqrt(2 / (float64(m.Shininess) + 2))
+	return 0, mgl32.Clamp(float32(math.Sqrt(alpha)), 0.05, 1)
 }
 
 func loadSOBJTexture(pbTex *pb.Texture) (*util.Texture, error) {
@@ -90,6 +120,13 @@ func LoadSOBJMaterial(m *pb.Material) (*Material, error) {
 		mat.Shininess = 32
 	}
 
+	if m.DiffuseColor != nil {
+		mat.Diffuse = util.PBVec3(m.DiffuseColor)
+	}
+	if m.EmissiveColor != nil {
+		mat.Emmissive = util.PBVec3(m.EmissiveColor)
+	}
+
 	var err error
 	if m.Diffuse != nil {
 		mat.DiffuseTexture, err = loadSOBJTexture(m.Diffuse)
@@ -102,6 +139,8 @@ func LoadSOBJMaterial(m *pb.Material) (*Material, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to load specular texture: %w", err)
 		}
+	} else if m.SpecularColor != nil {
+		mat.Specular = util.PBVec3(m.SpecularColor)
 	} else {
 		mat.Specular = mgl32.Vec3{0.3, 0.3, 0.3}
 	}
@@ -118,6 +157,24 @@ func LoadSOBJMaterial(m *pb.Material) (*Material, error) {
 		}
 	}
 
+	if m.Pbr {
+		mat.PBR = true
+		mat.Metallic = m.Metallic
+		mat.Roughness = m.Roughness
+	}
+	if m.MetallicRoughness != nil {
+		mat.MetallicRoughnessTexture, err = loadSOBJTexture(m.MetallicRoughness)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load metallic-roughness texture: %w", err)
+		}
+	}
+	if m.Occlusion != nil {
+		mat.OcclusionTexture, err = loadSOBJTexture(m.Occlusion)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load occlusion texture: %w", err)
+		}
+	}
+
 	return mat, nil
 }
 
@@ -136,15 +193,16 @@ type Mesh struct {
 	skinBuffer   *util.Buffer
 }
 
-// ReadOBJFile reads and parses a Wavefront .obj file
-func ReadOBJFile(objFile string) (*obj.Object, error) {
+// ReadOBJFile reads and parses a Wavefront .obj file (extra options can be
+// passed to handle additional statements)
+func ReadOBJFile(objFile string, opts ...obj.ReaderOption) (*obj.Object, error) {
 	f, err := os.Open(objFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file %v: %w", objFile, err)
 	}
 	defer f.Close()
 
-	obj, err := obj.NewReader(f).Read()
+	obj, err := obj.NewReader(f, opts...).Read()
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse: %w", err)
 	}
@@ -350,11 +408,8 @@ func v3NonZero(v mgl32.Vec3) mgl32.Vec3 {
 	return v
 }
 
-// Draw renders the mesh with the given shader and projection
-func (m *Mesh) Draw(p *util.Program, proj mgl32.Mat4, c *util.Camera, trans mgl32.Mat4, envMap *util.Texture, depthMaps *util.Texture) {
-	p.Use()
-	p.Project(proj, c, trans)
-
+// applyMaterial sets up the shader's material uniforms and textures
+func (m *Mesh) applyMaterial(p *util.Program, envMap *util.Texture, depthMaps *util.Texture) {
 	if m.Material != nil {
 		if m.Material.DiffuseTexture != nil {
 			m.Material.DiffuseTexture.Activate(p, "tex_diffuse", 0)
@@ -386,6 +441,25 @@ func (m *Mesh) Draw(p *util.Program, proj mgl32.Mat4, c *util.Camera, trans mgl3
 
 		p.SetUniformFloat32("m_shininess", m.Material.Shininess)
 		p.SetUniformFloat32("m_reflectiveness", m.Material.Reflectiveness)
+
+		metallic, roughness := m.Material.MetallicRoughness()
+		p.SetUniformBool("m_pbr", m.Material.PBR || ForcePBR)
+		p.SetUniformFloat32("m_metallic", metallic)
+		p.SetUniformFloat32("m_roughness", roughness)
+
+		if m.Material.MetallicRoughnessTexture != nil {
+			m.Material.MetallicRoughnessTexture.Activate(p, "tex_metallic_roughness", 13)
+			p.SetUniformBool("metallic_roughness_map", true)
+		} else {
+			p.SetUniformBool("metallic_roughness_map", false)
+		}
+
+		if m.Material.OcclusionTexture != nil {
+			m.Material.OcclusionTexture.Activate(p, "tex_occlusion", 14)
+			p.SetUniformBool("occlusion_map", true)
+		} else {
+			p.SetUniformBool("occlusion_map", false)
+		}
 	} else {
 		p.SetUniformFloat32("shininess", 16)
 	}
@@ -394,6 +468,13 @@ func (m *Mesh) Draw(p *util.Program, proj mgl32.Mat4, c *util.Camera, trans mgl3
 	if depthMaps != nil {
 		depthMaps.Activate(p, "depth_maps", 5)
 	}
+}
+
+// Draw renders the mesh with the given shader and projection
+func (m *Mesh) Draw(p *util.Program, proj mgl32.Mat4, c *util.Camera, trans mgl32.Mat4, envMap *util.Texture, depthMaps *util.Texture) {
+	p.Use()
+	p.Project(proj, c, trans)
+	m.applyMaterial(p, envMap, depthMaps)
 
 	gl.BindVertexArray(m.VAO)
 	if MeshWireFrame {
@@ -403,6 +484,22 @@ func (m *Mesh) Draw(p *util.Program, proj mgl32.Mat4, c *util.Camera, trans mgl3
 	gl.PolygonMode(gl.FRONT_AND_BACK, gl.FILL)
 }
 
+// DrawInstanced renders count instances of the mesh in a single draw call (the
+// shader is responsible for fetching per-instance transforms)
+func (m *Mesh) DrawInstanced(p *util.Program, proj mgl32.Mat4, c *util.Camera, count int, envMap *util.Texture, depthMaps *util.Texture) {
+	p.Use()
+	p.SetUniformMat4("projection", proj)
+	p.SetUniformMat4("camera", c.Transform())
+	m.applyMaterial(p, envMap, depthMaps)
+
+	gl.BindVertexArray(m.VAO)
+	if MeshWireFrame {
+		gl.PolygonMode(gl.FRONT_AND_BACK, gl.LINE)
+	}
+	gl.DrawElementsInstanced(gl.TRIANGLES, int32(len(m.Indices)), gl.UNSIGNED_INT, gl.PtrOffset(0), int32(count))
+	gl.PolygonMode(gl.FRONT_AND_BACK, gl.FILL)
+}
+
 // DepthMapPass renders the mesh only for depth information
 func (m *Mesh) DepthMapPass(p *util.Program, trans mgl32.Mat4, depthParamsApplicator util.DepthMapParamsApplicator) {
 	p.Use()
@@ -3,7 +3,11 @@ package object
 import (
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
 
+	"github.com/devplayer0/cs4052/pkg/gltf"
 	"github.com/devplayer0/cs4052/pkg/pb"
 	"github.com/devplayer0/cs4052/pkg/util"
 	"github.com/go-gl/gl/v4.6-core/gl"
@@ -17,48 +21,6 @@ type joint struct {
 	InverseBind mgl32.Mat4
 }
 
-type vec3Key struct {
-	Time  float32
-	Value mgl32.Vec3
-}
-type quatKey struct {
-	Time  float32
-	Value mgl32.Quat
-}
-type nodeAnim struct {
-	Pos   []vec3Key
-	Rot   []quatKey
-	Scale []vec3Key
-}
-
-func (a nodeAnim) findPos(t float32) (vec3Key, vec3Key) {
-	for i := 0; i < len(a.Pos)-1; i++ {
-		if t < a.Pos[i+1].Time {
-			return a.Pos[i], a.Pos[i+1]
-		}
-	}
-
-	return a.Pos[0], a.Pos[0]
-}
-func (a nodeAnim) findRot(t float32) (quatKey, quatKey) {
-	for i := 0; i < len(a.Rot)-1; i++ {
-		if t < a.Rot[i+1].Time {
-			return a.Rot[i], a.Rot[i+1]
-		}
-	}
-
-	return a.Rot[0], a.Rot[0]
-}
-func (a nodeAnim) findScale(t float32) (vec3Key, vec3Key) {
-	for i := 0; i < len(a.Scale)-1; i++ {
-		if t < a.Scale[i+1].Time {
-			return a.Scale[i], a.Scale[i+1]
-		}
-	}
-
-	return a.Scale[0], a.Scale[0]
-}
-
 type nodeDebug struct {
 	vao uint32
 
@@ -71,6 +33,16 @@ type node struct {
 	Transform mgl32.Mat4
 	Joint     *joint
 
+	// Rest pose, used for blending with animations that don't animate this node
+	restPos   mgl32.Vec3
+	restRot   mgl32.Quat
+	restScale mgl32.Vec3
+	// Set if this node's motion is extracted from animations
+	rootMotion *rootMotion
+
+	// Position in Object.nodes
+	index int
+
 	Parent   *node
 	Children []*node
 
@@ -81,6 +53,7 @@ func buildNodeHierarchy(pb *pb.Object, cnid uint32, anims []*Animation, current
 	cn := pb.Hierarchy[cnid]
 	current.Name = cn.Name
 	current.Transform = util.PBMat4(cn.Transform)
+	current.restPos, current.restRot, current.restScale = util.DecomposeTransform(current.Transform)
 
 	if cn.JointID != nil {
 		current.Joint = &joint{
@@ -92,31 +65,7 @@ func buildNodeHierarchy(pb *pb.Object, cnid uint32, anims []*Animation, current
 	for i, a := range pb.Animations {
 		for _, c := range a.Channels {
 			if c.NodeID == cnid {
-				aChan := nodeAnim{}
-
-				aChan.Pos = make([]vec3Key, len(c.PosFrames))
-				for j, p := range c.PosFrames {
-					aChan.Pos[j] = vec3Key{
-						Time:  p.Time,
-						Value: util.PBVec3(p.Value),
-					}
-				}
-				aChan.Rot = make([]quatKey, len(c.RotFrames))
-				for j, r := range c.RotFrames {
-					aChan.Rot[j] = quatKey{
-						Time:  r.Time,
-						Value: util.PBQuat(r.Value),
-					}
-				}
-				aChan.Scale = make([]vec3Key, len(c.ScaleFrames))
-				for j, s := range c.ScaleFrames {
-					aChan.Scale[j] = vec3Key{
-						Time:  s.Time,
-						Value: util.PBVec3(s.Value),
-					}
-				}
-
-				anims[i].channels[current] = aChan
+				anims[i].channels[current] = loadNodeAnim(c)
 			}
 		}
 	}
@@ -154,38 +103,106 @@ func (n *node) setupDebug(p *util.Program) {
 	}
 }
 
-type nodeTraverseCallback func(n *node, parent, local, final mgl32.Mat4)
+// local calculates the node's local transform with a set of animation layers
+// blended together
+func (n *node) local(layers []AnimationLayer) mgl32.Mat4 {
+	var pos, scale mgl32.Vec3
+	var rot mgl32.Quat
+	var total float32
+	animated := false
+	for _, l := range layers {
+		if l.Weight <= 0 {
+			continue
+		}
 
-func (n *node) traverse(parent mgl32.Mat4, anim *Animation, t float32, cb nodeTraverseCallback) {
-	local := n.Transform
-	if anim != nil {
-		if aChan, ok := anim.channels[n]; ok {
-			pa, pb := aChan.findPos(t)
-			pFactor := (t - pa.Time) / (pb.Time - pa.Time)
-			pVec := pa.Value.Add(pb.Value.Sub(pa.Value).Mul(pFactor))
-			pos := mgl32.Translate3D(pVec.X(), pVec.Y(), pVec.Z())
-
-			ra, rb := aChan.findRot(t)
-			rFactor := (t - ra.Time) / (rb.Time - ra.Time)
-			rot := util.QuatSlerp(ra.Value, rb.Value, rFactor).Normalize().Mat4()
-
-			sa, sb := aChan.findScale(t)
-			sFactor := (t - sa.Time) / (sb.Time - sa.Time)
-			sVec := util.InterpolateVec3(sa.Value, sb.Value, sFactor)
-			scale := mgl32.Scale3D(sVec.X(), sVec.Y(), sVec.Z())
-
-			local = pos.Mul4(rot).Mul4(scale)
+		// Layers without an animation (or which don't animate this node)
+		// contribute the rest pose
+		p, r, s := n.restPos, n.restRot, n.restScale
+		if l.Animation != nil {
+			if aChan, ok := l.Animation.channels[n]; ok {
+				p, r, s = aChan.sample(n, l.Animation.ticks(l.Time, l.Once), l.Animation.Duration, !l.Once)
+				if n.rootMotion != nil {
+					p, r = n.rootMotion.inPlace(n, aChan, l.Animation, p, r)
+				}
+				animated = true
+			}
 		}
+
+		total += l.Weight
+		pos = pos.Add(p.Mul(l.Weight))
+		scale = scale.Add(s.Mul(l.Weight))
+		if total == l.Weight {
+			rot = r
+		} else {
+			// Accumulate rotations by slerping towards each new one in proportion
+			// to its share of the total weight so far
+			rot = util.QuatSlerp(rot, r, l.Weight/total)
+		}
+	}
+	if !animated {
+		return n.Transform
 	}
 
-	final := parent.Mul4(local)
-	cb(n, parent, local, final)
+	pos = pos.Mul(1 / total)
+	scale = scale.Mul(1 / total)
+	return mgl32.Translate3D(pos.X(), pos.Y(), pos.Z()).
+		Mul4(rot.Normalize().Mat4()).
+		Mul4(mgl32.Scale3D(scale.X(), scale.Y(), scale.Z()))
+}
 
+// flatten lists the node and its descendants in pre-order (parents always
+// come before their children)
+func (n *node) flatten(nodes []*node) []*node {
+	n.index = len(nodes)
+	nodes = append(nodes, n)
 	for _, c := range n.Children {
-		c.traverse(final, anim, t, cb)
+		nodes = c.flatten(nodes)
+	}
+
+	return nodes
+}
+
+// pose holds the local and final (world space) transforms of each node,
+// indexed the same as Object.nodes
+type pose struct {
+	local []mgl32.Mat4
+	final []mgl32.Mat4
+}
+
+func newPose(n int) *pose {
+	return &pose{
+		local: make([]mgl32.Mat4, n),
+		final: make([]mgl32.Mat4, n),
+	}
+}
+
+// parentFinal returns the final transform of n's parent (or the object's
+// transform for the root)
+func (p *pose) parentFinal(n *node, trans mgl32.Mat4) mgl32.Mat4 {
+	if n.Parent == nil {
+		return trans
+	}
+
+	return p.final[n.Parent.index]
+}
+
+// updateFinal recalculates the final transforms of the nodes from index i
+// onwards (which includes all of the descendants of node i)
+func (p *pose) updateFinal(nodes []*node, trans mgl32.Mat4, i int) {
+	for _, n := range nodes[i:] {
+		p.final[n.index] = p.parentFinal(n, trans).Mul4(p.local[n.index])
 	}
 }
 
+// evaluate calculates the pose of the nodes for a blend of animation layers
+func (p *pose) evaluate(nodes []*node, trans mgl32.Mat4, layers []AnimationLayer) {
+	for _, n := range nodes {
+		p.local[n.index] = n.local(layers)
+	}
+
+	p.updateFinal(nodes, trans, 0)
+}
+
 // Animation represents a skeletal animation
 type Animation struct {
 	Name     string
@@ -193,6 +210,23 @@ type Animation struct {
 	TPS      float32
 
 	channels map[*node]nodeAnim
+	// Events sorted by time
+	Events []AnimationEvent
+}
+
+// ticks converts a time in seconds to a position in the animation, either
+// looped or clamped to the end
+func (a *Animation) ticks(t float32, once bool) float32 {
+	if once {
+		return mgl32.Clamp(t*a.TPS, 0, a.Duration)
+	}
+
+	return util.Mod(t*a.TPS, a.Duration)
+}
+
+// Length returns the duration of the animation in seconds
+func (a *Animation) Length() float32 {
+	return a.Duration / a.TPS
 }
 
 type meshInstance struct {
@@ -210,6 +244,8 @@ type Object struct {
 	materials  []*Material
 	meshes     []*Mesh
 	hierarchy  *node
+	nodes      []*node
+	jointCount int
 	Animations []*Animation
 	instances  []meshInstance
 
@@ -217,8 +253,12 @@ type Object struct {
 	debugShader *util.Program
 
 	currentTransforms []mgl32.Mat4
-	currentAnim       *Animation
-	currentATime      float32
+	currentLayers     []AnimationLayer
+	// Pose from the last update (its joints are currentTransforms)
+	current *Pose
+
+	rootMotionNode *node
+	ikChains       []*IKChain
 }
 
 // NewObject creates a new object
@@ -231,8 +271,12 @@ func NewObject(obj *pb.Object, shader, depthShader, ds *util.Program) (*Object,
 
 		debugShader: ds,
 
+		jointCount:        len(obj.Joints),
 		currentTransforms: make([]mgl32.Mat4, MaxJoints),
 	}
+	if o.jointCount > MaxJoints {
+		return nil, fmt.Errorf("too many joints (%v, maximum is %v)", o.jointCount, MaxJoints)
+	}
 
 	for _, m := range obj.Materials {
 		mat, err := LoadSOBJMaterial(m)
@@ -258,11 +302,24 @@ func NewObject(obj *pb.Object, shader, depthShader, ds *util.Program) (*Object,
 
 			channels: make(map[*node]nodeAnim),
 		}
+		for _, e := range a.Events {
+			ca.Events = append(ca.Events, AnimationEvent{Name: e.Name, Time: e.Time})
+		}
+		sort.Slice(ca.Events, func(i, j int) bool {
+			return ca.Events[i].Time < ca.Events[j].Time
+		})
 
 		o.Animations = append(o.Animations, ca)
 	}
 
 	buildNodeHierarchy(obj, 0, o.Animations, o.hierarchy)
+	o.nodes = o.hierarchy.flatten(nil)
+	o.current = &Pose{
+		nodes:  newPose(len(o.nodes)),
+		joints: o.currentTransforms,
+		trans:  mgl32.Ident4(),
+	}
+	o.current.nodes.evaluate(o.nodes, o.current.trans, nil)
 	if ds != nil {
 		o.hierarchy.setupDebug(ds)
 	}
@@ -279,8 +336,19 @@ func NewObject(obj *pb.Object, shader, depthShader, ds *util.Program) (*Object,
 	return o, nil
 }
 
-// NewObjectFile creates a new object from a file
+// NewObjectFile creates a new object from a file (either a .sobj or a glTF 2.0
+// .gltf / .glb)
 func NewObjectFile(objFile string, shader, depthShader, ds *util.Program) (*Object, error) {
+	switch strings.ToLower(filepath.Ext(objFile)) {
+	case ".gltf", ".glb":
+		obj, err := gltf.ConvertFile(objFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to import glTF: %w", err)
+		}
+
+		return NewObject(obj, shader, depthShader, ds)
+	}
+
 	data, err := ioutil.ReadFile(objFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file: %w", err)
@@ -294,21 +362,42 @@ func NewObjectFile(objFile string, shader, depthShader, ds *util.Program) (*Obje
 	return NewObject(&obj, shader, depthShader, ds)
 }
 
-// Update updates the state of each of the object's joint transforms
-func (o *Object) Update(proj mgl32.Mat4, cam *util.Camera, trans mgl32.Mat4, anim *Animation, t float32) {
-	o.currentAnim = anim
-	if anim != nil {
-		o.currentATime = util.Mod(t*anim.TPS, anim.Duration)
-	} else {
-		o.currentATime = 0
+// FindAnimation looks up an animation by name (returning nil if it doesn't
+// exist)
+func (o *Object) FindAnimation(name string) *Animation {
+	for _, a := range o.Animations {
+		if a.Name == name {
+			return a
+		}
 	}
 
-	invTrans := trans.Inv()
-	o.hierarchy.traverse(trans, o.currentAnim, o.currentATime, func(n *node, parent, local, final mgl32.Mat4) {
-		if n.Joint != nil {
-			o.currentTransforms[n.Joint.ID] = invTrans.Mul4(final).Mul4(n.Joint.InverseBind)
+	return nil
+}
+
+// Update updates the state of each of the object's joint transforms, returning
+// any animation events crossed and the root motion extracted since the
+// previous update
+func (o *Object) Update(proj mgl32.Mat4, cam *util.Camera, trans mgl32.Mat4, anim *Animation, t float32) ([]TriggeredEvent, RootMotion) {
+	var layers []AnimationLayer
+	if anim != nil {
+		prev, first := t, true
+		if len(o.currentLayers) == 1 && o.currentLayers[0].Animation == anim && o.currentLayers[0].Time <= t {
+			prev, first = o.currentLayers[0].Time, false
 		}
-	})
+
+		layers = []AnimationLayer{{Animation: anim, Time: t, PrevTime: prev, First: first, Weight: 1}}
+	}
+
+	return o.UpdateBlend(proj, cam, trans, layers)
+}
+
+// UpdateBlend updates the state of each of the object's joint transforms with
+// a weighted blend of animations, returning any animation events crossed and
+// the root motion extracted since each layer's previous time
+func (o *Object) UpdateBlend(proj mgl32.Mat4, cam *util.Camera, trans mgl32.Mat4, layers []AnimationLayer) ([]TriggeredEvent, RootMotion) {
+	o.currentLayers = append(o.currentLayers[:0], layers...)
+
+	return o.Evaluate(o.current, trans, layers)
 }
 
 // DepthMapPass renders the object only for depth information
@@ -337,7 +426,14 @@ func (o *Object) Draw(proj mgl32.Mat4, cam *util.Camera, trans mgl32.Mat4, envMa
 	}
 
 	if o.Debug && o.debugShader != nil {
-		o.hierarchy.traverse(trans, o.currentAnim, o.currentATime, func(n *node, parent, local, final mgl32.Mat4) {
+		// Draw the pose from the last update, moved to the current transform
+		p := o.current.nodes
+		offset := trans.Mul4(o.current.trans.Inv())
+		for _, n := range o.nodes {
+			final := offset.Mul4(p.final[n.index])
+			parent := offset.Mul4(p.parentFinal(n, o.current.trans))
+			local := p.local[n.index]
+
 			o.debugShader.Use()
 			o.debugShader.Project(proj, cam, final.Mul4(mgl32.Scale3D(0.05, 0.05, 0.05)))
 			gl.BindVertexArray(n.debug.vao)
@@ -353,6 +449,6 @@ func (o *Object) Draw(proj mgl32.Mat4, cam *util.Camera, trans mgl32.Mat4, envMa
 				})
 				gl.DrawArrays(gl.LINES, 0, 2)
 			}
-		})
+		}
 	}
 }
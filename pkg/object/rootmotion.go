@@ -0,0 +1,245 @@
+package object
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/go-gl/mathgl/mgl32"
+
+	"github.com/devplayer0/cs4052/pkg/util"
+)
+
+// RootMotionMode selects which parts of the root node's animation are
+// extracted from the pose and returned as motion instead
+type RootMotionMode int
+
+const (
+	// RootMotionNone applies the root node's animation as-is
+	RootMotionNone RootMotionMode = iota
+	// RootMotionTranslation extracts horizontal (X / Z) translation
+	RootMotionTranslation
+	// RootMotionFull extracts horizontal translation and rotation about the
+	// vertical (Y) axis
+	RootMotionFull
+)
+
+// RootMotion is the movement of an object's root node extracted during an
+// update
+type RootMotion struct {
+	// Translation in object space, relative to the object's facing at the
+	// start of the update
+	Translation mgl32.Vec3
+	// Yaw is the rotation about the Y axis in radians
+	Yaw float32
+}
+
+// Mat4 returns the motion as a transform, to be applied to the object's
+// transform as trans.Mul4(m.Mat4())
+func (m RootMotion) Mat4() mgl32.Mat4 {
+	return util.TransFromPos(m.Translation).Mul4(mgl32.HomogRotate3DY(m.Yaw))
+}
+
+// then combines the motion with another which follows it
+func (m RootMotion) then(o RootMotion) RootMotion {
+	return RootMotion{
+		Translation: m.Translation.Add(mgl32.QuatRotate(m.Yaw, mgl32.Vec3{0, 1, 0}).Rotate(o.Translation)),
+		Yaw:         m.Yaw + o.Yaw,
+	}
+}
+
+type rootMotion struct {
+	mode RootMotionMode
+
+	// Rest transform of the root node's parent (in object space), used to
+	// find the root's horizontal position and facing
+	parent    mgl32.Mat4
+	invParent mgl32.Mat4
+	parentRot mgl32.Quat
+}
+
+// yaw finds the rotation of q about the Y axis (the twist component)
+func yaw(q mgl32.Quat) float32 {
+	return 2 * util.Atan2(q.Y(), q.W)
+}
+
+// wrapAngle wraps an angle to [-π, π]
+func wrapAngle(a float32) float32 {
+	for a > math.Pi {
+		a -= 2 * math.Pi
+	}
+	for a < -math.Pi {
+		a += 2 * math.Pi
+	}
+
+	return a
+}
+
+// objectSpace finds the root's horizontal position and yaw in object space
+func (rm *rootMotion) objectSpace(p mgl32.Vec3, r mgl32.Quat) (mgl32.Vec3, float32) {
+	op := rm.parent.Mul4x1(p.Vec4(1)).Vec3()
+	op[1] = 0
+
+	var y float32
+	if rm.mode == RootMotionFull {
+		y = yaw(rm.parentRot.Mul(r))
+	}
+	return op, y
+}
+
+// inPlace removes the motion accumulated since the start of the animation
+// from a sample of the root node
+func (rm *rootMotion) inPlace(n *node, aChan nodeAnim, anim *Animation, p mgl32.Vec3, r mgl32.Quat) (mgl32.Vec3, mgl32.Quat) {
+	p0, r0, _ := aChan.sample(n, 0, anim.Duration, false)
+	h0, y0 := rm.objectSpace(p0, r0)
+	h, y := rm.objectSpace(p, r)
+
+	op := rm.parent.Mul4x1(p.Vec4(1)).Vec3().Sub(h).Add(h0)
+	p = rm.invParent.Mul4x1(op.Vec4(1)).Vec3()
+	if rm.mode == RootMotionFull {
+		undo := mgl32.QuatRotate(y0-y, mgl32.Vec3{0, 1, 0})
+		r = rm.parentRot.Inverse().Mul(undo).Mul(rm.parentRot).Mul(r)
+	}
+
+	return p, r
+}
+
+// segment calculates the motion between two times (in ticks) in an animation
+func (rm *rootMotion) segment(n *node, aChan nodeAnim, anim *Animation, from, to float32) RootMotion {
+	pa, ra, _ := aChan.sample(n, from, anim.Duration, false)
+	pb, rb, _ := aChan.sample(n, to, anim.Duration, false)
+	ha, ya := rm.objectSpace(pa, ra)
+	hb, yb := rm.objectSpace(pb, rb)
+
+	return RootMotion{
+		Translation: mgl32.QuatRotate(-ya, mgl32.Vec3{0, 1, 0}).Rotate(hb.Sub(ha)),
+		Yaw:         wrapAngle(yb - ya),
+	}
+}
+
+// motion calculates the motion of the root node in an animation layer since
+// its previous time
+func (rm *rootMotion) motion(n *node, l AnimationLayer) RootMotion {
+	anim := l.Animation
+	aChan, ok := anim.channels[n]
+	if !ok || l.Time <= l.PrevTime {
+		return RootMotion{}
+	}
+
+	if l.Once {
+		return rm.segment(n, aChan, anim, anim.ticks(l.PrevTime, true), anim.ticks(l.Time, true))
+	}
+
+	from, to := l.PrevTime*anim.TPS, l.Time*anim.TPS
+	loops := int(util.Floor(to/anim.Duration) - util.Floor(from/anim.Duration))
+	from, to = util.Mod(from, anim.Duration), util.Mod(to, anim.Duration)
+	if loops == 0 {
+		return rm.segment(n, aChan, anim, from, to)
+	}
+
+	m := rm.segment(n, aChan, anim, from, anim.Duration)
+	full := rm.segment(n, aChan, anim, 0, anim.Duration)
+	for i := 1; i < loops; i++ {
+		m = m.then(full)
+	}
+	return m.then(rm.segment(n, aChan, anim, 0, to))
+}
+
+// rootMotion calculates the weighted root motion of a set of animation layers
+func (o *Object) rootMotion(layers []AnimationLayer) RootMotion {
+	n := o.rootMotionNode
+	if n == nil {
+		return RootMotion{}
+	}
+
+	var m RootMotion
+	var total float32
+	for _, l := range layers {
+		if l.Weight <= 0 {
+			continue
+		}
+
+		total += l.Weight
+		if l.Animation == nil {
+			continue
+		}
+
+		lm := n.rootMotion.motion(n, l)
+		m.Translation = m.Translation.Add(lm.Translation.Mul(l.Weight))
+		m.Yaw += lm.Yaw * l.Weight
+	}
+	if total == 0 {
+		return RootMotion{}
+	}
+
+	m.Translation = m.Translation.Mul(1 / total)
+	m.Yaw /= total
+	return m
+}
+
+func (n *node) find(name string) *node {
+	if n.Name == name {
+		return n
+	}
+	for _, c := range n.Children {
+		if f := c.find(name); f != nil {
+			return f
+		}
+	}
+
+	return nil
+}
+
+// skeletonRoot finds the first node (breadth first) which is a joint
+func (n *node) skeletonRoot() *node {
+	queue := []*node{n}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		if c.Joint != nil {
+			return c
+		}
+
+		queue = append(queue, c.Children...)
+	}
+
+	return nil
+}
+
+// SetRootMotion enables extraction of the motion of the named node (or the
+// root of the skeleton if empty) from animations. The extracted motion is
+// returned by Update / UpdateBlend instead of being applied to the pose.
+func (o *Object) SetRootMotion(name string, mode RootMotionMode) error {
+	if o.rootMotionNode != nil {
+		o.rootMotionNode.rootMotion = nil
+		o.rootMotionNode = nil
+	}
+	if mode == RootMotionNone {
+		return nil
+	}
+
+	var n *node
+	if name == "" {
+		n = o.hierarchy.skeletonRoot()
+	} else {
+		n = o.hierarchy.find(name)
+	}
+	if n == nil {
+		return fmt.Errorf("root motion node %q not found", name)
+	}
+
+	parent := mgl32.Ident4()
+	for p := n.Parent; p != nil; p = p.Parent {
+		parent = p.Transform.Mul4(parent)
+	}
+	_, parentRot, _ := util.DecomposeTransform(parent)
+
+	n.rootMotion = &rootMotion{
+		mode: mode,
+
+		parent:    parent,
+		invParent: parent.Inv(),
+		parentRot: parentRot,
+	}
+	o.rootMotionNode = n
+	return nil
+}
@@ -0,0 +1,134 @@
+package object
+
+import "github.com/go-gl/mathgl/mgl32"
+
+// SpeciesRelation describes how boids of one species react to boids of
+// another within their perception
+type SpeciesRelation struct {
+	Other *Boids
+	// Flee is the weight of steering away from the other species (e.g. prey
+	// avoiding predators)
+	Flee float32
+	// Chase is the weight of steering towards the nearest boid of the other
+	// species (e.g. predators hunting prey)
+	Chase float32
+	// Separate includes the other species in the separation rule
+	Separate bool
+}
+
+// relation finds the relation to another species (nil if there isn't one)
+func (bs *Boids) relation(other *Boids) *SpeciesRelation {
+	for i := range bs.Relations {
+		if bs.Relations[i].Other == other {
+			return &bs.Relations[i]
+		}
+	}
+
+	return nil
+}
+
+// separates checks if the separation rule applies to boids of a species
+func (bs *Boids) separates(other *Boids) bool {
+	if other == bs {
+		return true
+	}
+
+	r := bs.relation(other)
+	return r != nil && r.Separate
+}
+
+// Interact applies each of the species relations, steering the boid away from
+// or towards other species
+func (b *Boid) Interact(bs *Boids) {
+	for i := range bs.Relations {
+		r := &bs.Relations[i]
+		if r.Flee == 0 && r.Chase == 0 {
+			continue
+		}
+
+		var away mgl32.Vec3
+		var nearest *Boid
+		var nearestDistance float32
+		for _, nb := range b.nearby {
+			if nb.boid.species != r.Other || nb.distance > bs.Perception || nb.distance == 0 {
+				continue
+			}
+
+			// Closer boids are more threatening
+			away = away.Sub(nb.diff.Mul(1 / (nb.distance * nb.distance)))
+			if nearest == nil || nb.distance < nearestDistance {
+				nearest, nearestDistance = nb.boid, nb.distance
+			}
+		}
+		if nearest == nil {
+			continue
+		}
+
+		if r.Flee != 0 && away.Len() > 1e-6 {
+			flee := steerTowards(b, away.Normalize().Mul(bs.MaxSpeed))
+			b.Acceleration = b.Acceleration.Add(limit(flee, bs.MaxForce).Mul(r.Flee))
+		}
+		if r.Chase != 0 {
+			chase := seek(b, bs, nearest.Position)
+			b.Acceleration = b.Acceleration.Add(limit(chase, bs.MaxForce).Mul(r.Chase))
+		}
+	}
+}
+
+// BoidSimulation simulates multiple species of boids together, so that they
+// can react to each other
+type BoidSimulation struct {
+	Species []*Boids
+	// Step is the fixed time step the simulation advances by (each species'
+	// own step is ignored)
+	Step float32
+	// Workers is the maximum number of goroutines to update each species with
+	// (0 to use GOMAXPROCS)
+	Workers int
+
+	accumulator float32
+	grid        *spatialGrid
+	all         []*Boid
+}
+
+// NewBoidSimulation creates a simulation of the given species. The species
+// share a spatial grid and should only be updated through the simulation.
+func NewBoidSimulation(species ...*Boids) *BoidSimulation {
+	s := &BoidSimulation{
+		Species: species,
+		Step:    DefaultBoidStep,
+
+		grid: &spatialGrid{},
+	}
+	for _, bs := range species {
+		bs.grid = s.grid
+	}
+
+	return s
+}
+
+// Update advances the simulation by dt seconds in fixed steps (any remainder
+// is carried over to the next update)
+func (s *BoidSimulation) Update(dt float32) {
+	fixedSteps(&s.accumulator, dt, s.Step, func() {
+		var radius float32
+		s.all = s.all[:0]
+		for _, bs := range s.Species {
+			bs.claim()
+			s.all = append(s.all, bs.Instances...)
+
+			if r := bs.radius(); r > radius {
+				radius = r
+			}
+		}
+		s.grid.rebuild(s.all, radius)
+
+		for _, bs := range s.Species {
+			bs.step(s.Step, s.Workers)
+		}
+		// Only move the boids once every species has seen where they were
+		for _, bs := range s.Species {
+			bs.commit()
+		}
+	})
+}
@@ -0,0 +1,336 @@
+package object
+
+import (
+	"math"
+
+	"github.com/go-gl/mathgl/mgl32"
+
+	"github.com/devplayer0/cs4052/pkg/util"
+)
+
+// SteeringBehaviour calculates a steering acceleration for a boid (which is
+// limited to the flock's MaxForce)
+type SteeringBehaviour interface {
+	Steer(b *Boid, bs *Boids) mgl32.Vec3
+}
+
+// WeightedBehaviour is a steering behaviour and the weight its acceleration is
+// scaled by before being combined with the others
+type WeightedBehaviour struct {
+	Behaviour SteeringBehaviour
+	Weight    float32
+}
+
+// limit clamps the length of v to max
+func limit(v mgl32.Vec3, max float32) mgl32.Vec3 {
+	if l := v.Len(); l > max {
+		return v.Mul(max / l)
+	}
+
+	return v
+}
+
+// steerTowards calculates the acceleration to change a boid's velocity to
+// desired
+func steerTowards(b *Boid, desired mgl32.Vec3) mgl32.Vec3 {
+	return desired.Sub(b.Velocity)
+}
+
+// seek calculates the acceleration to head towards target at full speed
+func seek(b *Boid, bs *Boids, target mgl32.Vec3) mgl32.Vec3 {
+	diff := target.Sub(b.Position)
+	if diff.Len() < 1e-6 {
+		return mgl32.Vec3{}
+	}
+
+	return steerTowards(b, diff.Normalize().Mul(bs.MaxSpeed))
+}
+
+// Seek steers boids towards a target
+type Seek struct {
+	Target mgl32.Vec3
+}
+
+// Steer implements SteeringBehaviour
+func (s *Seek) Steer(b *Boid, bs *Boids) mgl32.Vec3 {
+	return seek(b, bs, s.Target)
+}
+
+// Flee steers boids away from a target
+type Flee struct {
+	Target mgl32.Vec3
+	// Radius beyond which boids ignore the target (0 for no limit)
+	Radius float32
+}
+
+// Steer implements SteeringBehaviour
+func (f *Flee) Steer(b *Boid, bs *Boids) mgl32.Vec3 {
+	away := b.Position.Sub(f.Target)
+	if (f.Radius > 0 && away.Len() > f.Radius) || away.Len() < 1e-6 {
+		return mgl32.Vec3{}
+	}
+
+	return steerTowards(b, away.Normalize().Mul(bs.MaxSpeed))
+}
+
+// Arrive steers boids towards a target, slowing down as they approach it
+type Arrive struct {
+	Target mgl32.Vec3
+	// SlowingRadius is the distance from the target to start slowing down at
+	SlowingRadius float32
+}
+
+// Steer implements SteeringBehaviour
+func (a *Arrive) Steer(b *Boid, bs *Boids) mgl32.Vec3 {
+	diff := a.Target.Sub(b.Position)
+	d := diff.Len()
+	if d < 1e-6 {
+		return steerTowards(b, mgl32.Vec3{})
+	}
+
+	speed := bs.MaxSpeed
+	if d < a.SlowingRadius {
+		speed *= d / a.SlowingRadius
+	}
+	return steerTowards(b, diff.Mul(speed/d))
+}
+
+// Wander steers boids randomly, by seeking a point which moves around a circle
+// in front of each boid
+type Wander struct {
+	// Radius of the circle
+	Radius float32
+	// Distance of the circle's centre in front of the boid
+	Distance float32
+	// Jitter is how far (per second) the point can move around the circle
+	Jitter float32
+}
+
+// Steer implements SteeringBehaviour
+func (w *Wander) Steer(b *Boid, bs *Boids) mgl32.Vec3 {
+	jitter := w.Jitter * bs.dt
+	b.wander = b.wander.Add(mgl32.Vec3{
+		(2*b.random() - 1) * jitter,
+		(2*b.random() - 1) * jitter,
+		(2*b.random() - 1) * jitter,
+	})
+	// Stay in the plane the flock moves in
+	for i := 0; i < 3; i++ {
+		if bs.Bounds.Min[i] == bs.Bounds.Max[i] {
+			b.wander[i] = 0
+		}
+	}
+	if b.wander.Len() < 1e-6 {
+		b.wander = mgl32.Vec3{1, 0, 0}
+	}
+	b.wander = b.wander.Normalize().Mul(w.Radius)
+
+	forward := mgl32.Vec3{1, 0, 0}
+	if b.Velocity.Len() > 1e-6 {
+		forward = b.Velocity.Normalize()
+	}
+	return seek(b, bs, b.Position.Add(forward.Mul(w.Distance)).Add(b.wander))
+}
+
+// Obstacle is something boids can steer around
+type Obstacle interface {
+	// Avoid checks if the segment from -> to hits the obstacle, returning the
+	// direction to steer away in and the distance along the segment of the
+	// hit
+	Avoid(from, to mgl32.Vec3) (away mgl32.Vec3, distance float32, hit bool)
+}
+
+// SphereObstacle is a spherical obstacle
+type SphereObstacle struct {
+	Centre mgl32.Vec3
+	Radius float32
+}
+
+// Avoid implements Obstacle
+func (s SphereObstacle) Avoid(from, to mgl32.Vec3) (mgl32.Vec3, float32, bool) {
+	seg := to.Sub(from)
+	length := seg.Len()
+	if length < 1e-6 {
+		return mgl32.Vec3{}, 0, false
+	}
+	dir := seg.Mul(1 / length)
+
+	// Closest point on the segment to the centre
+	t := mgl32.Clamp(s.Centre.Sub(from).Dot(dir), 0, length)
+	closest := from.Add(dir.Mul(t))
+
+	offset := closest.Sub(s.Centre)
+	if offset.Len() > s.Radius {
+		return mgl32.Vec3{}, 0, false
+	}
+	// Steer sideways, away from the centre
+	away := offset.Sub(dir.Mul(offset.Dot(dir)))
+	if away.Len() < 1e-6 {
+		away = perpendicular(dir)
+	}
+
+	return away.Normalize(), t, true
+}
+
+// BoxObstacle is an axis-aligned box obstacle
+type BoxObstacle struct {
+	util.Bounds
+}
+
+// boxSamples is the number of points along the segment checked against a box
+const boxSamples = 4
+
+// Avoid implements Obstacle
+func (o BoxObstacle) Avoid(from, to mgl32.Vec3) (mgl32.Vec3, float32, bool) {
+	seg := to.Sub(from)
+	for i := 0; i <= boxSamples; i++ {
+		t := float32(i) / boxSamples
+		p := from.Add(seg.Mul(t))
+		if !o.contains(p) {
+			continue
+		}
+
+		// Push out through the nearest face
+		var away mgl32.Vec3
+		nearest := float32(math.MaxFloat32)
+		for a := 0; a < 3; a++ {
+			if d := p[a] - o.Min[a]; d < nearest {
+				nearest = d
+				away = mgl32.Vec3{}
+				away[a] = -1
+			}
+			if d := o.Max[a] - p[a]; d < nearest {
+				nearest = d
+				away = mgl32.Vec3{}
+				away[a] = 1
+			}
+		}
+
+		return away, t * seg.Len(), true
+	}
+
+	return mgl32.Vec3{}, 0, false
+}
+
+func (o BoxObstacle) contains(p mgl32.Vec3) bool {
+	for a := 0; a < 3; a++ {
+		if p[a] < o.Min[a] || p[a] > o.Max[a] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// AvoidObstacles steers boids away from the nearest obstacle in front of them
+type AvoidObstacles struct {
+	Obstacles []Obstacle
+	// Lookahead is how far in front of a boid to check for obstacles
+	Lookahead float32
+}
+
+// Steer implements SteeringBehaviour
+func (ao *AvoidObstacles) Steer(b *Boid, bs *Boids) mgl32.Vec3 {
+	if b.Velocity.Len() < 1e-6 {
+		return mgl32.Vec3{}
+	}
+	ahead := b.Position.Add(b.Velocity.Normalize().Mul(ao.Lookahead))
+
+	var away mgl32.Vec3
+	nearest := float32(math.MaxFloat32)
+	for _, o := range ao.Obstacles {
+		if a, d, hit := o.Avoid(b.Position, ahead); hit && d < nearest {
+			away, nearest = a, d
+		}
+	}
+	if nearest == math.MaxFloat32 {
+		return mgl32.Vec3{}
+	}
+
+	// Steer harder the closer the obstacle is
+	return away.Mul(bs.MaxForce * (1 - nearest/ao.Lookahead))
+}
+
+// Contain softly keeps boids within bounds, steering them back in as they get
+// within Margin of the edge. Flat axes (where the bounds have no size) are
+// ignored.
+type Contain struct {
+	Bounds util.Bounds
+	Margin float32
+}
+
+// Steer implements SteeringBehaviour
+func (c *Contain) Steer(b *Boid, bs *Boids) mgl32.Vec3 {
+	var steer mgl32.Vec3
+	for a := 0; a < 3; a++ {
+		if c.Bounds.Min[a] == c.Bounds.Max[a] {
+			continue
+		}
+
+		if d := c.Bounds.Min[a] + c.Margin - b.Position[a]; d > 0 {
+			steer[a] += mgl32.Clamp(d/c.Margin, 0, 1)
+		}
+		if d := b.Position[a] - (c.Bounds.Max[a] - c.Margin); d > 0 {
+			steer[a] -= mgl32.Clamp(d/c.Margin, 0, 1)
+		}
+	}
+
+	return steer.Mul(bs.MaxForce)
+}
+
+// FollowPath steers boids along a path of points
+type FollowPath struct {
+	Points []mgl32.Vec3
+	// Loop joins the last point back to the first
+	Loop bool
+	// Radius is how far boids can stray from the path before steering back
+	Radius float32
+	// Lookahead is how far ahead (along both the boid's velocity and the
+	// path) to steer towards
+	Lookahead float32
+}
+
+// Steer implements SteeringBehaviour
+func (fp *FollowPath) Steer(b *Boid, bs *Boids) mgl32.Vec3 {
+	n := len(fp.Points)
+	if n == 0 {
+		return mgl32.Vec3{}
+	}
+	if n == 1 {
+		return seek(b, bs, fp.Points[0])
+	}
+
+	predicted := b.Position
+	if b.Velocity.Len() > 1e-6 {
+		predicted = predicted.Add(b.Velocity.Normalize().Mul(fp.Lookahead))
+	}
+
+	segments := n - 1
+	if fp.Loop {
+		segments = n
+	}
+
+	var target mgl32.Vec3
+	nearest := float32(math.MaxFloat32)
+	for i := 0; i < segments; i++ {
+		a, c := fp.Points[i], fp.Points[(i+1)%n]
+		seg := c.Sub(a)
+		length := seg.Len()
+		if length < 1e-6 {
+			continue
+		}
+		dir := seg.Mul(1 / length)
+
+		t := mgl32.Clamp(predicted.Sub(a).Dot(dir), 0, length)
+		if d := a.Add(dir.Mul(t)).Sub(predicted).Len(); d < nearest {
+			nearest = d
+			// Aim further along the path (without going past the segment)
+			target = a.Add(dir.Mul(mgl32.Clamp(t+fp.Lookahead, 0, length)))
+		}
+	}
+
+	if nearest <= fp.Radius {
+		return mgl32.Vec3{}
+	}
+	return seek(b, bs, target)
+}
@@ -0,0 +1,44 @@
+package object
+
+import (
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+func TestFleeSteer(t *testing.T) {
+	bs := &Boids{MaxSpeed: 2}
+	f := &Flee{Target: mgl32.Vec3{10, 0, 0}}
+
+	tests := []struct {
+		name     string
+		position mgl32.Vec3
+		velocity mgl32.Vec3
+		expected mgl32.Vec3
+	}{
+		// Turn all the way around
+		{"head on", mgl32.Vec3{0, 0, 0}, mgl32.Vec3{2, 0, 0}, mgl32.Vec3{-4, 0, 0}},
+		// Already going as fast as possible in the right direction
+		{"already fleeing", mgl32.Vec3{0, 0, 0}, mgl32.Vec3{-2, 0, 0}, mgl32.Vec3{0, 0, 0}},
+		{"stationary", mgl32.Vec3{0, 0, 0}, mgl32.Vec3{}, mgl32.Vec3{-2, 0, 0}},
+		{"at the target", mgl32.Vec3{10, 0, 0}, mgl32.Vec3{1, 0, 0}, mgl32.Vec3{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Boid{Position: tt.position, Velocity: tt.velocity}
+			if got := f.Steer(b, bs); !got.ApproxEqual(tt.expected) {
+				t.Errorf("got %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFleeRadius(t *testing.T) {
+	bs := &Boids{MaxSpeed: 2}
+	f := &Flee{Target: mgl32.Vec3{10, 0, 0}, Radius: 5}
+
+	b := &Boid{Velocity: mgl32.Vec3{2, 0, 0}}
+	if got := f.Steer(b, bs); got != (mgl32.Vec3{}) {
+		t.Errorf("got %v outside the radius, expected nothing", got)
+	}
+}
@@ -0,0 +1,321 @@
+package scene
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/go-gl/mathgl/mgl32"
+
+	"github.com/devplayer0/cs4052/pkg/util"
+)
+
+// TransformDesc describes a transform as a translation, rotation (Euler angles
+// in degrees, applied in XYZ order) and scale
+type TransformDesc struct {
+	Translate mgl32.Vec3 `json:"translate"`
+	Rotate    mgl32.Vec3 `json:"rotate"`
+	Scale     mgl32.Vec3 `json:"scale"`
+}
+
+// Mat4 computes the transformation matrix for the transform
+func (t TransformDesc) Mat4() mgl32.Mat4 {
+	scale := t.Scale
+	if scale == (mgl32.Vec3{}) {
+		scale = mgl32.Vec3{1, 1, 1}
+	}
+
+	rot := mgl32.AnglesToQuat(
+		mgl32.DegToRad(t.Rotate.X()),
+		mgl32.DegToRad(t.Rotate.Y()),
+		mgl32.DegToRad(t.Rotate.Z()),
+		mgl32.XYZ,
+	)
+
+	return util.TransFromPos(t.Translate).
+		Mul4(rot.Mat4()).
+		Mul4(mgl32.Scale3D(scale.X(), scale.Y(), scale.Z()))
+}
+
+// AnimationRef refers to one of an object's animations, either by index (a
+// JSON number) or by name (a JSON string)
+type AnimationRef struct {
+	Index int
+	Name  string
+}
+
+// UnmarshalJSON parses an animation reference from a number or string
+func (r *AnimationRef) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &r.Index); err == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, &r.Name); err != nil {
+		return fmt.Errorf("animation reference must be an index or name")
+	}
+
+	return nil
+}
+
+// OrbitDesc describes a lamp which orbits a point on the Y axis
+type OrbitDesc struct {
+	Centre mgl32.Vec3 `json:"centre"`
+	Radius float32    `json:"radius"`
+	// Angular speed in radians per second
+	Speed float32 `json:"speed"`
+}
+
+// PatrolDesc describes a lamp which moves back and forth between two points
+type PatrolDesc struct {
+	From mgl32.Vec3 `json:"from"`
+	To   mgl32.Vec3 `json:"to"`
+	// Speed in units per second
+	Speed float32 `json:"speed"`
+}
+
+// LampDesc describes a point light, which may optionally be animated
+type LampDesc struct {
+	util.Lamp
+
+	Orbit  *OrbitDesc  `json:"orbit"`
+	Patrol *PatrolDesc `json:"patrol"`
+}
+
+// SpotlightDesc describes a spotlight (cutoff angles are in degrees)
+type SpotlightDesc struct {
+	Attenuation util.AttenuationParams `json:"attenuation"`
+
+	Position  mgl32.Vec3 `json:"position"`
+	Direction mgl32.Vec3 `json:"direction"`
+
+	Cutoff      float32 `json:"cutoff"`
+	OuterCutoff float32 `json:"outerCutoff"`
+
+	Ambient  mgl32.Vec3 `json:"ambient"`
+	Diffuse  mgl32.Vec3 `json:"diffuse"`
+	Specular mgl32.Vec3 `json:"specular"`
+
+	// FollowCamera makes the spotlight track the camera's position and
+	// direction (i.e. a flashlight)
+	FollowCamera bool `json:"followCamera"`
+	// ShadowResolution is the size of the spotlight's shadow map (0 for the
+	// default)
+	ShadowResolution int32 `json:"shadowResolution"`
+	// Shadow configures the shadow's filtering (the filter is given by name)
+	Shadow util.ShadowParams `json:"shadow"`
+}
+
+// LightsDesc describes all of the lights in a scene
+type LightsDesc struct {
+	Directional []*util.DirectionalLight `json:"directional"`
+	Lamps       []*LampDesc              `json:"lamps"`
+	Spotlights  []*SpotlightDesc         `json:"spotlights"`
+}
+
+// MaterialDesc describes a mesh material (textures are paths to JPEG or PNG
+// files). With pbr set, diffuse is the base colour and metallic and roughness
+// are used instead of the Phong parameters.
+type MaterialDesc struct {
+	Diffuse  mgl32.Vec3 `json:"diffuse"`
+	Specular mgl32.Vec3 `json:"specular"`
+	Emissive mgl32.Vec3 `json:"emissive"`
+
+	DiffuseTexture  string `json:"diffuseTexture"`
+	SpecularTexture string `json:"specularTexture"`
+	NormalTexture   string `json:"normalTexture"`
+	EmissiveTexture string `json:"emissiveTexture"`
+
+	Shininess      float32 `json:"shininess"`
+	Reflectiveness float32 `json:"reflectiveness"`
+
+	PBR                      bool    `json:"pbr"`
+	Metallic                 float32 `json:"metallic"`
+	Roughness                float32 `json:"roughness"`
+	MetallicRoughnessTexture string  `json:"metallicRoughnessTexture"`
+	OcclusionTexture         string  `json:"occlusionTexture"`
+}
+
+// MeshDesc describes a static mesh loaded from a Wavefront .obj file
+type MeshDesc struct {
+	File     string `json:"file"`
+	Material string `json:"material"`
+}
+
+// ConditionDesc describes a transition condition on an animator parameter. Op
+// is one of ">", "<", "==", "!=" or "trigger" (in which case Value is unused)
+type ConditionDesc struct {
+	Param string  `json:"param"`
+	Op    string  `json:"op"`
+	Value float32 `json:"value"`
+}
+
+// TransitionDesc describes a transition to another animation state
+type TransitionDesc struct {
+	To string `json:"to"`
+	// Duration of the crossfade in seconds
+	Duration   float32          `json:"duration"`
+	Conditions []*ConditionDesc `json:"conditions"`
+	// OnFinish waits for the state's animation to play through
+	OnFinish bool `json:"onFinish"`
+}
+
+// StateDesc describes an animation state
+type StateDesc struct {
+	Animation *AnimationRef `json:"animation"`
+	// Speed multiplies the playback rate (default 1)
+	Speed float32 `json:"speed"`
+	// Once plays the animation a single time instead of looping
+	Once bool `json:"once"`
+
+	Transitions []*TransitionDesc `json:"transitions"`
+}
+
+// StateMachineDesc describes an animation state machine
+type StateMachineDesc struct {
+	Initial string                `json:"initial"`
+	States  map[string]*StateDesc `json:"states"`
+}
+
+// ObjectDesc describes a skeletal object loaded from a .sobj file
+type ObjectDesc struct {
+	File string `json:"file"`
+	// StateMachine drives the animation of any entities or flocks using the
+	// object which don't specify an animation
+	StateMachine *StateMachineDesc `json:"stateMachine"`
+
+	// RootMotion extracts the motion of the root node from animations to move
+	// entities using the object instead ("translation" or "full", which also
+	// extracts rotation about the Y axis)
+	RootMotion string `json:"rootMotion"`
+	// RootMotionNode is the name of the root node (defaults to the root of the
+	// skeleton)
+	RootMotionNode string `json:"rootMotionNode"`
+}
+
+// EntityDesc describes a placement of a mesh or object in the scene
+type EntityDesc struct {
+	Mesh   string `json:"mesh"`
+	Object string `json:"object"`
+
+	Transform TransformDesc `json:"transform"`
+	// Animation to play (objects only, overrides the object's state machine)
+	Animation *AnimationRef `json:"animation"`
+}
+
+// RelationDesc describes how a flock reacts to another flock
+type RelationDesc struct {
+	// Flock is the name of the other flock
+	Flock string `json:"flock"`
+	// Flee and Chase are weights for steering away from / towards the other
+	// flock
+	Flee  float32 `json:"flee"`
+	Chase float32 `json:"chase"`
+	// Separate makes boids keep their distance from the other flock too
+	Separate bool `json:"separate"`
+}
+
+// FlockDesc describes a flock of boids (a species) rendered with an object.
+// All flocks are simulated together.
+type FlockDesc struct {
+	// Name is used to refer to the flock in relations
+	Name   string      `json:"name"`
+	Object string      `json:"object"`
+	Count  int         `json:"count"`
+	Bounds util.Bounds `json:"bounds"`
+	// MaxSpeed is in units per second
+	MaxSpeed float32 `json:"maxSpeed"`
+	Scale    float32 `json:"scale"`
+	// Seed makes the boids' starting positions, random behaviour and
+	// animation speeds / phases the same every time (if non-zero)
+	Seed int64 `json:"seed"`
+	// Animation to play (overrides the object's state machine)
+	Animation *AnimationRef `json:"animation"`
+	// RandomPhase starts each boid at a random point in Animation
+	RandomPhase bool `json:"randomPhase"`
+	// SpeedVariation randomly varies each boid's playback speed of Animation by
+	// up to this fraction
+	SpeedVariation float32 `json:"speedVariation"`
+
+	// MaxForce limits the acceleration from each behaviour (in units per
+	// second squared)
+	MaxForce   float32         `json:"maxForce"`
+	Behaviours []BehaviourDesc `json:"behaviours"`
+	Relations  []RelationDesc  `json:"relations"`
+}
+
+// ObstacleDesc describes a sphere (if Radius is set) or a box for boids to
+// avoid
+type ObstacleDesc struct {
+	Centre mgl32.Vec3  `json:"centre"`
+	Radius float32     `json:"radius"`
+	Bounds util.Bounds `json:"bounds"`
+}
+
+// BehaviourDesc describes a steering behaviour for a flock. Which fields are
+// used depends on the type.
+type BehaviourDesc struct {
+	// Type is one of "seek", "flee", "arrive", "wander", "avoid", "contain"
+	// or "path"
+	Type string `json:"type"`
+	// Weight of the behaviour (defaults to 1)
+	Weight float32 `json:"weight"`
+
+	// Target to seek / flee / arrive at
+	Target mgl32.Vec3 `json:"target"`
+	// FollowCamera makes Target track the camera's position
+	FollowCamera bool `json:"followCamera"`
+
+	// Radius is the distance to flee within, the slowing distance for
+	// arrive, the wander circle's radius or how far boids can stray from a
+	// path
+	Radius float32 `json:"radius"`
+	// Distance is the wander circle's distance in front of the boid or the
+	// lookahead distance for avoid and path
+	Distance float32 `json:"distance"`
+	// Jitter is how far the wander target moves per second
+	Jitter float32 `json:"jitter"`
+
+	Obstacles []ObstacleDesc `json:"obstacles"`
+	// LampRadius makes boids avoid every lamp in the scene description (as a
+	// sphere of this radius) if set
+	LampRadius float32 `json:"lampRadius"`
+
+	// Bounds and Margin are used for containment
+	Bounds util.Bounds `json:"bounds"`
+	Margin float32     `json:"margin"`
+
+	// Path is the list of points to follow, joined back to the start if
+	// Loop is set
+	Path []mgl32.Vec3 `json:"path"`
+	Loop bool         `json:"loop"`
+}
+
+// Description is the top-level scene description
+type Description struct {
+	// Skyboxes is a list of cubemap directories (the first is shown initially)
+	Skyboxes []string `json:"skyboxes"`
+	// Attenuation is used for any light which doesn't specify its own
+	Attenuation util.AttenuationParams `json:"attenuation"`
+	Lights      LightsDesc             `json:"lights"`
+
+	Materials map[string]*MaterialDesc `json:"materials"`
+	Meshes    map[string]*MeshDesc     `json:"meshes"`
+	Objects   map[string]*ObjectDesc   `json:"objects"`
+
+	Entities []*EntityDesc `json:"entities"`
+	Flocks   []*FlockDesc  `json:"flocks"`
+}
+
+// LoadFile reads and parses a JSON scene description
+func LoadFile(file string) (*Description, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %v: %w", file, err)
+	}
+
+	d := &Description{}
+	if err := json.Unmarshal(data, d); err != nil {
+		return nil, fmt.Errorf("failed to parse: %w", err)
+	}
+
+	return d, nil
+}
@@ -0,0 +1,653 @@
+package scene
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-gl/gl/v4.6-core/gl"
+	"github.com/go-gl/mathgl/mgl32"
+
+	"github.com/devplayer0/cs4052/pkg/object"
+	"github.com/devplayer0/cs4052/pkg/util"
+)
+
+type skinnedVSParams struct {
+	DepthPass bool
+	Instanced bool
+}
+
+// MovingLamp is a lamp whose position is animated over time
+type MovingLamp struct {
+	Lamp *util.Lamp
+
+	orbit  *OrbitDesc
+	angle  float32
+	patrol *PatrolDesc
+	toward bool
+}
+
+// Update moves the lamp by d seconds
+func (m *MovingLamp) Update(d float32) {
+	if o := m.orbit; o != nil {
+		m.angle = util.Mod(m.angle+o.Speed*d, 2*math.Pi)
+
+		t := util.TransFromPos(o.Centre).Mul4(mgl32.HomogRotate3DY(m.angle)).Mul4(mgl32.Translate3D(0, 0, -o.Radius))
+		m.Lamp.Position = util.PosFromTrans(t)
+	}
+
+	if p := m.patrol; p != nil {
+		target := p.From
+		if m.toward {
+			target = p.To
+		}
+
+		diff := target.Sub(m.Lamp.Position)
+		step := p.Speed * d
+		if diff.Len() <= step {
+			m.Lamp.Position = target
+			m.toward = !m.toward
+		} else {
+			m.Lamp.Position = m.Lamp.Position.Add(diff.Normalize().Mul(step))
+		}
+	}
+}
+
+// Entity is a mesh or object placed in the scene
+type Entity struct {
+	Mesh   *object.Mesh
+	Object *object.Object
+
+	Transform mgl32.Mat4
+	Animation *object.Animation
+	// Crossfade drives the object's animation, starting with Animation
+	Crossfade *object.Crossfade
+	// Animator drives the object's animation instead of Crossfade if the
+	// object has a state machine and no animation was given
+	Animator *object.Animator
+}
+
+// Flock is a set of boids, each drawn as an instance of an object
+type Flock struct {
+	Object    *object.Object
+	Boids     *object.Boids
+	Scale     float32
+	Animation *object.Animation
+	// Animators has one animator per boid if the object has a state machine
+	// and no animation was given
+	Animators []*object.Animator
+	// Instances has per-boid playback of Animation if there are no animators
+	Instances []object.InstanceAnimation
+	// Crowd draws all of the boids at once
+	Crowd *object.Crowd
+	// Pose is used to evaluate each boid's pose in turn
+	Pose *object.Pose
+}
+
+// Scene holds the lighting, shaders and renderable resources built from a
+// scene description
+type Scene struct {
+	Lighting *util.Lighting
+	Skyboxes []*util.Skybox
+
+	MeshShader             *util.Program
+	MeshDepthShader        *util.Program
+	SkinnedMeshShader      *util.Program
+	SkinnedMeshDepthShader *util.Program
+	// InstancedSkinnedMeshShader draws crowds
+	InstancedSkinnedMeshShader *util.Program
+	SkeletonShader             *util.Program
+
+	Meshes  map[string]*object.Mesh
+	Objects map[string]*object.Object
+	// StateMachines holds the animation state machine for each object which
+	// has one
+	StateMachines map[string]*object.AnimationStateMachine
+
+	Entities []*Entity
+	Flocks   []*Flock
+	// Boids simulates all of the flocks
+	Boids       *object.BoidSimulation
+	MovingLamps []*MovingLamp
+	// CameraSpotlights follow the camera's position and direction
+	CameraSpotlights []*util.Spotlight
+	// CameraTargets are steering behaviour targets which follow the camera's
+	// position
+	CameraTargets []*mgl32.Vec3
+	// Attenuation is the default attenuation for lights
+	Attenuation util.AttenuationParams
+
+	lamps []*util.Lamp
+}
+
+// LitPrograms returns the shader programs which need lighting uniforms
+func (s *Scene) LitPrograms() []*util.Program {
+	return []*util.Program{s.MeshShader, s.SkinnedMeshShader, s.InstancedSkinnedMeshShader}
+}
+
+func loadTextureFile(file string) (*util.Texture, error) {
+	t := util.NewTexture(gl.TEXTURE_2D)
+
+	var err error
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".jpg", ".jpeg":
+		err = t.LoadJPEGFile(gl.TEXTURE_2D, file)
+	case ".png":
+		err = t.LoadPNGFile(gl.TEXTURE_2D, file)
+	default:
+		err = fmt.Errorf("unsupported texture format %v", file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t.Apply2DDefaults()
+	return t, nil
+}
+
+func (md *MaterialDesc) build() (*object.Material, error) {
+	m := &object.Material{
+		Diffuse:   md.Diffuse,
+		Specular:  md.Specular,
+		Emmissive: md.Emissive,
+
+		Shininess:      md.Shininess,
+		Reflectiveness: md.Reflectiveness,
+
+		PBR:       md.PBR,
+		Metallic:  md.Metallic,
+		Roughness: md.Roughness,
+	}
+
+	textures := []struct {
+		name string
+		file string
+		dst  **util.Texture
+	}{
+		{"diffuse", md.DiffuseTexture, &m.DiffuseTexture},
+		{"specular", md.SpecularTexture, &m.SpecularTexture},
+		{"normal map", md.NormalTexture, &m.NormalTexture},
+		{"emissive", md.EmissiveTexture, &m.EmmissiveTexture},
+		{"metallic-roughness", md.MetallicRoughnessTexture, &m.MetallicRoughnessTexture},
+		{"occlusion", md.OcclusionTexture, &m.OcclusionTexture},
+	}
+	for _, t := range textures {
+		if t.file == "" {
+			continue
+		}
+
+		var err error
+		if *t.dst, err = loadTextureFile(t.file); err != nil {
+			return nil, fmt.Errorf("failed to load %v texture: %w", t.name, err)
+		}
+	}
+
+	return m, nil
+}
+
+func (r *AnimationRef) resolve(o *object.Object) (*object.Animation, error) {
+	if r == nil {
+		return nil, nil
+	}
+
+	if r.Name != "" {
+		a := o.FindAnimation(r.Name)
+		if a == nil {
+			return nil, fmt.Errorf("unknown animation %q", r.Name)
+		}
+
+		return a, nil
+	}
+
+	if r.Index < 0 || r.Index >= len(o.Animations) {
+		return nil, fmt.Errorf("animation index %v out of range", r.Index)
+	}
+	return o.Animations[r.Index], nil
+}
+
+var rootMotionModes = map[string]object.RootMotionMode{
+	"":            object.RootMotionNone,
+	"translation": object.RootMotionTranslation,
+	"full":        object.RootMotionFull,
+}
+
+var conditionOps = map[string]object.ConditionOp{
+	">":       object.OpGreater,
+	"<":       object.OpLess,
+	"==":      object.OpEqual,
+	"!=":      object.OpNotEqual,
+	"trigger": object.OpTrigger,
+}
+
+func (smd *StateMachineDesc) build(o *object.Object) (*object.AnimationStateMachine, error) {
+	var states []*object.AnimationState
+	for name, sd := range smd.States {
+		anim, err := sd.Animation.resolve(o)
+		if err != nil {
+			return nil, fmt.Errorf("state %v: %w", name, err)
+		}
+
+		st := &object.AnimationState{
+			Name:      name,
+			Animation: anim,
+			Playback: object.Playback{
+				Speed: sd.Speed,
+				Once:  sd.Once,
+			},
+		}
+		for _, td := range sd.Transitions {
+			tr := object.AnimationTransition{
+				To:       td.To,
+				Duration: td.Duration,
+				OnFinish: td.OnFinish,
+			}
+			for _, cd := range td.Conditions {
+				op, ok := conditionOps[cd.Op]
+				if !ok {
+					return nil, fmt.Errorf("state %v: unknown condition operator %q", name, cd.Op)
+				}
+
+				tr.Conditions = append(tr.Conditions, object.TransitionCondition{
+					Param: cd.Param,
+					Op:    op,
+					Value: cd.Value,
+				})
+			}
+
+			st.Transitions = append(st.Transitions, tr)
+		}
+
+		states = append(states, st)
+	}
+
+	return object.NewAnimationStateMachine(smd.Initial, states...)
+}
+
+// lampObstacle is a sphere around a (possibly moving) lamp for boids to avoid
+type lampObstacle struct {
+	lamp   *util.Lamp
+	radius float32
+}
+
+func (o lampObstacle) Avoid(from, to mgl32.Vec3) (mgl32.Vec3, float32, bool) {
+	return object.SphereObstacle{Centre: o.lamp.Position, Radius: o.radius}.Avoid(from, to)
+}
+
+func (s *Scene) buildBehaviour(bd *BehaviourDesc) (object.SteeringBehaviour, error) {
+	var b object.SteeringBehaviour
+	var target *mgl32.Vec3
+	switch bd.Type {
+	case "seek":
+		seek := &object.Seek{Target: bd.Target}
+		b, target = seek, &seek.Target
+	case "flee":
+		flee := &object.Flee{Target: bd.Target, Radius: bd.Radius}
+		b, target = flee, &flee.Target
+	case "arrive":
+		arrive := &object.Arrive{Target: bd.Target, SlowingRadius: bd.Radius}
+		b, target = arrive, &arrive.Target
+	case "wander":
+		b = &object.Wander{Radius: bd.Radius, Distance: bd.Distance, Jitter: bd.Jitter}
+	case "avoid":
+		avoid := &object.AvoidObstacles{Lookahead: bd.Distance}
+		for _, od := range bd.Obstacles {
+			if od.Radius > 0 {
+				avoid.Obstacles = append(avoid.Obstacles, object.SphereObstacle{Centre: od.Centre, Radius: od.Radius})
+			} else {
+				avoid.Obstacles = append(avoid.Obstacles, object.BoxObstacle{Bounds: od.Bounds})
+			}
+		}
+		if bd.LampRadius > 0 {
+			for _, l := range s.lamps {
+				avoid.Obstacles = append(avoid.Obstacles, lampObstacle{l, bd.LampRadius})
+			}
+		}
+
+		b = avoid
+	case "contain":
+		b = &object.Contain{Bounds: bd.Bounds, Margin: bd.Margin}
+	case "path":
+		b = &object.FollowPath{Points: bd.Path, Loop: bd.Loop, Radius: bd.Radius, Lookahead: bd.Distance}
+	default:
+		return nil, fmt.Errorf("unknown steering behaviour %q", bd.Type)
+	}
+
+	if bd.FollowCamera {
+		if target == nil {
+			return nil, fmt.Errorf("%v behaviour has no target to follow the camera", bd.Type)
+		}
+
+		s.CameraTargets = append(s.CameraTargets, target)
+	}
+
+	return b, nil
+}
+
+func (s *Scene) initLighting(d *Description, deferred bool) error {
+	withDefault := func(a util.AttenuationParams) util.AttenuationParams {
+		if a == (util.AttenuationParams{}) {
+			return d.Attenuation
+		}
+
+		return a
+	}
+
+	lamps := make([]*util.Lamp, len(d.Lights.Lamps))
+	for i, ld := range d.Lights.Lamps {
+		l := ld.Lamp
+		l.Attenuation = withDefault(l.Attenuation)
+		lamps[i] = &l
+
+		if ld.Orbit != nil || ld.Patrol != nil {
+			s.MovingLamps = append(s.MovingLamps, &MovingLamp{
+				Lamp: &l,
+
+				orbit:  ld.Orbit,
+				patrol: ld.Patrol,
+				toward: true,
+			})
+		}
+		if ld.Orbit != nil {
+			l.Position = ld.Orbit.Centre
+		}
+		if ld.Patrol != nil {
+			l.Position = ld.Patrol.From
+		}
+	}
+
+	spotlights := make([]*util.Spotlight, len(d.Lights.Spotlights))
+	for i, sd := range d.Lights.Spotlights {
+		spotlights[i] = &util.Spotlight{
+			Attenuation: withDefault(sd.Attenuation),
+
+			Position:  sd.Position,
+			Direction: sd.Direction,
+
+			Cutoff:      util.Cos(mgl32.DegToRad(sd.Cutoff)),
+			OuterCutoff: util.Cos(mgl32.DegToRad(sd.OuterCutoff)),
+
+			Ambient:  sd.Ambient,
+			Diffuse:  sd.Diffuse,
+			Specular: sd.Specular,
+
+			ShadowResolution: sd.ShadowResolution,
+			Shadow:           sd.Shadow,
+		}
+
+		if sd.FollowCamera {
+			s.CameraSpotlights = append(s.CameraSpotlights, spotlights[i])
+		}
+	}
+
+	s.lamps = lamps
+	s.Attenuation = d.Attenuation
+
+	var err error
+	s.Lighting, err = util.NewLighting(d.Lights.Directional, lamps, spotlights, deferred)
+	return err
+}
+
+func (s *Scene) initShaders() error {
+	var err error
+	s.MeshShader, err = s.Lighting.ProgramVSFile("assets/shaders/mesh.vs")
+	if err != nil {
+		return fmt.Errorf("failed to link mesh shaders: %w", err)
+	}
+	s.MeshDepthShader, err = s.Lighting.DepthProgramVSFile("assets/shaders/shadows_depth.vs")
+	if err != nil {
+		return fmt.Errorf("failed to link mesh depth pass shaders: %w", err)
+	}
+
+	s.SkinnedMeshShader, err = s.Lighting.ProgramVSTemplateFile("assets/shaders/mesh_skinned.vs", skinnedVSParams{DepthPass: false})
+	if err != nil {
+		return fmt.Errorf("failed to link skinned mesh shaders: %w", err)
+	}
+	s.SkinnedMeshDepthShader, err = s.Lighting.DepthProgramVSTemplateFile("assets/shaders/mesh_skinned.vs", skinnedVSParams{DepthPass: true})
+	if err != nil {
+		return fmt.Errorf("failed to link skinned mesh depth shaders: %w", err)
+	}
+	s.InstancedSkinnedMeshShader, err = s.Lighting.ProgramVSTemplateFile("assets/shaders/mesh_skinned.vs", skinnedVSParams{Instanced: true})
+	if err != nil {
+		return fmt.Errorf("failed to link instanced skinned mesh shaders: %w", err)
+	}
+
+	s.SkeletonShader = util.NewProgram()
+	if err := s.SkeletonShader.LinkFiles("assets/shaders/generic_3d.vs", "assets/shaders/uniform_color.fs", ""); err != nil {
+		return fmt.Errorf("failed to setup skeleton debug shader: %w", err)
+	}
+	s.SkeletonShader.SetUniformVec3("color", mgl32.Vec3{1, 0, 1})
+
+	return nil
+}
+
+func (s *Scene) initResources(d *Description) error {
+	materials := make(map[string]*object.Material, len(d.Materials))
+	for name, md := range d.Materials {
+		m, err := md.build()
+		if err != nil {
+			return fmt.Errorf("failed to load material %v: %w", name, err)
+		}
+
+		materials[name] = m
+	}
+
+	for name, md := range d.Meshes {
+		var mat *object.Material
+		if md.Material != "" {
+			var ok bool
+			if mat, ok = materials[md.Material]; !ok {
+				return fmt.Errorf("mesh %v: unknown material %q", name, md.Material)
+			}
+		}
+
+		m, err := object.NewOBJMeshFile(md.File, mat)
+		if err != nil {
+			return fmt.Errorf("failed to load mesh %v: %w", name, err)
+		}
+		m.Upload(s.MeshShader).LinkDepthMap(s.MeshDepthShader)
+
+		s.Meshes[name] = m
+	}
+
+	for name, od := range d.Objects {
+		o, err := object.NewObjectFile(od.File, s.SkinnedMeshShader, s.SkinnedMeshDepthShader, s.SkeletonShader)
+		if err != nil {
+			return fmt.Errorf("failed to set up object %v: %w", name, err)
+		}
+
+		s.Objects[name] = o
+
+		mode, ok := rootMotionModes[od.RootMotion]
+		if !ok {
+			return fmt.Errorf("object %v: unknown root motion mode %q", name, od.RootMotion)
+		}
+		if err := o.SetRootMotion(od.RootMotionNode, mode); err != nil {
+			return fmt.Errorf("object %v: %w", name, err)
+		}
+
+		if od.StateMachine != nil {
+			if s.StateMachines[name], err = od.StateMachine.build(o); err != nil {
+				return fmt.Errorf("object %v: invalid state machine: %w", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Scene) initEntities(d *Description) error {
+	for i, ed := range d.Entities {
+		e := &Entity{Transform: ed.Transform.Mat4()}
+
+		switch {
+		case ed.Mesh != "" && ed.Object != "":
+			return fmt.Errorf("entity %v: only one of mesh or object may be set", i)
+		case ed.Mesh != "":
+			var ok bool
+			if e.Mesh, ok = s.Meshes[ed.Mesh]; !ok {
+				return fmt.Errorf("entity %v: unknown mesh %q", i, ed.Mesh)
+			}
+		case ed.Object != "":
+			var ok bool
+			if e.Object, ok = s.Objects[ed.Object]; !ok {
+				return fmt.Errorf("entity %v: unknown object %q", i, ed.Object)
+			}
+
+			var err error
+			if e.Animation, err = ed.Animation.resolve(e.Object); err != nil {
+				return fmt.Errorf("entity %v: %w", i, err)
+			}
+			e.Crossfade = object.NewCrossfade(e.Animation, 0)
+			if m, ok := s.StateMachines[ed.Object]; ok && ed.Animation == nil {
+				e.Animator = object.NewAnimator(m, 0)
+			}
+		default:
+			return fmt.Errorf("entity %v: one of mesh or object must be set", i)
+		}
+
+		s.Entities = append(s.Entities, e)
+	}
+
+	for i, fd := range d.Flocks {
+		o, ok := s.Objects[fd.Object]
+		if !ok {
+			return fmt.Errorf("flock %v: unknown object %q", i, fd.Object)
+		}
+		anim, err := fd.Animation.resolve(o)
+		if err != nil {
+			return fmt.Errorf("flock %v: %w", i, err)
+		}
+
+		boids := object.NewBoids(fd.Bounds, fd.MaxSpeed)
+		if fd.Seed != 0 {
+			boids.Seed(fd.Seed)
+		}
+		if fd.MaxForce != 0 {
+			boids.MaxForce = fd.MaxForce
+		}
+		for j := range fd.Behaviours {
+			bd := &fd.Behaviours[j]
+			b, err := s.buildBehaviour(bd)
+			if err != nil {
+				return fmt.Errorf("flock %v: behaviour %v: %w", i, j, err)
+			}
+
+			weight := bd.Weight
+			if weight == 0 {
+				weight = 1
+			}
+			boids.Behaviours = append(boids.Behaviours, object.WeightedBehaviour{Behaviour: b, Weight: weight})
+		}
+
+		f := &Flock{
+			Object:    o,
+			Boids:     boids,
+			Scale:     fd.Scale,
+			Animation: anim,
+			Crowd:     object.NewCrowd(o, s.InstancedSkinnedMeshShader),
+			Pose:      o.NewPose(),
+		}
+		m, useAnimators := s.StateMachines[fd.Object]
+		useAnimators = useAnimators && fd.Animation == nil
+		for j := 0; j < fd.Count; j++ {
+			f.Boids.Instances = append(f.Boids.Instances, f.Boids.MakeBoid())
+			if useAnimators {
+				f.Animators = append(f.Animators, object.NewAnimator(m, 0))
+				continue
+			}
+
+			ia := object.InstanceAnimation{
+				Animation: anim,
+				Speed:     1 + fd.SpeedVariation*(2*f.Boids.Rand().Float32()-1),
+			}
+			if fd.RandomPhase && anim != nil {
+				ia.Offset = f.Boids.Rand().Float32() * anim.Length()
+			}
+			f.Instances = append(f.Instances, ia)
+		}
+
+		s.Flocks = append(s.Flocks, f)
+	}
+
+	named := make(map[string]*object.Boids)
+	species := make([]*object.Boids, len(s.Flocks))
+	for i, fd := range d.Flocks {
+		species[i] = s.Flocks[i].Boids
+		if fd.Name == "" {
+			continue
+		}
+		if _, ok := named[fd.Name]; ok {
+			return fmt.Errorf("flock %v: duplicate name %q", i, fd.Name)
+		}
+
+		named[fd.Name] = species[i]
+	}
+	for i, fd := range d.Flocks {
+		for _, rd := range fd.Relations {
+			other, ok := named[rd.Flock]
+			if !ok {
+				return fmt.Errorf("flock %v: unknown flock %q in relation", i, rd.Flock)
+			}
+
+			species[i].Relations = append(species[i].Relations, object.SpeciesRelation{
+				Other:    other,
+				Flee:     rd.Flee,
+				Chase:    rd.Chase,
+				Separate: rd.Separate,
+			})
+		}
+	}
+	s.Boids = object.NewBoidSimulation(species...)
+
+	return nil
+}
+
+// New builds a scene from a description (an OpenGL context must be current),
+// with deferred or forward lighting
+func New(d *Description, deferred bool) (*Scene, error) {
+	if len(d.Skyboxes) == 0 {
+		return nil, fmt.Errorf("at least one skybox is required")
+	}
+
+	s := &Scene{
+		Meshes:  make(map[string]*object.Mesh),
+		Objects: make(map[string]*object.Object),
+
+		StateMachines: make(map[string]*object.AnimationStateMachine),
+	}
+
+	for i, path := range d.Skyboxes {
+		sb, err := util.NewSkybox(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up skybox %v: %w", i, err)
+		}
+
+		s.Skyboxes = append(s.Skyboxes, sb)
+	}
+
+	if err := s.initLighting(d, deferred); err != nil {
+		return nil, fmt.Errorf("failed to initialize lighting: %w", err)
+	}
+	if err := s.initShaders(); err != nil {
+		return nil, err
+	}
+	if err := s.initResources(d); err != nil {
+		return nil, err
+	}
+	if err := s.initEntities(d); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// NewFile loads a scene description from a file and builds it
+func NewFile(file string, deferred bool) (*Scene, error) {
+	d, err := LoadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load scene description: %w", err)
+	}
+
+	return New(d, deferred)
+}
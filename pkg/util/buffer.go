@@ -91,3 +91,21 @@ func (b *Buffer) SetVec4(vecs []mgl32.Vec4) {
 
 	b.SetData(buf.Bytes())
 }
+
+// SetMat4 sets the buffer's data to the list of Mat4 (e.g. per-instance
+// transforms), for buffers which are updated often
+func (b *Buffer) SetMat4(ms []mgl32.Mat4) {
+	b.Bind()
+	if len(ms) == 0 {
+		gl.BufferData(b.t, 0, nil, gl.DYNAMIC_DRAW)
+		return
+	}
+
+	gl.BufferData(b.t, len(ms)*4*16, gl.Ptr(&ms[0][0]), gl.DYNAMIC_DRAW)
+}
+
+// BindBase binds the buffer to an indexed binding point (e.g. for a shader
+// storage buffer)
+func (b *Buffer) BindBase(index uint32) {
+	gl.BindBufferBase(b.t, index, b.id)
+}
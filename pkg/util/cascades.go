@@ -0,0 +1,141 @@
+package util
+
+import (
+	"math"
+
+	"github.com/go-gl/gl/v4.6-core/gl"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// ShadowCascades is the number of shadow maps each directional light's shadow
+// is split into along the camera's view
+const ShadowCascades = 4
+
+// CascadeResolution is the size of a single cascade's shadow map (square)
+const CascadeResolution = 2048
+
+// cascadeCasterMargin extends each cascade towards the light so that objects
+// outside the camera's view can still cast shadows into it
+const cascadeCasterMargin = float32(30.0)
+
+func (l *Lighting) initDirDepthMaps() {
+	l.DirDepthMaps = NewTexture(gl.TEXTURE_2D_ARRAY)
+	l.dirDepthMapsFBO = NewFramebuffer(gl.FRAMEBUFFER)
+	l.allocDirDepthMaps()
+}
+
+// allocDirDepthMaps (re)allocates the cascades if there are more directional
+// lights than there is space for
+func (l *Lighting) allocDirDepthMaps() {
+	if l.dirCapacity > 0 && len(l.dirs) <= l.dirCapacity {
+		return
+	}
+
+	l.dirCapacity = growCapacity(l.dirCapacity, len(l.dirs))
+	allocDepthArray(l.DirDepthMaps, l.dirDepthMapsFBO, gl.TEXTURE_2D_ARRAY, CascadeResolution, int32(l.dirCapacity*ShadowCascades))
+}
+
+// SetView sets the camera's projection and view, which directional light
+// shadow cascades are fitted to
+func (l *Lighting) SetView(projection mgl32.Mat4, c *Camera) {
+	l.projection = projection
+	l.view = c.Transform()
+}
+
+// perspectiveDepthRange extracts the near and far planes from a perspective
+// projection matrix
+func perspectiveDepthRange(p mgl32.Mat4) (float32, float32) {
+	return p[14] / (p[10] - 1), p[14] / (p[10] + 1)
+}
+
+// updateCascades splits the camera's view (up to ShadowDistance) into cascades
+// and fits an orthographic projection from each directional light around each
+// one
+func (l *Lighting) updateCascades() {
+	if len(l.dirShadowTransforms) != len(l.dirs) {
+		l.dirShadowTransforms = make([][ShadowCascades]mgl32.Mat4, len(l.dirs))
+	}
+	if l.projection == (mgl32.Mat4{}) {
+		// No view set
+		return
+	}
+
+	near, projFar := perspectiveDepthRange(l.projection)
+	far := projFar
+	if l.ShadowDistance > 0 && l.ShadowDistance < far {
+		far = l.ShadowDistance
+	}
+
+	// Blend between logarithmic and uniform splits
+	for i := range l.cascadeSplits {
+		p := float32(i+1) / ShadowCascades
+		log := near * float32(math.Pow(float64(far/near), float64(p)))
+		uniform := near + (far-near)*p
+		l.cascadeSplits[i] = l.CascadeSplitLambda*log + (1-l.CascadeSplitLambda)*uniform
+	}
+
+	// Corners of the camera's whole frustum in world space
+	inv := l.projection.Mul4(l.view).Inv()
+	var nearCorners, farCorners [4]mgl32.Vec3
+	for i := 0; i < 4; i++ {
+		x, y := float32(i%2*2-1), float32(i/2*2-1)
+		n := inv.Mul4x1(mgl32.Vec4{x, y, -1, 1})
+		f := inv.Mul4x1(mgl32.Vec4{x, y, 1, 1})
+		nearCorners[i] = n.Vec3().Mul(1 / n.W())
+		farCorners[i] = f.Vec3().Mul(1 / f.W())
+	}
+
+	start := near
+	for c, end := range l.cascadeSplits {
+		// Points along each corner ray are linear in view depth
+		t0, t1 := (start-near)/(projFar-near), (end-near)/(projFar-near)
+		var corners [8]mgl32.Vec3
+		var centre mgl32.Vec3
+		for i := 0; i < 4; i++ {
+			ray := farCorners[i].Sub(nearCorners[i])
+			corners[i] = nearCorners[i].Add(ray.Mul(t0))
+			corners[i+4] = nearCorners[i].Add(ray.Mul(t1))
+			centre = centre.Add(corners[i]).Add(corners[i+4])
+		}
+		centre = centre.Mul(1.0 / 8)
+
+		// Fit a sphere (rather than a box) so the projection doesn't change
+		// size as the camera rotates
+		var radius float32
+		for _, p := range corners {
+			if d := p.Sub(centre).Len(); d > radius {
+				radius = d
+			}
+		}
+		radius = Ceil(radius*16) / 16
+		l.cascadeRadii[c] = radius
+
+		for d, dir := range l.dirs {
+			l.dirShadowTransforms[d][c] = cascadeTransform(dir.Direction, centre, radius)
+		}
+
+		start = end
+	}
+}
+
+// cascadeTransform creates a light space transform from a directional light
+// around a sphere
+func cascadeTransform(direction, centre mgl32.Vec3, radius float32) mgl32.Mat4 {
+	dir := direction.Normalize()
+	up := mgl32.Vec3{0, 1, 0}
+	if Abs(dir.Y()) > 0.99 {
+		up = mgl32.Vec3{0, 0, 1}
+	}
+
+	eye := centre.Sub(dir.Mul(radius + cascadeCasterMargin))
+	view := mgl32.LookAtV(eye, centre, up)
+	proj := mgl32.Ortho(-radius, radius, -radius, radius, 0, 2*radius+cascadeCasterMargin)
+
+	// Snap to whole texels so that shadow edges don't shimmer as the camera
+	// moves
+	origin := proj.Mul4(view).Mul4x1(mgl32.Vec4{0, 0, 0, 1}).Mul(CascadeResolution / 2)
+	proj[12] += (float32(math.Round(float64(origin.X()))) - origin.X()) * 2 / CascadeResolution
+	proj[13] += (float32(math.Round(float64(origin.Y()))) - origin.Y()) * 2 / CascadeResolution
+
+	return proj.Mul4(view)
+}
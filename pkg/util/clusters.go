@@ -0,0 +1,223 @@
+package util
+
+import (
+	"math"
+
+	"github.com/go-gl/gl/v4.6-core/gl"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// The view frustum is split into a grid of clusters (screen space tiles,
+// sliced exponentially by depth), and each cluster only lists the lamps and
+// spotlights which can reach it
+const (
+	clustersX = 16
+	clustersY = 9
+	clustersZ = 24
+
+	clusterCount = clustersX * clustersY * clustersZ
+)
+
+// clustersBinding is the shader storage buffer binding point for the cluster
+// grid
+const clustersBinding = 5
+
+// lightCutoff is the fraction of a light's brightness below which it's
+// considered to no longer have any effect (setting its radius)
+const lightCutoff = 1.0 / 256
+
+// lightRadius finds the distance at which a light's attenuated brightness
+// drops below lightCutoff (infinite if it never does)
+func lightRadius(a AttenuationParams, colours ...mgl32.Vec3) float32 {
+	var brightness float32
+	for _, c := range colours {
+		for _, v := range c {
+			if v > brightness {
+				brightness = v
+			}
+		}
+	}
+
+	// Solve constant + linear*d + quadratic*d^2 = brightness / cutoff
+	target := brightness / lightCutoff
+	if target <= a.Constant {
+		return 0
+	}
+	if a.Quadratic == 0 {
+		if a.Linear == 0 {
+			return math.MaxFloat32
+		}
+
+		return (target - a.Constant) / a.Linear
+	}
+
+	disc := a.Linear*a.Linear - 4*a.Quadratic*(a.Constant-target)
+	return (-a.Linear + float32(math.Sqrt(float64(disc)))) / (2 * a.Quadratic)
+}
+
+// clusterSlice finds the depth slice for a (positive) view space depth
+func clusterSlice(depth, near, far float32) int {
+	if depth <= near {
+		return 0
+	}
+
+	s := int(float32(math.Log(float64(depth/near))/math.Log(float64(far/near))) * clustersZ)
+	if s >= clustersZ {
+		return clustersZ - 1
+	}
+
+	return s
+}
+
+// updateClusterBounds calculates the view space bounding box of each cluster
+// (which only depends on the projection)
+func (l *Lighting) updateClusterBounds() {
+	l.clusterProjection = l.projection
+	if l.clusterBounds == nil {
+		l.clusterBounds = make([]Bounds, clusterCount)
+	}
+
+	n, f := l.clusterNear, l.clusterFar
+	for z := 0; z < clustersZ; z++ {
+		zn := n * float32(math.Pow(float64(f/n), float64(z)/clustersZ))
+		zf := n * float32(math.Pow(float64(f/n), float64(z+1)/clustersZ))
+
+		for y := 0; y < clustersY; y++ {
+			y0, y1 := -1+2*float32(y)/clustersY, -1+2*float32(y+1)/clustersY
+			for x := 0; x < clustersX; x++ {
+				x0, x1 := -1+2*float32(x)/clustersX, -1+2*float32(x+1)/clustersX
+
+				// Tile edges at the near and far depths of the slice
+				var b Bounds
+				for i, d := range []float32{zn, zf} {
+					corners := [4]mgl32.Vec3{
+						{x0 * d / l.projection[0], y0 * d / l.projection[5], -d},
+						{x1 * d / l.projection[0], y0 * d / l.projection[5], -d},
+						{x0 * d / l.projection[0], y1 * d / l.projection[5], -d},
+						{x1 * d / l.projection[0], y1 * d / l.projection[5], -d},
+					}
+					for j, c := range corners {
+						if i == 0 && j == 0 {
+							b = Bounds{Min: c, Max: c}
+							continue
+						}
+						for a := 0; a < 3; a++ {
+							if c[a] < b.Min[a] {
+								b.Min[a] = c[a]
+							}
+							if c[a] > b.Max[a] {
+								b.Max[a] = c[a]
+							}
+						}
+					}
+				}
+
+				l.clusterBounds[(z*clustersY+y)*clustersX+x] = b
+			}
+		}
+	}
+}
+
+// sphereIntersects checks if a sphere intersects a box
+func sphereIntersects(b Bounds, centre mgl32.Vec3, radius float32) bool {
+	var d2 float32
+	for a := 0; a < 3; a++ {
+		if centre[a] < b.Min[a] {
+			d := b.Min[a] - centre[a]
+			d2 += d * d
+		} else if centre[a] > b.Max[a] {
+			d := centre[a] - b.Max[a]
+			d2 += d * d
+		}
+	}
+
+	return d2 <= radius*radius
+}
+
+// binLight adds a light to every cluster its sphere of influence overlaps
+func (l *Lighting) binLight(index int32, position mgl32.Vec3, radius float32, bins [][]int32) {
+	if radius == 0 {
+		return
+	}
+
+	c := l.view.Mul4x1(position.Vec4(1)).Vec3()
+	depth := -c.Z()
+	if depth+radius < l.clusterNear || depth-radius > l.clusterFar {
+		return
+	}
+
+	z0 := clusterSlice(depth-radius, l.clusterNear, l.clusterFar)
+	z1 := clusterSlice(depth+radius, l.clusterNear, l.clusterFar)
+	for z := z0; z <= z1; z++ {
+		for i := z * clustersX * clustersY; i < (z+1)*clustersX*clustersY; i++ {
+			if sphereIntersects(l.clusterBounds[i], c, radius) {
+				bins[i] = append(bins[i], index)
+			}
+		}
+	}
+}
+
+func (l *Lighting) initClusters() {
+	l.clustersBuffer = NewBuffer(gl.SHADER_STORAGE_BUFFER)
+	l.clusterLamps = make([][]int32, clusterCount)
+	l.clusterSpotlights = make([][]int32, clusterCount)
+}
+
+// updateClusters bins the lamps and spotlights into clusters and uploads the
+// grid. Until the view and viewport size have been set, every light is put in
+// the first cluster (which the shader then uses for every fragment).
+func (l *Lighting) updateClusters() {
+	for i := range l.clusterLamps {
+		l.clusterLamps[i] = l.clusterLamps[i][:0]
+		l.clusterSpotlights[i] = l.clusterSpotlights[i][:0]
+	}
+
+	if l.projection == (mgl32.Mat4{}) || l.viewportSize == (mgl32.Vec2{}) {
+		l.clusterNear = 0
+		for i := range l.lamps {
+			l.clusterLamps[0] = append(l.clusterLamps[0], int32(i))
+		}
+		for i := range l.spotlights {
+			l.clusterSpotlights[0] = append(l.clusterSpotlights[0], int32(i))
+		}
+	} else {
+		l.clusterNear, l.clusterFar = perspectiveDepthRange(l.projection)
+		if l.projection != l.clusterProjection {
+			l.updateClusterBounds()
+		}
+
+		for i, lamp := range l.lamps {
+			r := lightRadius(lamp.Attenuation, lamp.Ambient, lamp.Diffuse, lamp.Specular)
+			l.binLight(int32(i), lamp.Position, r, l.clusterLamps)
+		}
+		for i, spot := range l.spotlights {
+			r := lightRadius(spot.Attenuation, spot.Ambient, spot.Diffuse, spot.Specular)
+			l.binLight(int32(i), spot.Position, r, l.clusterSpotlights)
+		}
+	}
+
+	// Each cluster has the offset of its lights in the index list followed by
+	// the number of lamps and spotlights
+	s := &l.layout
+	s.words = s.words[:0]
+	offset := int32(0)
+	for i := range l.clusterLamps {
+		lamps, spots := int32(len(l.clusterLamps[i])), int32(len(l.clusterSpotlights[i]))
+		s.int(offset)
+		s.int(lamps)
+		s.int(spots)
+		s.int(0)
+
+		offset += lamps + spots
+	}
+	for i := range l.clusterLamps {
+		for _, index := range l.clusterLamps[i] {
+			s.int(index)
+		}
+		for _, index := range l.clusterSpotlights[i] {
+			s.int(index)
+		}
+	}
+
+	s.upload(l.clustersBuffer)
+}
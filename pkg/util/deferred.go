@@ -0,0 +1,155 @@
+package util
+
+import (
+	"fmt"
+
+	"github.com/go-gl/gl/v4.6-core/gl"
+)
+
+const gBufferFragShaderFile = "assets/shaders/gbuffer.fs"
+const fullscreenVertShaderFile = "assets/shaders/fullscreen.vs"
+
+// Texture units the G-buffer is bound to for the lighting pass (the material
+// units are free, the emissive target goes after the shadow maps)
+var gBufferUnits = [...]uint32{0, 1, 2, 3, 11}
+
+// Formats of the G-buffer's colour targets (position, normal, albedo +
+// reflectiveness, specular + shininess or metallic + roughness + occlusion and
+// emissive)
+var gBufferFormats = [...]struct {
+	internal int32
+	xtype    uint32
+}{
+	{gl.RGBA32F, gl.FLOAT},
+	{gl.RGBA16F, gl.FLOAT},
+	{gl.RGBA8, gl.UNSIGNED_BYTE},
+	{gl.RGBA16F, gl.FLOAT},
+	{gl.RGBA16F, gl.FLOAT},
+}
+
+// GBuffer holds the geometry and material at each pixel for deferred lighting
+type GBuffer struct {
+	fbo *Framebuffer
+
+	Width, Height int32
+	Targets       [len(gBufferFormats)]*Texture
+	Depth         *Texture
+}
+
+// NewGBuffer creates a G-buffer of the given size
+func NewGBuffer(w, h int32) (*GBuffer, error) {
+	g := &GBuffer{
+		fbo: NewFramebuffer(gl.FRAMEBUFFER),
+
+		Width:  w,
+		Height: h,
+		Depth:  NewTexture(gl.TEXTURE_2D),
+	}
+
+	attachments := make([]uint32, len(g.Targets))
+	for i, f := range gBufferFormats {
+		t := NewTexture(gl.TEXTURE_2D)
+		t.SetData2D(gl.TEXTURE_2D, 0, f.internal, w, h, 0, gl.RGBA, f.xtype, nil)
+		t.SetIParameter(gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+		t.SetIParameter(gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+
+		attachments[i] = gl.COLOR_ATTACHMENT0 + uint32(i)
+		g.fbo.SetTexture(attachments[i], t, 0)
+		g.Targets[i] = t
+	}
+
+	g.Depth.SetData2D(gl.TEXTURE_2D, 0, gl.DEPTH_COMPONENT32F, w, h, 0, gl.DEPTH_COMPONENT, gl.FLOAT, nil)
+	g.Depth.SetIParameter(gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	g.Depth.SetIParameter(gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	g.fbo.SetTexture(gl.DEPTH_ATTACHMENT, g.Depth, 0)
+
+	gl.DrawBuffers(int32(len(attachments)), &attachments[0])
+	status := gl.CheckFramebufferStatus(gl.FRAMEBUFFER)
+	g.fbo.Unbind()
+	if status != gl.FRAMEBUFFER_COMPLETE {
+		return nil, fmt.Errorf("framebuffer incomplete (status 0x%x)", status)
+	}
+
+	return g, nil
+}
+
+// Bind binds and clears the G-buffer for the geometry pass
+func (g *GBuffer) Bind() {
+	g.fbo.Bind()
+	gl.Viewport(0, 0, g.Width, g.Height)
+
+	// Zero so that pixels without geometry can be told apart
+	var zero [4]float32
+	for i := range g.Targets {
+		gl.ClearBufferfv(gl.COLOR, int32(i), &zero[0])
+	}
+	gl.Clear(gl.DEPTH_BUFFER_BIT)
+}
+
+// Unbind goes back to drawing to the default framebuffer
+func (g *GBuffer) Unbind() {
+	g.fbo.Unbind()
+}
+
+func (l *Lighting) initDeferred(tplData shaderTemplateData) error {
+	var err error
+	if l.fragSource, err = TemplateFile(gBufferFragShaderFile, tplData); err != nil {
+		return fmt.Errorf("failed to generate G-buffer shader source: %w", err)
+	}
+
+	tplData.Deferred = true
+	fsSource, err := TemplateFile(lightingFragShaderFile, tplData)
+	if err != nil {
+		return fmt.Errorf("failed to generate deferred lighting shader source: %w", err)
+	}
+
+	vs, err := NewShaderFile(gl.VERTEX_SHADER, fullscreenVertShaderFile)
+	if err != nil {
+		return fmt.Errorf("failed to load full screen vertex shader: %w", err)
+	}
+	if err := vs.Compile(); err != nil {
+		return fmt.Errorf("failed to compile full screen vertex shader: %w", err)
+	}
+	fs := NewShader(gl.FRAGMENT_SHADER, fsSource)
+	if err := fs.Compile(); err != nil {
+		return fmt.Errorf("failed to compile deferred lighting shader: %w", err)
+	}
+
+	l.deferredProgram = NewProgram()
+	if err := l.deferredProgram.Link(vs, fs, nil); err != nil {
+		return fmt.Errorf("failed to link deferred lighting shaders: %w", err)
+	}
+
+	// The full screen triangle is generated in the vertex shader, but a VAO
+	// still needs to be bound
+	gl.GenVertexArrays(1, &l.screenVAO)
+	return nil
+}
+
+// Deferred returns true if programs created by this Lighting write to a
+// G-buffer (to be lit with DeferredPass) instead of lighting directly
+func (l *Lighting) Deferred() bool {
+	return l.deferredProgram != nil
+}
+
+// DeferredPass lights the contents of a G-buffer to the current framebuffer,
+// writing the depth of the G-buffer's geometry so that forward rendered
+// objects can be drawn on top
+func (l *Lighting) DeferredPass(g *GBuffer, envMap *Texture) {
+	p := l.deferredProgram
+	p.Use()
+	p.SetUniformMat4("projection", l.projection)
+	p.SetUniformMat4("camera", l.view)
+
+	for i, t := range g.Targets {
+		gl.ActiveTexture(gl.TEXTURE0 + gBufferUnits[i])
+		t.Bind()
+	}
+	envMap.Activate(p, "env_map", 4)
+	l.DepthMaps.Activate(p, "depth_maps", 5)
+
+	gl.DepthFunc(gl.ALWAYS)
+	gl.BindVertexArray(l.screenVAO)
+	gl.DrawArrays(gl.TRIANGLES, 0, 3)
+	gl.DepthFunc(gl.LESS)
+}
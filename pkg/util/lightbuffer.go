@@ -0,0 +1,148 @@
+package util
+
+import (
+	"math"
+
+	"github.com/go-gl/gl/v4.6-core/gl"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// Shader storage buffer binding points for the light lists (after those used
+// by the instanced skinned mesh shader)
+const (
+	dirsBinding       = 2
+	lampsBinding      = 3
+	spotlightsBinding = 4
+)
+
+// std430 builds the contents of a shader storage buffer following the std430
+// layout rules, one 4 byte word at a time
+type std430 struct {
+	words []uint32
+}
+
+// align pads to a multiple of n words
+func (s *std430) align(n int) {
+	for len(s.words)%n != 0 {
+		s.words = append(s.words, 0)
+	}
+}
+
+func (s *std430) float(f float32) {
+	s.words = append(s.words, math.Float32bits(f))
+}
+
+func (s *std430) int(i int32) {
+	s.words = append(s.words, uint32(i))
+}
+
+func (s *std430) vec3(v mgl32.Vec3) {
+	s.align(4)
+	s.float(v[0])
+	s.float(v[1])
+	s.float(v[2])
+}
+
+func (s *std430) mat4(m mgl32.Mat4) {
+	s.align(4)
+	for _, f := range m {
+		s.float(f)
+	}
+}
+
+func (s *std430) attenuation(a AttenuationParams) {
+	s.float(a.Constant)
+	s.float(a.Linear)
+	s.float(a.Quadratic)
+}
+
+func (s *std430) shadow(p ShadowParams) {
+	s.int(int32(p.Filter))
+	s.float(p.Bias)
+	s.float(p.SlopeBias)
+	s.float(p.NormalOffset)
+	s.float(p.Radius)
+	s.int(p.Samples)
+	s.float(p.LightSize)
+}
+
+// list starts a block holding a count followed by an array of structs (which
+// are aligned to 4 words since they contain vectors)
+func (s *std430) list(n int) {
+	s.words = s.words[:0]
+	s.int(int32(n))
+	s.align(4)
+}
+
+// upload writes the words to a buffer
+func (s *std430) upload(b *Buffer) {
+	data := make([]byte, len(s.words)*4)
+	for i, w := range s.words {
+		NativeOrder.PutUint32(data[i*4:], w)
+	}
+
+	b.Bind()
+	gl.BufferData(b.t, len(data), gl.Ptr(data), gl.DYNAMIC_DRAW)
+}
+
+func (l *Lighting) initLightBuffers() {
+	l.dirsBuffer = NewBuffer(gl.SHADER_STORAGE_BUFFER)
+	l.lampsBuffer = NewBuffer(gl.SHADER_STORAGE_BUFFER)
+	l.spotlightsBuffer = NewBuffer(gl.SHADER_STORAGE_BUFFER)
+}
+
+func (l *Lighting) uploadDirs() {
+	s := &l.layout
+	s.list(len(l.dirs))
+	for i, d := range l.dirs {
+		s.vec3(d.Direction)
+		s.vec3(d.Ambient)
+		s.vec3(d.Diffuse)
+		s.vec3(d.Specular)
+		s.shadow(d.Shadow)
+		for _, t := range l.dirShadowTransforms[i] {
+			s.mat4(t)
+		}
+		s.align(4)
+	}
+
+	s.upload(l.dirsBuffer)
+}
+
+func (l *Lighting) uploadLamps() {
+	s := &l.layout
+	s.list(len(l.lamps))
+	for i, lamp := range l.lamps {
+		s.attenuation(lamp.Attenuation)
+		s.vec3(lamp.Position)
+		s.vec3(lamp.Ambient)
+		s.vec3(lamp.Diffuse)
+		s.vec3(lamp.Specular)
+		s.shadow(lamp.Shadow)
+		s.int(int32(l.lampShadowSlots[i]))
+		s.align(4)
+	}
+
+	s.upload(l.lampsBuffer)
+}
+
+func (l *Lighting) uploadSpotlights() {
+	s := &l.layout
+	s.list(len(l.spotlights))
+	for i, spot := range l.spotlights {
+		s.attenuation(spot.Attenuation)
+		s.vec3(spot.Position)
+		s.vec3(spot.Direction)
+		s.float(spot.Cutoff)
+		s.float(spot.OuterCutoff)
+		s.vec3(spot.Ambient)
+		s.vec3(spot.Diffuse)
+		s.vec3(spot.Specular)
+		s.shadow(spot.Shadow)
+		s.mat4(l.spotShadowTransforms[i])
+		s.float(float32(spot.shadowResolution()) / float32(l.spotMapSize))
+		s.align(4)
+	}
+
+	s.upload(l.spotlightsBuffer)
+}
@@ -14,6 +14,17 @@ const lightingFragShaderFile = "assets/shaders/lighting.fs"
 const lightingDepthFragShaderFile = "assets/shaders/shadows_depth.fs"
 const lightingDepthGeoShaderFile = "assets/shaders/shadows_depth.gs"
 
+// Texture units shadow maps are bound to (after those used by materials). The
+// comparison units have the same textures bound with a comparison sampler, for
+// hardware filtering.
+const (
+	dirDepthMapsUnit  = 6
+	dirCompareUnit    = 7
+	lampCompareUnit   = 8
+	spotDepthMapsUnit = 9
+	spotCompareUnit   = 10
+)
+
 const nearPlane = float32(1.0)
 const farPlane = float32(45.0)
 
@@ -31,6 +42,9 @@ type DirectionalLight struct {
 	Ambient  mgl32.Vec3
 	Diffuse  mgl32.Vec3
 	Specular mgl32.Vec3
+
+	// Shadow configures the shadow's filtering (DefaultShadowParams if unset)
+	Shadow ShadowParams
 }
 
 // Lamp represents a point light source
@@ -42,6 +56,12 @@ type Lamp struct {
 	Ambient  mgl32.Vec3
 	Diffuse  mgl32.Vec3
 	Specular mgl32.Vec3
+
+	// NoShadows stops the lamp from casting shadows (so it doesn't need a cube
+	// map, allowing for many more lamps)
+	NoShadows bool
+	// Shadow configures the shadow's filtering (DefaultShadowParams if unset)
+	Shadow ShadowParams
 }
 
 // Spotlight represents a directional (cone) point light source
@@ -57,14 +77,31 @@ type Spotlight struct {
 	Ambient  mgl32.Vec3
 	Diffuse  mgl32.Vec3
 	Specular mgl32.Vec3
+
+	// ShadowResolution is the size of the shadow map (0 for the default)
+	ShadowResolution int32
+	// Shadow configures the shadow's filtering (DefaultShadowParams if unset)
+	Shadow ShadowParams
 }
 
 type shaderTemplateData struct {
-	Dirs       []*DirectionalLight
-	Lamps      []*Lamp
-	Spotlights []*Spotlight
+	Cascades            int
+	CascadeCasterMargin float32
+	ClustersX           int
+	ClustersY           int
+	ClustersZ           int
+	// Deferred selects the variant of the lighting shader which reads from the
+	// G-buffer
+	Deferred bool
 }
 
+// Values of the shadow_pass uniform in the depth shaders
+const (
+	shadowPassLamps = 0
+	shadowPassDirs  = 1
+	shadowPassSpot  = 2
+)
+
 // Lighting represents a shader to colour an object with lighting
 type Lighting struct {
 	viewPos    mgl32.Vec3
@@ -75,21 +112,78 @@ type Lighting struct {
 	cubeVAO    uint32
 	cubeShader *Program
 
+	// Light lists in shader storage buffers, so lights can be added and
+	// removed without recompiling shaders
+	layout           std430
+	dirsBuffer       *Buffer
+	lampsBuffer      *Buffer
+	spotlightsBuffer *Buffer
+	lampsChanged     bool
+
 	ShadowsEnabled       bool
 	depthUpdateLamps     []bool
-	lampShadowTransforms []mgl32.Mat4
-	depthMapsFBO         *Framebuffer
-	DepthMaps            *Texture
+	lampShadowTransforms [][6]mgl32.Mat4
+	// Cube map in the depth map array for each lamp (-1 if it doesn't cast
+	// shadows)
+	lampShadowSlots []int
+	shadowLamps     int
+	lampCapacity    int
+	depthMapsFBO    *Framebuffer
+	DepthMaps       *Texture
+
+	// ShadowDistance is how far from the camera directional lights cast
+	// shadows
+	ShadowDistance float32
+	// CascadeSplitLambda blends between uniform (0) and logarithmic (1)
+	// cascade splits
+	CascadeSplitLambda  float32
+	projection          mgl32.Mat4
+	view                mgl32.Mat4
+	cascadeSplits       []float32
+	cascadeRadii        []float32
+	dirShadowTransforms [][ShadowCascades]mgl32.Mat4
+	dirCapacity         int
+	dirDepthMapsFBO     *Framebuffer
+	// DirDepthMaps holds the shadow cascades for each directional light
+	DirDepthMaps *Texture
+
+	spotShadowTransforms []mgl32.Mat4
+	spotCapacity         int
+	spotMapSize          int32
+	spotDepthMapsFBO     *Framebuffer
+	// SpotDepthMaps holds the shadow map for each spotlight (one per layer)
+	SpotDepthMaps *Texture
+
+	// Sampler used to bind the shadow maps for hardware comparison
+	compareSampler uint32
+
+	// Lamps and spotlights binned into view space clusters
+	clustersBuffer    *Buffer
+	clusterLamps      [][]int32
+	clusterSpotlights [][]int32
+	clusterBounds     []Bounds
+	clusterProjection mgl32.Mat4
+	clusterNear       float32
+	clusterFar        float32
+	viewportSize      mgl32.Vec2
+
+	// AmbientOcclusion darkens the ambient lighting if set (see SSAO)
+	AmbientOcclusion *Texture
+
+	// Full screen lighting pass (only if deferred)
+	deferredProgram *Program
+	screenVAO       uint32
 
 	fragSource      string
 	depthFragSource string
 	depthGeoSource  string
 }
 
-// NewLighting creates a new lighting shader from a given vertex shader and set
-// of lamps
-func NewLighting(dirs []*DirectionalLight, lamps []*Lamp, spotlights []*Spotlight) (*Lighting, error) {
-	shaderTplParams := shaderTemplateData{dirs, lamps, spotlights}
+// NewLighting creates a new lighting shader from a given vertex shader and
+// initial set of lights. If deferred is set, the programs it creates write to a
+// G-buffer instead, which is lit by DeferredPass.
+func NewLighting(dirs []*DirectionalLight, lamps []*Lamp, spotlights []*Spotlight, deferred bool) (*Lighting, error) {
+	shaderTplParams := shaderTemplateData{ShadowCascades, cascadeCasterMargin, clustersX, clustersY, clustersZ, false}
 	fsSource, err := TemplateFile(lightingFragShaderFile, shaderTplParams)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate fragment shader source: %w", err)
@@ -110,7 +204,13 @@ func NewLighting(dirs []*DirectionalLight, lamps []*Lamp, spotlights []*Spotligh
 		spotlights: spotlights,
 
 		depthUpdateLamps:     make([]bool, len(lamps)),
-		lampShadowTransforms: make([]mgl32.Mat4, len(lamps)*6),
+		lampShadowTransforms: make([][6]mgl32.Mat4, len(lamps)),
+		lampShadowSlots:      make([]int, len(lamps)),
+
+		ShadowDistance:     50,
+		CascadeSplitLambda: 0.75,
+		cascadeSplits:      make([]float32, ShadowCascades),
+		cascadeRadii:       make([]float32, ShadowCascades),
 
 		fragSource:      fsSource,
 		depthFragSource: dfsSource,
@@ -122,9 +222,29 @@ func NewLighting(dirs []*DirectionalLight, lamps []*Lamp, spotlights []*Spotligh
 	if l.initDepthMaps(); err != nil {
 		return nil, fmt.Errorf("failed to initialize depth map: %w", err)
 	}
+	l.initDirDepthMaps()
+	l.initSpotDepthMaps()
+	l.initCompareSampler()
+	l.initLightBuffers()
+	l.initClusters()
+	if deferred {
+		if err := l.initDeferred(shaderTplParams); err != nil {
+			return nil, fmt.Errorf("failed to initialize deferred lighting: %w", err)
+		}
+	}
+
+	for _, d := range dirs {
+		withDefaultShadow(&d.Shadow)
+	}
+	for _, lamp := range lamps {
+		withDefaultShadow(&lamp.Shadow)
+	}
+	for _, spot := range spotlights {
+		withDefaultShadow(&spot.Shadow)
+	}
 
 	for i := range lamps {
-		l.UpdateLampI(i, []*Program{}...)
+		l.UpdateLampI(i)
 	}
 
 	return l, nil
@@ -146,27 +266,85 @@ func (l *Lighting) initDebugCubes() error {
 	return nil
 }
 
-func (l *Lighting) initDepthMaps() {
-	l.DepthMaps = NewTexture(gl.TEXTURE_CUBE_MAP_ARRAY)
-	l.DepthMaps.SetData3D(gl.TEXTURE_CUBE_MAP_ARRAY, 0, gl.DEPTH_COMPONENT, ShadowResolution, ShadowResolution, int32(len(l.lamps)*6), 0, gl.DEPTH_COMPONENT, gl.FLOAT, nil)
+// growCapacity returns the number of lights to allocate shadow maps for to
+// fit n (doubling so that adding lights one at a time isn't too expensive)
+func growCapacity(capacity, n int) int {
+	capacity *= 2
+	if capacity < n {
+		capacity = n
+	}
+	if capacity == 0 {
+		// Textures can't be empty
+		capacity = 1
+	}
 
-	l.DepthMaps.SetIParameter(gl.TEXTURE_MIN_FILTER, gl.NEAREST)
-	l.DepthMaps.SetIParameter(gl.TEXTURE_MAG_FILTER, gl.NEAREST)
-	l.DepthMaps.SetIParameter(gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
-	l.DepthMaps.SetIParameter(gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
-	l.DepthMaps.SetIParameter(gl.TEXTURE_WRAP_R, gl.CLAMP_TO_EDGE)
-	l.DepthMaps.SetIParameter(gl.TEXTURE_BASE_LEVEL, 0)
-	l.DepthMaps.SetIParameter(gl.TEXTURE_MAX_LEVEL, 0)
+	return capacity
+}
 
-	l.depthMapsFBO = NewFramebuffer(gl.FRAMEBUFFER)
-	l.depthMapsFBO.Bind()
-	l.depthMapsFBO.SetTexture(gl.DEPTH_ATTACHMENT, l.DepthMaps, 0)
+// allocDepthArray (re)allocates a layered depth texture and attaches all of
+// its layers to a framebuffer
+func allocDepthArray(t *Texture, fbo *Framebuffer, target uint32, size, layers int32) {
+	t.SetData3D(target, 0, gl.DEPTH_COMPONENT32F, size, size, layers, 0, gl.DEPTH_COMPONENT, gl.FLOAT, nil)
+
+	t.SetIParameter(gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	t.SetIParameter(gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	t.SetIParameter(gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	t.SetIParameter(gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+	t.SetIParameter(gl.TEXTURE_WRAP_R, gl.CLAMP_TO_EDGE)
+	t.SetIParameter(gl.TEXTURE_BASE_LEVEL, 0)
+	t.SetIParameter(gl.TEXTURE_MAX_LEVEL, 0)
+
+	fbo.SetTexture(gl.DEPTH_ATTACHMENT, t, 0)
 	gl.DrawBuffer(gl.NONE)
 	gl.ReadBuffer(gl.NONE)
-	l.depthMapsFBO.Unbind()
+	fbo.Unbind()
+}
+
+func (l *Lighting) initDepthMaps() {
+	l.DepthMaps = NewTexture(gl.TEXTURE_CUBE_MAP_ARRAY)
+	l.depthMapsFBO = NewFramebuffer(gl.FRAMEBUFFER)
+	l.assignShadowSlots()
+}
+
+// assignShadowSlots packs the cube maps of the lamps which cast shadows into
+// the depth map array, marking those which have moved as needing an update
+func (l *Lighting) assignShadowSlots() {
+	n := 0
+	for i, lamp := range l.lamps {
+		slot := -1
+		if !lamp.NoShadows {
+			slot = n
+			n++
+		}
+
+		if l.lampShadowSlots[i] != slot {
+			l.lampShadowSlots[i] = slot
+			l.depthUpdateLamps[i] = true
+		}
+	}
+
+	l.shadowLamps = n
+	l.allocDepthMaps()
+}
+
+// allocDepthMaps (re)allocates the lamp cube maps if there are more shadow
+// casting lamps than there is space for
+func (l *Lighting) allocDepthMaps() {
+	if l.lampCapacity > 0 && l.shadowLamps <= l.lampCapacity {
+		return
+	}
+
+	l.lampCapacity = growCapacity(l.lampCapacity, l.shadowLamps)
+	allocDepthArray(l.DepthMaps, l.depthMapsFBO, gl.TEXTURE_CUBE_MAP_ARRAY, ShadowResolution, int32(l.lampCapacity*6))
+
+	// Reallocating loses the existing maps
+	for i := range l.depthUpdateLamps {
+		l.depthUpdateLamps[i] = true
+	}
 }
 
-// MakeFragShader creates a new fragment shader defined by this Lighting
+// MakeFragShader creates a new fragment shader defined by this Lighting (the
+// G-buffer shader if deferred)
 func (l *Lighting) MakeFragShader() (*Shader, error) {
 	fs := NewShader(gl.FRAGMENT_SHADER, l.fragSource)
 	if err := fs.Compile(); err != nil {
@@ -273,99 +451,167 @@ func (l *Lighting) SetViewPos(pos mgl32.Vec3) {
 	l.viewPos = pos
 }
 
-// UpdateLampI updates a single lamp by index
-func (l *Lighting) UpdateLampI(index int, ps ...*Program) {
-	lamp := l.lamps[index]
-	base := fmt.Sprintf("lamps[%v]", index)
-	for _, p := range ps {
-		p.SetUniformFloat32(base+".attenuation.constant", lamp.Attenuation.Constant)
-		p.SetUniformFloat32(base+".attenuation.linear", lamp.Attenuation.Linear)
-		p.SetUniformFloat32(base+".attenuation.quadratic", lamp.Attenuation.Quadratic)
-
-		p.SetUniformVec3(base+".position", lamp.Position)
-
-		p.SetUniformVec3(base+".ambient", lamp.Ambient)
-		p.SetUniformVec3(base+".diffuse", lamp.Diffuse)
-		p.SetUniformVec3(base+".specular", lamp.Specular)
-	}
+// SetViewportSize sets the size of the viewport rendered to, which the
+// clusters' screen space tiles divide up
+func (l *Lighting) SetViewportSize(w, h int) {
+	l.viewportSize = mgl32.Vec2{float32(w), float32(h)}
+}
 
+// UpdateLampI updates a single lamp by index
+func (l *Lighting) UpdateLampI(index int) {
 	// Calculate transforms for each face of the cubemap
 	shadowProj := mgl32.Perspective(mgl32.DegToRad(90), 1, nearPlane, farPlane)
-	lp := lamp.Position
-	ts := l.lampShadowTransforms
+	lp := l.lamps[index].Position
+	ts := &l.lampShadowTransforms[index]
 
-	ts[index*6+0] = shadowProj.Mul4(mgl32.LookAtV(lp, lp.Add(mgl32.Vec3{1, 0, 0}), mgl32.Vec3{0, -1, 0}))
-	ts[index*6+1] = shadowProj.Mul4(mgl32.LookAtV(lp, lp.Add(mgl32.Vec3{-1, 0, 0}), mgl32.Vec3{0, -1, 0}))
-	ts[index*6+2] = shadowProj.Mul4(mgl32.LookAtV(lp, lp.Add(mgl32.Vec3{0, 1, 0}), mgl32.Vec3{0, 0, 1}))
-	ts[index*6+3] = shadowProj.Mul4(mgl32.LookAtV(lp, lp.Add(mgl32.Vec3{0, -1, 0}), mgl32.Vec3{0, 0, -1}))
-	ts[index*6+4] = shadowProj.Mul4(mgl32.LookAtV(lp, lp.Add(mgl32.Vec3{0, 0, 1}), mgl32.Vec3{0, -1, 0}))
-	ts[index*6+5] = shadowProj.Mul4(mgl32.LookAtV(lp, lp.Add(mgl32.Vec3{0, 0, -1}), mgl32.Vec3{0, -1, 0}))
+	ts[0] = shadowProj.Mul4(mgl32.LookAtV(lp, lp.Add(mgl32.Vec3{1, 0, 0}), mgl32.Vec3{0, -1, 0}))
+	ts[1] = shadowProj.Mul4(mgl32.LookAtV(lp, lp.Add(mgl32.Vec3{-1, 0, 0}), mgl32.Vec3{0, -1, 0}))
+	ts[2] = shadowProj.Mul4(mgl32.LookAtV(lp, lp.Add(mgl32.Vec3{0, 1, 0}), mgl32.Vec3{0, 0, 1}))
+	ts[3] = shadowProj.Mul4(mgl32.LookAtV(lp, lp.Add(mgl32.Vec3{0, -1, 0}), mgl32.Vec3{0, 0, -1}))
+	ts[4] = shadowProj.Mul4(mgl32.LookAtV(lp, lp.Add(mgl32.Vec3{0, 0, 1}), mgl32.Vec3{0, -1, 0}))
+	ts[5] = shadowProj.Mul4(mgl32.LookAtV(lp, lp.Add(mgl32.Vec3{0, 0, -1}), mgl32.Vec3{0, -1, 0}))
 
 	l.depthUpdateLamps[index] = true
+	l.lampsChanged = true
 }
 
 // UpdateLamps updates all lamps (expensive)
-func (l *Lighting) UpdateLamps(ps ...*Program) {
+func (l *Lighting) UpdateLamps() {
 	for i := range l.lamps {
-		l.UpdateLampI(i, ps...)
+		l.UpdateLampI(i)
 	}
 }
 
-// UpdateLamp updates a single lamp (for the shaders provided), and also marks
-// it as needing an update on the next depth map pass
-func (l *Lighting) UpdateLamp(lamp *Lamp, ps ...*Program) {
-	index := -1
-	for i, l := range l.lamps {
-		if l == lamp {
-			index = i
-			break
+func (l *Lighting) lampIndex(lamp *Lamp) int {
+	for i, ll := range l.lamps {
+		if ll == lamp {
+			return i
 		}
 	}
+
+	return -1
+}
+
+// UpdateLamp updates a single lamp (on the next call to Update), and also
+// marks it as needing an update on the next depth map pass
+func (l *Lighting) UpdateLamp(lamp *Lamp) {
+	index := l.lampIndex(lamp)
 	if index == -1 {
 		return
 	}
 
-	l.UpdateLampI(index, ps...)
+	l.UpdateLampI(index)
 }
 
-// Update re-sets all of the light parameter uniforms (except for point lamps,
-// which should be updated individually for performance)
-func (l *Lighting) Update(ps ...*Program) {
-	for _, p := range ps {
-		p.SetUniformVec3("view_pos", l.viewPos)
-		p.SetUniformFloat32("far_plane", farPlane)
-		p.SetUniformBool("shadows_enabled", l.ShadowsEnabled)
+// AddLamp adds a point light
+func (l *Lighting) AddLamp(lamp *Lamp) {
+	withDefaultShadow(&lamp.Shadow)
+
+	l.lamps = append(l.lamps, lamp)
+	l.depthUpdateLamps = append(l.depthUpdateLamps, false)
+	l.lampShadowTransforms = append(l.lampShadowTransforms, [6]mgl32.Mat4{})
+	// Given a cube map on the next call to Update
+	l.lampShadowSlots = append(l.lampShadowSlots, -2)
 
-		for i, spot := range l.spotlights {
-			base := fmt.Sprintf("spotlights[%v]", i)
+	l.UpdateLampI(len(l.lamps) - 1)
+}
+
+// RemoveLamp removes a point light
+func (l *Lighting) RemoveLamp(lamp *Lamp) {
+	index := l.lampIndex(lamp)
+	if index == -1 {
+		return
+	}
 
-			p.SetUniformFloat32(base+".attenuation.constant", spot.Attenuation.Constant)
-			p.SetUniformFloat32(base+".attenuation.linear", spot.Attenuation.Linear)
-			p.SetUniformFloat32(base+".attenuation.quadratic", spot.Attenuation.Quadratic)
+	l.lamps = append(l.lamps[:index], l.lamps[index+1:]...)
+	l.depthUpdateLamps = append(l.depthUpdateLamps[:index], l.depthUpdateLamps[index+1:]...)
+	l.lampShadowTransforms = append(l.lampShadowTransforms[:index], l.lampShadowTransforms[index+1:]...)
+	// The following lamps' cube maps are moved down on the next call to Update
+	l.lampShadowSlots = append(l.lampShadowSlots[:index], l.lampShadowSlots[index+1:]...)
+	l.lampsChanged = true
+}
 
-			p.SetUniformVec3(base+".position", spot.Position)
-			p.SetUniformVec3(base+".direction", spot.Direction)
+// AddDirectionalLight adds a directional light
+func (l *Lighting) AddDirectionalLight(d *DirectionalLight) {
+	withDefaultShadow(&d.Shadow)
 
-			p.SetUniformFloat32(base+".cutoff", spot.Cutoff)
-			p.SetUniformFloat32(base+".outer_cutoff", spot.OuterCutoff)
+	l.dirs = append(l.dirs, d)
+	l.allocDirDepthMaps()
+}
 
-			p.SetUniformVec3(base+".ambient", spot.Ambient)
-			p.SetUniformVec3(base+".diffuse", spot.Diffuse)
-			p.SetUniformVec3(base+".specular", spot.Specular)
+// RemoveDirectionalLight removes a directional light
+func (l *Lighting) RemoveDirectionalLight(d *DirectionalLight) {
+	for i, dd := range l.dirs {
+		if dd == d {
+			l.dirs = append(l.dirs[:i], l.dirs[i+1:]...)
+			return
 		}
+	}
+}
 
-		for i, dir := range l.dirs {
-			base := fmt.Sprintf("dirs[%v]", i)
+// AddSpotlight adds a spotlight
+func (l *Lighting) AddSpotlight(s *Spotlight) {
+	withDefaultShadow(&s.Shadow)
 
-			p.SetUniformVec3(base+".direction", dir.Direction)
+	l.spotlights = append(l.spotlights, s)
+	l.allocSpotDepthMaps()
+}
 
-			p.SetUniformVec3(base+".ambient", dir.Ambient)
-			p.SetUniformVec3(base+".diffuse", dir.Diffuse)
-			p.SetUniformVec3(base+".specular", dir.Specular)
+// RemoveSpotlight removes a spotlight
+func (l *Lighting) RemoveSpotlight(s *Spotlight) {
+	for i, ss := range l.spotlights {
+		if ss == s {
+			l.spotlights = append(l.spotlights[:i], l.spotlights[i+1:]...)
+			return
 		}
 	}
 }
 
+// Update uploads the directional lights and spotlights (and point lamps if
+// any have been added, removed or updated) to the light buffers, sets the
+// remaining lighting uniforms and recalculates the shadow transforms.
+// Changes to a light's shadow parameters are applied by this (after
+// UpdateLamp for point lamps).
+func (l *Lighting) Update(ps ...*Program) {
+	l.updateCascades()
+	l.updateSpotShadows()
+
+	l.uploadDirs()
+	l.uploadSpotlights()
+	if l.lampsChanged {
+		l.assignShadowSlots()
+		l.uploadLamps()
+		l.lampsChanged = false
+	}
+
+	l.dirsBuffer.BindBase(dirsBinding)
+	l.lampsBuffer.BindBase(lampsBinding)
+	l.spotlightsBuffer.BindBase(spotlightsBinding)
+
+	l.updateClusters()
+	l.clustersBuffer.BindBase(clustersBinding)
+
+	if l.deferredProgram != nil {
+		ps = append(ps, l.deferredProgram)
+	}
+	if l.AmbientOcclusion != nil {
+		gl.ActiveTexture(gl.TEXTURE0 + ambientOcclusionUnit)
+		l.AmbientOcclusion.Bind()
+	}
+	for _, p := range ps {
+		p.SetUniformVec3("view_pos", l.viewPos)
+		p.SetUniformFloat32("far_plane", farPlane)
+		p.SetUniformBool("shadows_enabled", l.ShadowsEnabled)
+		p.SetUniformFloat32Slice("cascade_splits", l.cascadeSplits)
+		p.SetUniformFloat32Slice("cascade_radii", l.cascadeRadii)
+		p.SetUniformFloat32("spot_near_plane", spotNearPlane)
+		p.SetUniformVec2("viewport_size", l.viewportSize)
+		p.SetUniformFloat32("cluster_near", l.clusterNear)
+		p.SetUniformFloat32("cluster_far", l.clusterFar)
+		p.SetUniformBool("ssao_enabled", l.AmbientOcclusion != nil)
+	}
+}
+
 // DrawCubes renders the lights in the scene as cubes (coloured by their diffuse
 // colour)
 func (l *Lighting) DrawCubes(projection mgl32.Mat4, c *Camera) {
@@ -388,36 +634,78 @@ type DepthMapParamsApplicator = func(p *Program)
 type DepthMapRenderFunc = func(DepthMapParamsApplicator)
 
 // ShadowsDepthPass renders the scene from each lamp's perspective to generate
-// a set of depth maps
+// a set of depth maps, from each directional light for each cascade and from
+// each spotlight (the callback is called once for each lamp which needs an
+// update, each directional light and each spotlight)
 func (l *Lighting) ShadowsDepthPass(cb DepthMapRenderFunc) {
 	if !l.ShadowsEnabled {
 		return
 	}
 
+	l.lampsDepthPass(cb)
+	l.dirsDepthPass(cb)
+	l.spotsDepthPass(cb)
+}
+
+func (l *Lighting) dirsDepthPass(cb DepthMapRenderFunc) {
+	gl.Viewport(0, 0, CascadeResolution, CascadeResolution)
+	l.dirDepthMapsFBO.Bind()
+	gl.Clear(gl.DEPTH_BUFFER_BIT)
+
+	for i := range l.dirs {
+		cb(func(p *Program) {
+			p.Use()
+
+			p.SetUniformInt("shadow_pass", shadowPassDirs)
+			p.SetUniformInt("shadow_layer_base", int32(i*ShadowCascades))
+			p.SetUniformInt("shadow_layers", ShadowCascades)
+			p.SetUniformMat4Slice("shadow_transforms", l.dirShadowTransforms[i][:])
+		})
+	}
+
+	l.dirDepthMapsFBO.Unbind()
+
+	// Not part of the material, so the meshes won't bind it
+	gl.ActiveTexture(gl.TEXTURE0 + dirDepthMapsUnit)
+	l.DirDepthMaps.Bind()
+	l.bindCompare(dirCompareUnit, l.DirDepthMaps)
+}
+
+// clearDepth is the value depth maps are cleared to
+var clearDepth = float32(1)
+
+func (l *Lighting) lampsDepthPass(cb DepthMapRenderFunc) {
 	gl.Viewport(0, 0, ShadowResolution, ShadowResolution)
 	l.depthMapsFBO.Bind()
-	gl.Clear(gl.DEPTH_BUFFER_BIT)
 
-	lampPositions := make([]mgl32.Vec3, len(l.lamps))
 	for i, lamp := range l.lamps {
-		lampPositions[i] = lamp.Position
-	}
+		slot := l.lampShadowSlots[i]
+		if !l.depthUpdateLamps[i] || slot < 0 {
+			continue
+		}
 
-	cb(func(p *Program) {
-		p.Use()
+		// Only clear this lamp's faces, the others keep their maps
+		gl.ClearTexSubImage(l.DepthMaps.id, 0, 0, 0, int32(slot*6), ShadowResolution, ShadowResolution, 6, gl.DEPTH_COMPONENT, gl.FLOAT, gl.Ptr(&clearDepth))
 
-		// For geometry shader
-		p.SetUniformBoolSlice("update_lamps", l.depthUpdateLamps)
-		p.SetUniformMat4Slice("shadow_transforms", l.lampShadowTransforms)
+		cb(func(p *Program) {
+			p.Use()
 
-		// For fragment shader
-		p.SetUniformVec3Slice("lamp_positions", lampPositions)
-		p.SetUniformFloat32("far_plane", farPlane)
-	})
+			p.SetUniformInt("shadow_pass", shadowPassLamps)
+			// For geometry shader
+			p.SetUniformInt("shadow_layer_base", int32(slot*6))
+			p.SetUniformInt("shadow_layers", 6)
+			p.SetUniformMat4Slice("shadow_transforms", l.lampShadowTransforms[i][:])
+
+			// For fragment shader
+			p.SetUniformVec3("lamp_position", lamp.Position)
+			p.SetUniformFloat32("far_plane", farPlane)
+		})
 
-	for i := range l.depthUpdateLamps {
 		l.depthUpdateLamps[i] = false
 	}
 
 	l.depthMapsFBO.Unbind()
+
+	// The meshes only bind these for sampling directly
+	l.bindCompare(lampCompareUnit, l.DepthMaps)
 }
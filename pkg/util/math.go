@@ -17,6 +17,16 @@ func Ceil(x float32) float32 {
 	return float32(math.Ceil(float64(x)))
 }
 
+// Abs calculates single precision abs()
+func Abs(x float32) float32 {
+	return float32(math.Abs(float64(x)))
+}
+
+// Sqrt calculates single precision sqrt()
+func Sqrt(x float32) float32 {
+	return float32(math.Sqrt(float64(x)))
+}
+
 // Sin calculates single precision sin()
 func Sin(x float32) float32 {
 	return float32(math.Sin(float64(x)))
@@ -47,6 +57,23 @@ func PosFromTrans(trans mgl32.Mat4) mgl32.Vec3 {
 	return trans.Col(3).Vec3()
 }
 
+// DecomposeTransform splits an affine transform (without shear) into its
+// translation, rotation and scale
+func DecomposeTransform(m mgl32.Mat4) (mgl32.Vec3, mgl32.Quat, mgl32.Vec3) {
+	sx, sy, sz := mgl32.Extract3DScale(m)
+	if sx == 0 || sy == 0 || sz == 0 {
+		return PosFromTrans(m), mgl32.QuatIdent(), mgl32.Vec3{sx, sy, sz}
+	}
+
+	rot := mgl32.Mat4FromCols(
+		m.Col(0).Mul(1/sx),
+		m.Col(1).Mul(1/sy),
+		m.Col(2).Mul(1/sz),
+		mgl32.Vec4{0, 0, 0, 1},
+	)
+	return PosFromTrans(m), mgl32.Mat4ToQuat(rot).Normalize(), mgl32.Vec3{sx, sy, sz}
+}
+
 // Interpolate calculates the linear interpolation between two values
 func Interpolate(a, b, t float32) float32 {
 	return (b * t) + ((1 - t) * a)
@@ -97,6 +124,74 @@ func QuatSlerp(q1, q2 mgl32.Quat, amount float32) mgl32.Quat {
 	return q1.Scale(c).Add(rel.Scale(s))
 }
 
+// CalculateNormals computes smooth per-vertex normals for a set of triangles
+// (each vertex's normal is the area-weighted average of its faces' normals)
+func CalculateNormals(positions []mgl32.Vec3, indices []uint32) []mgl32.Vec3 {
+	normals := make([]mgl32.Vec3, len(positions))
+	for i := 0; i+2 < len(indices); i += 3 {
+		a, b, c := indices[i], indices[i+1], indices[i+2]
+		n := positions[b].Sub(positions[a]).Cross(positions[c].Sub(positions[a]))
+
+		normals[a] = normals[a].Add(n)
+		normals[b] = normals[b].Add(n)
+		normals[c] = normals[c].Add(n)
+	}
+
+	for i, n := range normals {
+		if n.Len() != 0 {
+			normals[i] = n.Normalize()
+		}
+	}
+
+	return normals
+}
+
+// CalculateTangents computes per-vertex tangents and bitangents for a set of
+// triangles (needed for normal mapping) from their positions, normals and UV's
+func CalculateTangents(positions, normals []mgl32.Vec3, uvs []mgl32.Vec2, indices []uint32) ([]mgl32.Vec3, []mgl32.Vec3) {
+	tangents := make([]mgl32.Vec3, len(positions))
+	bitangents := make([]mgl32.Vec3, len(positions))
+	for i := 0; i+2 < len(indices); i += 3 {
+		a, b, c := indices[i], indices[i+1], indices[i+2]
+
+		e1 := positions[b].Sub(positions[a])
+		e2 := positions[c].Sub(positions[a])
+		d1 := uvs[b].Sub(uvs[a])
+		d2 := uvs[c].Sub(uvs[a])
+
+		det := d1.X()*d2.Y() - d2.X()*d1.Y()
+		if det == 0 {
+			continue
+		}
+		r := 1 / det
+
+		t := e1.Mul(d2.Y()).Sub(e2.Mul(d1.Y())).Mul(r)
+		bt := e2.Mul(d1.X()).Sub(e1.Mul(d2.X())).Mul(r)
+		for _, j := range []uint32{a, b, c} {
+			tangents[j] = tangents[j].Add(t)
+			bitangents[j] = bitangents[j].Add(bt)
+		}
+	}
+
+	for i, n := range normals {
+		// Gram-Schmidt orthogonalize against the normal
+		t := tangents[i].Sub(n.Mul(n.Dot(tangents[i])))
+		if t.Len() == 0 {
+			tangents[i], bitangents[i] = mgl32.Vec3{}, mgl32.Vec3{}
+			continue
+		}
+		tangents[i] = t.Normalize()
+
+		bt := n.Cross(tangents[i])
+		if bt.Dot(bitangents[i]) < 0 {
+			bt = bt.Mul(-1)
+		}
+		bitangents[i] = bt
+	}
+
+	return tangents, bitangents
+}
+
 // Bounds represents a 3D box
 type Bounds struct {
 	Min mgl32.Vec3
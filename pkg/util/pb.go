@@ -34,3 +34,33 @@ func PBMat4(i *pb.Mat4) mgl32.Mat4 {
 		PBVec4(i.D),
 	)
 }
+
+// Vec2PB converts an mgl32.Vec2 to an Object protobuf Vec2
+func Vec2PB(v mgl32.Vec2) *pb.Vec2 {
+	return &pb.Vec2{X: v.X(), Y: v.Y()}
+}
+
+// Vec3PB converts an mgl32.Vec3 to an Object protobuf Vec3
+func Vec3PB(v mgl32.Vec3) *pb.Vec3 {
+	return &pb.Vec3{X: v.X(), Y: v.Y(), Z: v.Z()}
+}
+
+// Vec4PB converts an mgl32.Vec4 to an Object protobuf Vec4
+func Vec4PB(v mgl32.Vec4) *pb.Vec4 {
+	return &pb.Vec4{X: v.X(), Y: v.Y(), Z: v.Z(), W: v.W()}
+}
+
+// QuatPB converts an mgl32.Quat to an Object protobuf Vec4
+func QuatPB(q mgl32.Quat) *pb.Vec4 {
+	return &pb.Vec4{X: q.X(), Y: q.Y(), Z: q.Z(), W: q.W}
+}
+
+// Mat4PB converts an mgl32.Mat4 to an Object protobuf Mat4
+func Mat4PB(m mgl32.Mat4) *pb.Mat4 {
+	return &pb.Mat4{
+		A: Vec4PB(m.Row(0)),
+		B: Vec4PB(m.Row(1)),
+		C: Vec4PB(m.Row(2)),
+		D: Vec4PB(m.Row(3)),
+	}
+}
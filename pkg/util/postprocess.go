@@ -0,0 +1,230 @@
+package util
+
+import (
+	"fmt"
+
+	"github.com/go-gl/gl/v4.6-core/gl"
+)
+
+// ToneMapper selects how HDR colours are mapped to the display's range
+type ToneMapper int32
+
+const (
+	// ToneMapClamp clips colours over 1
+	ToneMapClamp ToneMapper = iota
+	// ToneMapReinhard compresses colours with x / (x + 1)
+	ToneMapReinhard
+	// ToneMapACES uses a fit of the ACES filmic curve
+	ToneMapACES
+
+	toneMapperCount
+)
+
+var toneMapperNames = map[string]ToneMapper{
+	"clamp":    ToneMapClamp,
+	"reinhard": ToneMapReinhard,
+	"aces":     ToneMapACES,
+}
+
+// UnmarshalText parses a tone mapper from its name
+func (t *ToneMapper) UnmarshalText(text []byte) error {
+	v, ok := toneMapperNames[string(text)]
+	if !ok {
+		return fmt.Errorf("unknown tone mapper %v", string(text))
+	}
+
+	*t = v
+	return nil
+}
+
+// String returns the tone mapper's name
+func (t ToneMapper) String() string {
+	for name, v := range toneMapperNames {
+		if v == t {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("ToneMapper(%d)", int32(t))
+}
+
+// Next returns the tone mapper after this one (wrapping around)
+func (t ToneMapper) Next() ToneMapper {
+	return (t + 1) % toneMapperCount
+}
+
+// PostProcess renders the scene to an HDR target, which is then blurred for
+// bloom and tone mapped to the screen
+type PostProcess struct {
+	// Exposure scales the HDR colours before tone mapping
+	Exposure   float32
+	ToneMapper ToneMapper
+
+	Bloom bool
+	// BloomThreshold is the brightness over which pixels bloom (emissive
+	// surfaces always do)
+	BloomThreshold float32
+	BloomIntensity float32
+	// BloomPasses is the number of times the bloom is blurred (horizontally
+	// and vertically)
+	BloomPasses int
+
+	width, height int32
+
+	hdrFBO *Framebuffer
+	// Colour holds the lit scene and Emissive what should bloom regardless of
+	// its brightness
+	Colour   *Texture
+	Emissive *Texture
+	depth    *Texture
+
+	// Ping-pong targets for the bloom at half resolution
+	bloomFBOs     [2]*Framebuffer
+	bloomTextures [2]*Texture
+
+	brightProgram  *Program
+	blurProgram    *Program
+	tonemapProgram *Program
+	vao            uint32
+}
+
+// newColourTarget allocates a floating point texture and attaches it to a
+// framebuffer
+func newColourTarget(fbo *Framebuffer, attachment uint32, w, h int32) *Texture {
+	t := NewTexture(gl.TEXTURE_2D)
+	t.SetData2D(gl.TEXTURE_2D, 0, gl.RGBA16F, w, h, 0, gl.RGBA, gl.FLOAT, nil)
+	t.SetIParameter(gl.TEXTURE_MIN_FILTER, gl.LINEAR)
+	t.SetIParameter(gl.TEXTURE_MAG_FILTER, gl.LINEAR)
+	t.SetIParameter(gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	t.SetIParameter(gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+
+	fbo.SetTexture(attachment, t, 0)
+	return t
+}
+
+// NewPostProcess creates the HDR target and post-processing shaders for a
+// screen of the given size
+func NewPostProcess(w, h int32) (*PostProcess, error) {
+	p := &PostProcess{
+		Exposure:   1,
+		ToneMapper: ToneMapACES,
+
+		Bloom:          true,
+		BloomThreshold: 1,
+		BloomIntensity: 0.6,
+		BloomPasses:    4,
+
+		width:  w,
+		height: h,
+
+		hdrFBO: NewFramebuffer(gl.FRAMEBUFFER),
+		depth:  NewTexture(gl.TEXTURE_2D),
+	}
+
+	p.Colour = newColourTarget(p.hdrFBO, gl.COLOR_ATTACHMENT0, w, h)
+	p.Emissive = newColourTarget(p.hdrFBO, gl.COLOR_ATTACHMENT1, w, h)
+	p.depth.SetData2D(gl.TEXTURE_2D, 0, gl.DEPTH_COMPONENT32F, w, h, 0, gl.DEPTH_COMPONENT, gl.FLOAT, nil)
+	p.depth.SetIParameter(gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	p.depth.SetIParameter(gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	p.hdrFBO.SetTexture(gl.DEPTH_ATTACHMENT, p.depth, 0)
+
+	attachments := []uint32{gl.COLOR_ATTACHMENT0, gl.COLOR_ATTACHMENT1}
+	gl.DrawBuffers(int32(len(attachments)), &attachments[0])
+	if status := gl.CheckFramebufferStatus(gl.FRAMEBUFFER); status != gl.FRAMEBUFFER_COMPLETE {
+		return nil, fmt.Errorf("HDR framebuffer incomplete (status 0x%x)", status)
+	}
+
+	for i := range p.bloomFBOs {
+		p.bloomFBOs[i] = NewFramebuffer(gl.FRAMEBUFFER)
+		p.bloomTextures[i] = newColourTarget(p.bloomFBOs[i], gl.COLOR_ATTACHMENT0, w/2, h/2)
+		if status := gl.CheckFramebufferStatus(gl.FRAMEBUFFER); status != gl.FRAMEBUFFER_COMPLETE {
+			return nil, fmt.Errorf("bloom framebuffer incomplete (status 0x%x)", status)
+		}
+	}
+	p.hdrFBO.Unbind()
+
+	programs := []struct {
+		name string
+		file string
+		dst  **Program
+	}{
+		{"bright pass", "assets/shaders/bloom_bright.fs", &p.brightProgram},
+		{"blur", "assets/shaders/bloom_blur.fs", &p.blurProgram},
+		{"tone mapping", "assets/shaders/tonemap.fs", &p.tonemapProgram},
+	}
+	for _, sp := range programs {
+		*sp.dst = NewProgram()
+		if err := (*sp.dst).LinkFiles(fullscreenVertShaderFile, sp.file, ""); err != nil {
+			return nil, fmt.Errorf("failed to set up %v shader: %w", sp.name, err)
+		}
+	}
+
+	gl.GenVertexArrays(1, &p.vao)
+
+	return p, nil
+}
+
+// Bind binds and clears the HDR target for the scene to be drawn to
+func (p *PostProcess) Bind() {
+	p.hdrFBO.Bind()
+	gl.Viewport(0, 0, p.width, p.height)
+	gl.Clear(gl.COLOR_BUFFER_BIT | gl.DEPTH_BUFFER_BIT)
+}
+
+func (p *PostProcess) drawScreen() {
+	gl.BindVertexArray(p.vao)
+	gl.DrawArrays(gl.TRIANGLES, 0, 3)
+}
+
+// bloomPass extracts the bright parts of the scene and blurs them, returning
+// the texture holding the result
+func (p *PostProcess) bloomPass() *Texture {
+	gl.Viewport(0, 0, p.width/2, p.height/2)
+
+	p.bloomFBOs[0].Bind()
+	p.brightProgram.Use()
+	p.brightProgram.SetUniformFloat32("threshold", p.BloomThreshold)
+	p.Colour.Activate(p.brightProgram, "hdr_color", 0)
+	p.Emissive.Activate(p.brightProgram, "hdr_emissive", 1)
+	p.drawScreen()
+
+	// Blur back and forth between the two targets
+	p.blurProgram.Use()
+	for i := 0; i < p.BloomPasses*2; i++ {
+		p.bloomFBOs[(i+1)%2].Bind()
+		p.blurProgram.SetUniformBool("horizontal", i%2 == 0)
+		p.bloomTextures[i%2].Activate(p.blurProgram, "image", 0)
+		p.drawScreen()
+	}
+
+	return p.bloomTextures[0]
+}
+
+// Draw applies bloom and tone mapping to the HDR target, drawing the result to
+// the default framebuffer
+func (p *PostProcess) Draw() {
+	gl.Disable(gl.DEPTH_TEST)
+
+	var bloom *Texture
+	if p.Bloom {
+		bloom = p.bloomPass()
+	}
+
+	p.hdrFBO.Unbind()
+	gl.Viewport(0, 0, p.width, p.height)
+	gl.Clear(gl.DEPTH_BUFFER_BIT)
+
+	t := p.tonemapProgram
+	t.Use()
+	t.SetUniformFloat32("exposure", p.Exposure)
+	t.SetUniformInt("tone_mapper", int32(p.ToneMapper))
+	t.SetUniformBool("bloom_enabled", bloom != nil)
+	t.SetUniformFloat32("bloom_intensity", p.BloomIntensity)
+	p.Colour.Activate(t, "hdr_color", 0)
+	if bloom != nil {
+		bloom.Activate(t, "bloom", 1)
+	}
+	p.drawScreen()
+
+	gl.Enable(gl.DEPTH_TEST)
+}
@@ -121,6 +121,16 @@ func (p *Program) SetUniformFloat32(n string, val float32) {
 	gl.Uniform1fv(p.Uniform(n), 1, &val)
 }
 
+// SetUniformFloat32Slice sets a float array uniform
+func (p *Program) SetUniformFloat32Slice(n string, vals []float32) {
+	gl.Uniform1fv(p.Uniform(n), int32(len(vals)), &vals[0])
+}
+
+// SetUniformVec2 sets a vec2 uniform value
+func (p *Program) SetUniformVec2(n string, val mgl32.Vec2) {
+	gl.Uniform2fv(p.Uniform(n), 1, &val[0])
+}
+
 // SetUniformVec3 sets a vec3 uniform value
 func (p *Program) SetUniformVec3(n string, val mgl32.Vec3) {
 	gl.Uniform3fv(p.Uniform(n), 1, &val[0])
@@ -0,0 +1,129 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-gl/gl/v4.6-core/gl"
+)
+
+// ShadowFilter selects how a light's shadow map is sampled
+type ShadowFilter int32
+
+const (
+	// ShadowFilterDefault uses DefaultShadowParams' filter
+	ShadowFilterDefault ShadowFilter = iota
+	// ShadowFilterHard does a single depth comparison
+	ShadowFilterHard
+	// ShadowFilterHardware uses hardware depth comparison, which bilinearly
+	// filters the results of the 4 nearest texels
+	ShadowFilterHardware
+	// ShadowFilterPCFGrid averages comparisons over a regular grid of texels
+	ShadowFilterPCFGrid
+	// ShadowFilterPCFPoisson averages comparisons over a (randomly rotated)
+	// Poisson disk
+	ShadowFilterPCFPoisson
+	// ShadowFilterPCSS varies the Poisson disk's radius with the distance
+	// between the occluder and the receiver, so shadows harden near contact
+	ShadowFilterPCSS
+)
+
+var shadowFilterNames = map[string]ShadowFilter{
+	"default":     ShadowFilterDefault,
+	"hard":        ShadowFilterHard,
+	"hardware":    ShadowFilterHardware,
+	"pcf-grid":    ShadowFilterPCFGrid,
+	"pcf-poisson": ShadowFilterPCFPoisson,
+	"pcss":        ShadowFilterPCSS,
+}
+
+// UnmarshalText parses a shadow filter from its name
+func (f *ShadowFilter) UnmarshalText(text []byte) error {
+	v, ok := shadowFilterNames[string(text)]
+	if !ok {
+		return fmt.Errorf("unknown shadow filter %v", string(text))
+	}
+
+	*f = v
+	return nil
+}
+
+// ShadowParams configures the filtering and biasing of a light's shadow.
+// Distances given in texels are converted to world units using the size of a
+// shadow map texel at the receiving surface. Fields missing when decoding from
+// JSON take their values from DefaultShadowParams.
+type ShadowParams struct {
+	Filter ShadowFilter
+	// Bias is a constant depth bias in world units
+	Bias float32
+	// SlopeBias is added to the bias in texels, scaled by the tangent of the
+	// angle between the surface and the light
+	SlopeBias float32
+	// NormalOffset moves the point looked up along the surface normal (in
+	// texels, more so as the surface faces away from the light)
+	NormalOffset float32
+	// Radius of the PCF filters in texels
+	Radius float32
+	// Samples is the number of PCF samples (up to 16 for Poisson and PCSS,
+	// rounded down to a square for the grid)
+	Samples int32
+	// LightSize is the size of the light for PCSS (in world units for lamps and
+	// spotlights, or the penumbra width per unit of distance from the occluder
+	// for directional lights)
+	LightSize float32
+}
+
+// DefaultShadowParams are used for lights whose ShadowParams are unset (and
+// for the fields not given in JSON)
+var DefaultShadowParams = ShadowParams{
+	Filter:       ShadowFilterPCFPoisson,
+	Bias:         0.02,
+	SlopeBias:    1,
+	NormalOffset: 1,
+	Radius:       1.5,
+	Samples:      16,
+	LightSize:    0.2,
+}
+
+// UnmarshalJSON decodes shadow params over the defaults, so that only the
+// fields given are changed (and zero values can still be set)
+func (p *ShadowParams) UnmarshalJSON(data []byte) error {
+	// Without the methods, to avoid recursing
+	type params ShadowParams
+
+	v := params(DefaultShadowParams)
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	*p = ShadowParams(v)
+	return nil
+}
+
+// withDefaultShadow fills in unset shadow params (all of them for the zero
+// value, otherwise just the filter)
+func withDefaultShadow(p *ShadowParams) {
+	if *p == (ShadowParams{}) {
+		*p = DefaultShadowParams
+	} else if p.Filter == ShadowFilterDefault {
+		p.Filter = DefaultShadowParams.Filter
+	}
+}
+
+func (l *Lighting) initCompareSampler() {
+	gl.GenSamplers(1, &l.compareSampler)
+	gl.SamplerParameteri(l.compareSampler, gl.TEXTURE_COMPARE_MODE, gl.COMPARE_REF_TO_TEXTURE)
+	gl.SamplerParameteri(l.compareSampler, gl.TEXTURE_COMPARE_FUNC, gl.LEQUAL)
+	gl.SamplerParameteri(l.compareSampler, gl.TEXTURE_MIN_FILTER, gl.LINEAR)
+	gl.SamplerParameteri(l.compareSampler, gl.TEXTURE_MAG_FILTER, gl.LINEAR)
+	gl.SamplerParameteri(l.compareSampler, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	gl.SamplerParameteri(l.compareSampler, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+	gl.SamplerParameteri(l.compareSampler, gl.TEXTURE_WRAP_R, gl.CLAMP_TO_EDGE)
+}
+
+// bindCompare binds a shadow map to a unit with the comparison sampler
+func (l *Lighting) bindCompare(unit uint32, t *Texture) {
+	gl.ActiveTexture(gl.TEXTURE0 + unit)
+	t.Bind()
+	gl.BindSampler(unit, l.compareSampler)
+}
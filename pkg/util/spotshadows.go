@@ -0,0 +1,98 @@
+package util
+
+import (
+	"math"
+
+	"github.com/go-gl/gl/v4.6-core/gl"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// DefaultSpotShadowResolution is the size of a spotlight's shadow map (square)
+// if it doesn't set its own
+const DefaultSpotShadowResolution = 1024
+
+// spotNearPlane is the near plane of spotlight shadow projections (further
+// than the lamps' since spotlight shadow maps store non-linear depth)
+const spotNearPlane = float32(0.5)
+
+func (s *Spotlight) shadowResolution() int32 {
+	if s.ShadowResolution == 0 {
+		return DefaultSpotShadowResolution
+	}
+
+	return s.ShadowResolution
+}
+
+func (l *Lighting) initSpotDepthMaps() {
+	l.SpotDepthMaps = NewTexture(gl.TEXTURE_2D_ARRAY)
+	l.spotDepthMapsFBO = NewFramebuffer(gl.FRAMEBUFFER)
+	l.allocSpotDepthMaps()
+}
+
+// allocSpotDepthMaps (re)allocates the spotlight shadow maps if there are more
+// spotlights than layers, or one of them has a higher resolution than the
+// layers. Each spotlight only uses as much of its layer as its resolution.
+func (l *Lighting) allocSpotDepthMaps() {
+	size := l.spotMapSize
+	for _, spot := range l.spotlights {
+		if r := spot.shadowResolution(); r > size {
+			size = r
+		}
+	}
+	if size == 0 {
+		size = DefaultSpotShadowResolution
+	}
+	if l.spotCapacity > 0 && len(l.spotlights) <= l.spotCapacity && size == l.spotMapSize {
+		return
+	}
+
+	if len(l.spotlights) > l.spotCapacity || l.spotCapacity == 0 {
+		l.spotCapacity = growCapacity(l.spotCapacity, len(l.spotlights))
+	}
+	l.spotMapSize = size
+	allocDepthArray(l.SpotDepthMaps, l.spotDepthMapsFBO, gl.TEXTURE_2D_ARRAY, l.spotMapSize, int32(l.spotCapacity))
+}
+
+// updateSpotShadows calculates the perspective transform for each spotlight's
+// shadow map, covering its outer cone
+func (l *Lighting) updateSpotShadows() {
+	if len(l.spotShadowTransforms) != len(l.spotlights) {
+		l.spotShadowTransforms = make([]mgl32.Mat4, len(l.spotlights))
+	}
+
+	for i, spot := range l.spotlights {
+		dir := spot.Direction.Normalize()
+		up := mgl32.Vec3{0, 1, 0}
+		if Abs(dir.Y()) > 0.99 {
+			up = mgl32.Vec3{0, 0, 1}
+		}
+
+		fov := 2 * float32(math.Acos(float64(spot.OuterCutoff)))
+		proj := mgl32.Perspective(fov, 1, spotNearPlane, farPlane)
+		l.spotShadowTransforms[i] = proj.Mul4(mgl32.LookAtV(spot.Position, spot.Position.Add(dir), up))
+	}
+}
+
+func (l *Lighting) spotsDepthPass(cb DepthMapRenderFunc) {
+	l.spotDepthMapsFBO.Bind()
+	gl.Clear(gl.DEPTH_BUFFER_BIT)
+
+	for i, spot := range l.spotlights {
+		res := spot.shadowResolution()
+		gl.Viewport(0, 0, res, res)
+
+		cb(func(p *Program) {
+			p.Use()
+
+			p.SetUniformInt("shadow_pass", shadowPassSpot)
+			p.SetUniformInt("shadow_layer_base", int32(i))
+			p.SetUniformInt("shadow_layers", 1)
+			p.SetUniformMat4Slice("shadow_transforms", l.spotShadowTransforms[i:i+1])
+		})
+	}
+	l.spotDepthMapsFBO.Unbind()
+
+	gl.ActiveTexture(gl.TEXTURE0 + spotDepthMapsUnit)
+	l.SpotDepthMaps.Bind()
+	l.bindCompare(spotCompareUnit, l.SpotDepthMaps)
+}
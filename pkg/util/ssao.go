@@ -0,0 +1,247 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+
+	"github.com/go-gl/gl/v4.6-core/gl"
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+const (
+	ssaoKernelSize = 32
+	// ssaoNoiseSize is the width of the (square) tiled rotation texture, which
+	// the blur averages over
+	ssaoNoiseSize = 4
+)
+
+// ambientOcclusionUnit is the texture unit the occlusion is bound to for the
+// lighting shader
+const ambientOcclusionUnit = 12
+
+type ssaoTemplateData struct {
+	KernelSize int
+	NoiseSize  int
+}
+
+// SSAO computes screen space ambient occlusion from a depth map and world
+// space normals, which darkens the ambient lighting in creases and corners
+type SSAO struct {
+	Enabled bool
+	// Radius of the hemisphere sampled around each point (in world units)
+	Radius float32
+	// Intensity is the power the unoccluded fraction is raised to
+	Intensity float32
+	// Bias stops surfaces from occluding themselves
+	Bias float32
+
+	width, height int32
+
+	// Prepass for forward rendering (deferred uses the G-buffer)
+	prepassFBO *Framebuffer
+	Normals    *Texture
+	Depth      *Texture
+
+	aoFBO   *Framebuffer
+	ao      *Texture
+	blurFBO *Framebuffer
+	// Occlusion holds the blurred result (1 where unoccluded)
+	Occlusion *Texture
+
+	kernel []mgl32.Vec3
+	noise  *Texture
+
+	program      *Program
+	blurProgram  *Program
+	debugProgram *Program
+	vao          uint32
+}
+
+// newOcclusionTarget allocates a single channel texture and attaches it to a
+// framebuffer
+func newOcclusionTarget(fbo *Framebuffer, w, h int32) *Texture {
+	t := NewTexture(gl.TEXTURE_2D)
+	t.SetData2D(gl.TEXTURE_2D, 0, gl.R16F, w, h, 0, gl.RED, gl.FLOAT, nil)
+	t.SetIParameter(gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	t.SetIParameter(gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	t.SetIParameter(gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	t.SetIParameter(gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+
+	fbo.SetTexture(gl.COLOR_ATTACHMENT0, t, 0)
+	return t
+}
+
+func linkScreenProgram(fsFile string, tplData interface{}) (*Program, error) {
+	vs, err := NewShaderFile(gl.VERTEX_SHADER, fullscreenVertShaderFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load vertex shader: %w", err)
+	}
+	if err := vs.Compile(); err != nil {
+		return nil, fmt.Errorf("failed to compile vertex shader: %w", err)
+	}
+	fs, err := NewShaderTemplateFile(gl.FRAGMENT_SHADER, fsFile, tplData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load fragment shader: %w", err)
+	}
+	if err := fs.Compile(); err != nil {
+		return nil, fmt.Errorf("failed to compile fragment shader: %w", err)
+	}
+
+	p := NewProgram()
+	if err := p.Link(vs, fs, nil); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// NewSSAO creates the SSAO targets and shaders for a screen of the given size
+func NewSSAO(w, h int32) (*SSAO, error) {
+	s := &SSAO{
+		Enabled:   true,
+		Radius:    0.5,
+		Intensity: 1.5,
+		Bias:      0.025,
+
+		width:  w,
+		height: h,
+
+		prepassFBO: NewFramebuffer(gl.FRAMEBUFFER),
+		Normals:    NewTexture(gl.TEXTURE_2D),
+		Depth:      NewTexture(gl.TEXTURE_2D),
+
+		aoFBO:   NewFramebuffer(gl.FRAMEBUFFER),
+		blurFBO: NewFramebuffer(gl.FRAMEBUFFER),
+	}
+
+	s.Normals.SetData2D(gl.TEXTURE_2D, 0, gl.RGBA16F, w, h, 0, gl.RGBA, gl.FLOAT, nil)
+	s.Normals.SetIParameter(gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	s.Normals.SetIParameter(gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	s.prepassFBO.SetTexture(gl.COLOR_ATTACHMENT0, s.Normals, 0)
+	s.Depth.SetData2D(gl.TEXTURE_2D, 0, gl.DEPTH_COMPONENT32F, w, h, 0, gl.DEPTH_COMPONENT, gl.FLOAT, nil)
+	s.Depth.SetIParameter(gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	s.Depth.SetIParameter(gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	s.Depth.SetIParameter(gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	s.Depth.SetIParameter(gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+	s.prepassFBO.SetTexture(gl.DEPTH_ATTACHMENT, s.Depth, 0)
+	if status := gl.CheckFramebufferStatus(gl.FRAMEBUFFER); status != gl.FRAMEBUFFER_COMPLETE {
+		return nil, fmt.Errorf("prepass framebuffer incomplete (status 0x%x)", status)
+	}
+
+	s.ao = newOcclusionTarget(s.aoFBO, w, h)
+	s.Occlusion = newOcclusionTarget(s.blurFBO, w, h)
+	s.blurFBO.Unbind()
+
+	// Samples in a hemisphere around +Z, more of them closer to the centre
+	r := rand.New(rand.NewSource(1))
+	s.kernel = make([]mgl32.Vec3, ssaoKernelSize)
+	for i := range s.kernel {
+		v := mgl32.Vec3{r.Float32()*2 - 1, r.Float32()*2 - 1, r.Float32()}.Normalize()
+
+		scale := float32(i) / ssaoKernelSize
+		s.kernel[i] = v.Mul(r.Float32() * Interpolate(0.1, 1, scale*scale))
+	}
+
+	noise := make([]mgl32.Vec3, ssaoNoiseSize*ssaoNoiseSize)
+	for i := range noise {
+		noise[i] = mgl32.Vec3{r.Float32()*2 - 1, r.Float32()*2 - 1, 0}
+	}
+	buf := &bytes.Buffer{}
+	binary.Write(buf, NativeOrder, noise)
+	s.noise = NewTexture(gl.TEXTURE_2D)
+	s.noise.SetData2D(gl.TEXTURE_2D, 0, gl.RGB16F, ssaoNoiseSize, ssaoNoiseSize, 0, gl.RGB, gl.FLOAT, buf.Bytes())
+	s.noise.SetIParameter(gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	s.noise.SetIParameter(gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	s.noise.SetIParameter(gl.TEXTURE_WRAP_S, gl.REPEAT)
+	s.noise.SetIParameter(gl.TEXTURE_WRAP_T, gl.REPEAT)
+
+	tplData := ssaoTemplateData{ssaoKernelSize, ssaoNoiseSize}
+	programs := []struct {
+		name string
+		file string
+		dst  **Program
+	}{
+		{"SSAO", "assets/shaders/ssao.fs", &s.program},
+		{"blur", "assets/shaders/ssao_blur.fs", &s.blurProgram},
+		{"debug", "assets/shaders/ssao_debug.fs", &s.debugProgram},
+	}
+	for _, sp := range programs {
+		var err error
+		if *sp.dst, err = linkScreenProgram(sp.file, tplData); err != nil {
+			return nil, fmt.Errorf("failed to set up %v shader: %w", sp.name, err)
+		}
+	}
+	s.program.SetUniformVec3Slice("kernel", s.kernel)
+
+	gl.GenVertexArrays(1, &s.vao)
+
+	return s, nil
+}
+
+// BeginPrepass binds and clears the prepass target and switches the lighting
+// programs to only output normals (for forward rendering)
+func (s *SSAO) BeginPrepass(ps ...*Program) {
+	s.prepassFBO.Bind()
+	gl.Viewport(0, 0, s.width, s.height)
+	gl.Clear(gl.COLOR_BUFFER_BIT | gl.DEPTH_BUFFER_BIT)
+
+	for _, p := range ps {
+		p.SetUniformBool("normal_pass", true)
+	}
+}
+
+// EndPrepass switches the lighting programs back to normal
+func (s *SSAO) EndPrepass(ps ...*Program) {
+	for _, p := range ps {
+		p.SetUniformBool("normal_pass", false)
+	}
+
+	s.prepassFBO.Unbind()
+}
+
+func (s *SSAO) drawScreen() {
+	gl.BindVertexArray(s.vao)
+	gl.DrawArrays(gl.TRIANGLES, 0, 3)
+}
+
+// Compute calculates the occlusion from a depth map and world space normals
+// (from the prepass or a G-buffer) rendered with the given projection and view
+func (s *SSAO) Compute(depth, normals *Texture, projection, view mgl32.Mat4) {
+	gl.Disable(gl.DEPTH_TEST)
+	gl.Viewport(0, 0, s.width, s.height)
+
+	s.aoFBO.Bind()
+	p := s.program
+	p.Use()
+	p.SetUniformMat4("projection", projection)
+	p.SetUniformMat4("inv_projection", projection.Inv())
+	p.SetUniformMat4("camera", view)
+	p.SetUniformFloat32("radius", s.Radius)
+	p.SetUniformFloat32("bias", s.Bias)
+	p.SetUniformFloat32("intensity", s.Intensity)
+	depth.Activate(p, "depth_map", 0)
+	normals.Activate(p, "normal_map", 1)
+	s.noise.Activate(p, "noise", 2)
+	s.drawScreen()
+
+	s.blurFBO.Bind()
+	s.blurProgram.Use()
+	s.ao.Activate(s.blurProgram, "occlusion", 0)
+	s.drawScreen()
+
+	s.blurFBO.Unbind()
+	gl.Enable(gl.DEPTH_TEST)
+}
+
+// DrawDebug shows the occlusion on the current framebuffer
+func (s *SSAO) DrawDebug() {
+	gl.Disable(gl.DEPTH_TEST)
+
+	s.debugProgram.Use()
+	s.Occlusion.Activate(s.debugProgram, "occlusion", 0)
+	s.drawScreen()
+
+	gl.Enable(gl.DEPTH_TEST)
+}
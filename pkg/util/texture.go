@@ -139,3 +139,14 @@ func (t *Texture) LoadJPEGFile(target uint32, file string) error {
 
 	return t.LoadJPEG(target, data)
 }
+
+// LoadPNGFile is a convenience method which reads a PNG file, decodes it and
+// uploads it to the texture on the GPU
+func (t *Texture) LoadPNGFile(target uint32, file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read file %v: %w", file, err)
+	}
+
+	return t.LoadPNG(target, data)
+}